@@ -1,6 +1,7 @@
 package controller
 
 import (
+	"crypto/subtle"
 	"log"
 	"net/http"
 
@@ -14,8 +15,15 @@ const authSecretKey = "c8b7b19b-19a0-4201-bc42-dfe6111d8819"
 const authService = "AuthService"
 const authExpirationInHours = 24
 
+// InternalSecretHeader carries the secret services share with the user
+// server to call its internal endpoints.
+const InternalSecretHeader = "X-Internal-Secret"
+
 type UserServer struct {
 	DB *gorm.DB
+	// InternalSecret is required from callers of internal endpoints, they
+	// are disabled without one
+	InternalSecret string
 }
 
 // LoginPayload login body
@@ -167,6 +175,102 @@ func (u *UserServer) Verify(c *gin.Context) {
 	})
 }
 
+// PreferencesPayload notification preferences body
+type PreferencesPayload struct {
+	Token       string `json:"token"`
+	EmailAlerts bool   `json:"email_alerts"`
+}
+
+// ContactResponse is what other services need to reach a user
+type ContactResponse struct {
+	UserID      string `json:"user_id"`
+	Email       string `json:"email"`
+	EmailAlerts bool   `json:"email_alerts"`
+}
+
+// Preferences updates the notification preferences of the logged in user
+func (u *UserServer) Preferences(c *gin.Context) {
+	var payload PreferencesPayload
+	err := c.ShouldBindJSON(&payload)
+	if err != nil {
+		c.JSON(400, gin.H{
+			"error": err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	jwtWrapper := jwt.Wrapper{
+		SecretKey:       authSecretKey,
+		Issuer:          authService,
+		ExpirationHours: authExpirationInHours,
+	}
+
+	claims, err := jwtWrapper.ValidateToken(payload.Token)
+	if err != nil {
+		log.Println(err)
+		c.JSON(401, gin.H{
+			"error": err.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	result := u.DB.Model(&models.User{}).Where("email = ?", claims.Email).Update("email_alerts", payload.EmailAlerts)
+	if result.Error != nil {
+		c.JSON(400, gin.H{
+			"error": result.Error.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"email_alerts": payload.EmailAlerts,
+	})
+}
+
+// Internal only lets through requests carrying the internal secret
+func (u *UserServer) Internal(c *gin.Context) {
+	secret := c.GetHeader(InternalSecretHeader)
+	if len(u.InternalSecret) == 0 || subtle.ConstantTimeCompare([]byte(secret), []byte(u.InternalSecret)) != 1 {
+		c.JSON(403, gin.H{
+			"msg": "internal endpoint",
+		})
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// Contact returns the email and notification preferences of a user
+func (u *UserServer) Contact(c *gin.Context) {
+	var user models.User
+
+	result := u.DB.Where("id = ?", c.Query("user_id")).First(&user)
+
+	if result.Error == gorm.ErrRecordNotFound {
+		c.JSON(404, gin.H{
+			"msg": "user not found",
+		})
+		c.Abort()
+		return
+	}
+	if result.Error != nil {
+		c.JSON(500, gin.H{
+			"error": result.Error.Error(),
+		})
+		c.Abort()
+		return
+	}
+
+	c.JSON(http.StatusOK, ContactResponse{
+		UserID:      user.ID,
+		Email:       user.Email,
+		EmailAlerts: user.EmailAlerts,
+	})
+}
+
 func (u *UserServer) VerifyAPIKey(c *gin.Context) {
 	var user models.User
 
@@ -19,6 +19,8 @@ type User struct {
 	Email     string     `json:"email" gorm:"unique"`
 	Password  string     `json:"password"`
 	APIKey    string     `json:"api_key"`
+	// EmailAlerts sends alert and issue notifications to Email
+	EmailAlerts bool `json:"email_alerts"`
 }
 
 func (user *User) BeforeCreate(tx *gorm.DB) (err error) {
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+
+	empty "google.golang.org/protobuf/types/known/emptypb"
+
+	pb "github.com/loggysh/loggy/loggy"
+	"github.com/loggysh/loggy/service"
+)
+
+// Notification types for alert state changes.
+const (
+	NotificationAlertFiring   = "alert.firing"
+	NotificationAlertResolved = "alert.resolved"
+)
+
+const (
+	alertEvaluationInterval = 15 * time.Second
+	// messages waiting to be fed to the rules
+	alertQueueSize = 10000
+)
+
+type alertRuleState struct {
+	rule service.AlertRule
+	// timestamps of matching messages still inside the rule window
+	hits []time.Time
+}
+
+// alertObservation is a message waiting to be fed to the rules of its
+// application.
+type alertObservation struct {
+	appID string
+	msg   *pb.Message
+	at    time.Time
+}
+
+// alertTransition is a state change of a rule to record and notify once the
+// rules are unlocked.
+type alertTransition struct {
+	rule  service.AlertRule
+	event *service.AlertEvent
+}
+
+// alertEngine evaluates alert rules against incoming messages. Threshold
+// and match rules are fed by observe, absence rules and resolving of
+// quiet rules happen in evaluate. Both run on the goroutine of run, off the
+// ingestion path, and state changes are recorded outside the lock.
+type alertEngine struct {
+	lock     sync.Mutex
+	db       *gorm.DB
+	rules    map[string]map[int32]*alertRuleState // appid -> ruleid -> state
+	lastSeen map[string]time.Time                 // appid -> last message
+	started  time.Time
+	notify   func(rule *service.AlertRule, event *pb.AlertEvent)
+	queue    chan alertObservation
+
+	// matcher holds the message being observed so match rules can run
+	// the same query string syntax as search against it, only run uses it
+	matcher bleve.Index
+}
+
+func newAlertEngine(db *gorm.DB, analyzer string, notify func(rule *service.AlertRule, event *pb.AlertEvent)) (*alertEngine, error) {
+	matcher, err := bleve.NewMemOnly(service.NewIndexMapping(analyzer))
+	if err != nil {
+		return nil, err
+	}
+	engine := &alertEngine{
+		db:       db,
+		rules:    make(map[string]map[int32]*alertRuleState),
+		lastSeen: make(map[string]time.Time),
+		started:  time.Now(),
+		notify:   notify,
+		queue:    make(chan alertObservation, alertQueueSize),
+		matcher:  matcher,
+	}
+
+	var rules []*service.AlertRule
+	if err := db.Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	for _, rule := range rules {
+		engine.put(rule)
+	}
+	return engine, nil
+}
+
+// put adds or replaces a rule, starting its window from scratch.
+func (e *alertEngine) put(rule *service.AlertRule) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.removeLocked(rule.ID)
+	if e.rules[rule.AppID] == nil {
+		e.rules[rule.AppID] = make(map[int32]*alertRuleState)
+	}
+	e.rules[rule.AppID][rule.ID] = &alertRuleState{rule: *rule}
+}
+
+// update replaces the definition of a rule and starts its window from
+// scratch. The rule keeps its state, so a firing rule is resolved by
+// evaluate once its new window is quiet, with an event and a notification
+// like any other. It returns the rule as the engine has it.
+func (e *alertEngine) update(rule *service.AlertRule) service.AlertRule {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	updated := *rule
+	for _, rules := range e.rules {
+		if state, ok := rules[rule.ID]; ok {
+			updated.State = state.rule.State
+			updated.LastFiredAt = state.rule.LastFiredAt
+			updated.LastResolvedAt = state.rule.LastResolvedAt
+			updated.SilencedUntil = state.rule.SilencedUntil
+		}
+	}
+	e.removeLocked(rule.ID)
+	if e.rules[rule.AppID] == nil {
+		e.rules[rule.AppID] = make(map[int32]*alertRuleState)
+	}
+	e.rules[rule.AppID][rule.ID] = &alertRuleState{rule: updated}
+	return updated
+}
+
+func (e *alertEngine) remove(ruleID int32) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.removeLocked(ruleID)
+}
+
+func (e *alertEngine) removeLocked(ruleID int32) {
+	for _, rules := range e.rules {
+		delete(rules, ruleID)
+	}
+}
+
+// silence updates the silence of a loaded rule without touching its window.
+func (e *alertEngine) silence(rule *service.AlertRule) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if state, ok := e.rules[rule.AppID][rule.ID]; ok {
+		state.rule.SilencedUntil = rule.SilencedUntil
+	}
+}
+
+// observe queues a message received for the application for its rules.
+// It never blocks ingestion, messages are skipped while the queue is full.
+func (e *alertEngine) observe(appID string, msg *pb.Message) {
+	select {
+	case e.queue <- alertObservation{appID: appID, msg: msg, at: time.Now()}:
+	default:
+		log.Printf("alert queue is full, skipping a message of %s", appID)
+	}
+}
+
+// apply feeds an observed message to the rules of its application.
+func (e *alertEngine) apply(o alertObservation) []alertTransition {
+	msg := o.msg
+
+	// queries of match rules run before taking the lock
+	e.lock.Lock()
+	queries := make(map[int32]string)
+	for id, state := range e.rules[o.appID] {
+		if state.rule.Type == service.AlertMatch && service.LogLevel(msg.Level) >= state.rule.Level {
+			queries[id] = state.rule.Query
+		}
+	}
+	e.lock.Unlock()
+	matched := make(map[int32]bool, len(queries))
+	for id, query := range queries {
+		matched[id] = e.matches(query, msg)
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	var transitions []alertTransition
+	e.lastSeen[o.appID] = o.at
+	for _, state := range e.rules[o.appID] {
+		rule := &state.rule
+		switch rule.Type {
+		case service.AlertAbsence:
+			if rule.State == service.AlertFiring {
+				transitions = append(transitions, e.transition(state, service.AlertOK, "messages received again"))
+			}
+		case service.AlertThreshold:
+			if service.LogLevel(msg.Level) < rule.Level {
+				continue
+			}
+			state.hits = append(pruneHits(state.hits, o.at.Add(-rule.Window)), o.at)
+			if rule.State == service.AlertOK && int32(len(state.hits)) > rule.Threshold {
+				transitions = append(transitions, e.transition(state, service.AlertFiring,
+					fmt.Sprintf("%d messages at %s or above in the last %s", len(state.hits), levelName(rule.Level), rule.Window)))
+			}
+		case service.AlertMatch:
+			// rules put since the query ran wait for the next message
+			if service.LogLevel(msg.Level) < rule.Level || !matched[rule.ID] {
+				continue
+			}
+			state.hits = append(state.hits[:0], o.at)
+			if rule.State == service.AlertOK {
+				transitions = append(transitions, e.transition(state, service.AlertFiring, fmt.Sprintf("message matched: %s", msg.Msg)))
+			}
+		}
+	}
+	return transitions
+}
+
+// evaluate fires absence rules and resolves rules whose window went quiet.
+func (e *alertEngine) evaluate() []alertTransition {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	var transitions []alertTransition
+	now := time.Now()
+	for appID, rules := range e.rules {
+		for _, state := range rules {
+			rule := &state.rule
+			switch rule.Type {
+			case service.AlertAbsence:
+				last, ok := e.lastSeen[appID]
+				if !ok {
+					last = e.started
+					if rule.CreatedAt.After(last) {
+						last = rule.CreatedAt
+					}
+				}
+				if rule.State == service.AlertOK && now.Sub(last) > rule.Window {
+					transitions = append(transitions, e.transition(state, service.AlertFiring, fmt.Sprintf("no messages for %s", rule.Window)))
+				}
+			case service.AlertThreshold:
+				state.hits = pruneHits(state.hits, now.Add(-rule.Window))
+				if rule.State == service.AlertFiring && int32(len(state.hits)) <= rule.Threshold {
+					transitions = append(transitions, e.transition(state, service.AlertOK, fmt.Sprintf("%d messages in the last %s", len(state.hits), rule.Window)))
+				}
+			case service.AlertMatch:
+				state.hits = pruneHits(state.hits, now.Add(-rule.Window))
+				if rule.State == service.AlertFiring && len(state.hits) == 0 {
+					transitions = append(transitions, e.transition(state, service.AlertOK, fmt.Sprintf("no matching messages for %s", rule.Window)))
+				}
+			}
+		}
+	}
+	return transitions
+}
+
+// run feeds queued messages to the rules and evaluates them periodically.
+// Transitions are recorded in the order they happen, by this goroutine only.
+func (e *alertEngine) run() {
+	ticker := time.NewTicker(alertEvaluationInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case o := <-e.queue:
+			e.record(e.apply(o))
+		case <-ticker.C:
+			e.record(e.evaluate())
+		}
+	}
+}
+
+// transition changes the state of the rule, to be recorded once the lock is
+// released. Only changes are recorded, so a rule that keeps matching while
+// firing does not notify again.
+func (e *alertEngine) transition(state *alertRuleState, to service.AlertState, message string) alertTransition {
+	rule := &state.rule
+	now := time.Now()
+	rule.State = to
+	if to == service.AlertFiring {
+		rule.LastFiredAt = &now
+	} else {
+		rule.LastResolvedAt = &now
+	}
+	return alertTransition{
+		rule: *rule,
+		event: &service.AlertEvent{
+			RuleID:   rule.ID,
+			AppID:    rule.AppID,
+			State:    to,
+			Message:  message,
+			Silenced: rule.Silenced(now),
+		},
+	}
+}
+
+// record saves state changes of rules and notifies their owners.
+func (e *alertEngine) record(transitions []alertTransition) {
+	for _, t := range transitions {
+		rule := &t.rule
+		updates := map[string]interface{}{"state": rule.State}
+		if rule.State == service.AlertFiring {
+			updates["last_fired_at"] = *rule.LastFiredAt
+		} else {
+			updates["last_resolved_at"] = *rule.LastResolvedAt
+		}
+		if err := e.db.Model(&service.AlertRule{}).Where("id = ?", rule.ID).Updates(updates).Error; err != nil {
+			log.Printf("failed to update alert rule %d: %v", rule.ID, err)
+		}
+		if err := e.db.Create(t.event).Error; err != nil {
+			log.Printf("failed to record alert event for rule %d: %v", rule.ID, err)
+		}
+		log.Printf("Alert %d (%s) is now %d: %s", rule.ID, rule.Name, rule.State, t.event.Message)
+
+		if !t.event.Silenced {
+			e.notify(rule, alertEventToPb(t.event, rule.Name))
+		}
+	}
+}
+
+// matches runs a query string against a single message. An empty query
+// matches every message.
+func (e *alertEngine) matches(query string, msg *pb.Message) bool {
+	if len(query) == 0 {
+		return true
+	}
+
+	const docID = "message"
+	doc := &service.IndexedMessage{
+		SessionID: strconv.Itoa(int(msg.Sessionid)),
+		Msg:       msg.Msg,
+		Level:     msg.Level.String(),
+		Severity:  int(msg.Level),
+		Timestamp: msg.Timestamp.AsTime(),
+	}
+	if err := e.matcher.Index(docID, doc); err != nil {
+		log.Printf("failed to match message: %v", err)
+		return false
+	}
+	defer e.matcher.Delete(docID)
+
+	request := bleve.NewSearchRequest(bleve.NewConjunctionQuery(
+		bleve.NewDocIDQuery([]string{docID}),
+		bleve.NewQueryStringQuery(query),
+	))
+	result, err := e.matcher.Search(request)
+	if err != nil {
+		log.Printf("failed to match query %q: %v", query, err)
+		return false
+	}
+	return result.Total > 0
+}
+
+func pruneHits(hits []time.Time, since time.Time) []time.Time {
+	i := 0
+	for i < len(hits) && hits[i].Before(since) {
+		i++
+	}
+	return hits[i:]
+}
+
+func levelName(level service.LogLevel) string {
+	return pb.Message_Level(level).String()
+}
+
+func alertRuleToPb(rule *service.AlertRule) *pb.AlertRule {
+	r := &pb.AlertRule{
+		Id:        rule.ID,
+		Appid:     rule.AppID,
+		Name:      rule.Name,
+		Type:      pb.AlertRule_Type(rule.Type),
+		Level:     pb.Message_Level(rule.Level),
+		Threshold: rule.Threshold,
+		Window:    durationpb.New(rule.Window),
+		Query:     rule.Query,
+		State:     pb.AlertRule_State(rule.State),
+	}
+	if rule.SilencedUntil != nil {
+		r.SilencedUntil = timestamppb.New(*rule.SilencedUntil)
+	}
+	if rule.LastFiredAt != nil {
+		r.LastFiredAt = timestamppb.New(*rule.LastFiredAt)
+	}
+	if rule.LastResolvedAt != nil {
+		r.LastResolvedAt = timestamppb.New(*rule.LastResolvedAt)
+	}
+	return r
+}
+
+func alertEventToPb(event *service.AlertEvent, name string) *pb.AlertEvent {
+	return &pb.AlertEvent{
+		RuleId:    event.RuleID,
+		Appid:     event.AppID,
+		Name:      name,
+		State:     pb.AlertRule_State(event.State),
+		Message:   event.Message,
+		Timestamp: timestamppb.New(event.CreatedAt),
+		Silenced:  event.Silenced,
+	}
+}
+
+func (l *loggyServer) notifyAlert(rule *service.AlertRule, event *pb.AlertEvent) {
+	kind := NotificationAlertResolved
+	if rule.State == service.AlertFiring {
+		kind = NotificationAlertFiring
+	}
+	l.notify(rule.UserID, rule.AppID, kind, fmt.Sprintf("%s: %s", rule.Name, event.Message), event)
+}
+
+func validateAlertRule(rule *pb.AlertRule) error {
+	if len(rule.Name) == 0 {
+		return status.Error(codes.InvalidArgument, "alert rule needs a name")
+	}
+	if rule.Window.AsDuration() <= 0 {
+		return status.Error(codes.InvalidArgument, "alert rule needs a window")
+	}
+	if rule.Type == pb.AlertRule_THRESHOLD && rule.Threshold < 0 {
+		return status.Error(codes.InvalidArgument, "alert rule threshold must not be negative")
+	}
+	if len(rule.Query) != 0 {
+		if err := bleve.NewQueryStringQuery(rule.Query).Validate(); err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid alert rule query: %v", err)
+		}
+	}
+	return nil
+}
+
+// ownedAlertRule loads a rule and checks that it belongs to the user making
+// the request.
+func (l *loggyServer) ownedAlertRule(ctx context.Context, ruleID int32) (*service.AlertRule, error) {
+	userID, err := getUserIdFromMetaData(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "user not found")
+	}
+	rule, err := l.alertStore.AlertRule(ruleID, userID)
+	if err != nil {
+		return nil, storeError(err, fmt.Sprintf("alert rule %d", ruleID))
+	}
+	return rule, nil
+}
+
+func (l *loggyServer) CreateAlertRule(ctx context.Context, rule *pb.AlertRule) (*pb.AlertRule, error) {
+	app, err := l.ownedApp(ctx, rule.Appid)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateAlertRule(rule); err != nil {
+		return nil, err
+	}
+	entry := &service.AlertRule{
+		AppID:     app.ID,
+		UserID:    app.UserID,
+		Name:      rule.Name,
+		Type:      service.AlertRuleType(rule.Type),
+		Level:     service.LogLevel(rule.Level),
+		Threshold: rule.Threshold,
+		Window:    rule.Window.AsDuration(),
+		Query:     rule.Query,
+	}
+	if err := l.alertStore.CreateAlertRule(entry); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create alert rule: %v", err)
+	}
+	l.alerts.put(entry)
+	return alertRuleToPb(entry), nil
+}
+
+func (l *loggyServer) UpdateAlertRule(ctx context.Context, rule *pb.AlertRule) (*pb.AlertRule, error) {
+	entry, err := l.ownedAlertRule(ctx, rule.Id)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateAlertRule(rule); err != nil {
+		return nil, err
+	}
+	entry.Name = rule.Name
+	entry.Type = service.AlertRuleType(rule.Type)
+	entry.Level = service.LogLevel(rule.Level)
+	entry.Threshold = rule.Threshold
+	entry.Window = rule.Window.AsDuration()
+	entry.Query = rule.Query
+	// the state is the engine's to change, it records every change
+	if err := l.alertStore.UpdateAlertRule(entry); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to update alert rule: %v", err)
+	}
+	updated := l.alerts.update(entry)
+	return alertRuleToPb(&updated), nil
+}
+
+func (l *loggyServer) DeleteAlertRule(ctx context.Context, ruleid *pb.AlertRuleId) (*empty.Empty, error) {
+	entry, err := l.ownedAlertRule(ctx, ruleid.Id)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.alertStore.DeleteAlertRule(entry); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to delete alert rule: %v", err)
+	}
+	l.alerts.remove(entry.ID)
+	return &empty.Empty{}, nil
+}
+
+func (l *loggyServer) ListAlertRules(ctx context.Context, appid *pb.ApplicationId) (*pb.AlertRuleList, error) {
+	if _, err := l.ownedApp(ctx, appid.Id); err != nil {
+		return nil, err
+	}
+	var rules []*pb.AlertRule
+	entries, err := l.alertStore.ListAlertRules(appid.Id)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list alert rules: %v", err)
+	}
+	for _, rule := range entries {
+		rules = append(rules, alertRuleToPb(rule))
+	}
+	return &pb.AlertRuleList{Rules: rules}, nil
+}
+
+func (l *loggyServer) SilenceAlertRule(ctx context.Context, request *pb.SilenceRequest) (*pb.AlertRule, error) {
+	entry, err := l.ownedAlertRule(ctx, request.Id)
+	if err != nil {
+		return nil, err
+	}
+	entry.SilencedUntil = nil
+	if d := request.Duration.AsDuration(); d > 0 {
+		until := time.Now().Add(d)
+		entry.SilencedUntil = &until
+	}
+	if err := l.alertStore.SilenceAlertRule(entry); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to silence alert rule: %v", err)
+	}
+	l.alerts.silence(entry)
+	return alertRuleToPb(entry), nil
+}
+
+func (l *loggyServer) ListAlertEvents(ctx context.Context, ruleid *pb.AlertRuleId) (*pb.AlertEventList, error) {
+	rule, err := l.ownedAlertRule(ctx, ruleid.Id)
+	if err != nil {
+		return nil, err
+	}
+	var events []*pb.AlertEvent
+	entries, err := l.alertStore.ListAlertEvents(rule.ID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list alert events: %v", err)
+	}
+	for _, event := range entries {
+		events = append(events, alertEventToPb(event, rule.Name))
+	}
+	return &pb.AlertEventList{Events: events}, nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+
+	pb "github.com/loggysh/loggy/loggy"
+	"github.com/loggysh/loggy/service"
+)
+
+// Notification types for anomalies.
+const (
+	NotificationAnomalyErrorRate  = "anomaly.error_rate"
+	NotificationAnomalyNewPattern = "anomaly.new_pattern"
+)
+
+const (
+	// closed windows the error rate of a window is compared to
+	anomalyBaselineWindows = 24
+	// windows an application needs before it is checked, so the first
+	// messages after a start are not all new
+	anomalyMinBaselineWindows = 6
+	// z score of a significant error rate, about p < 0.001 one sided
+	anomalyMinScore = 3.0
+	// errors a window needs before its rate can be an anomaly
+	anomalyMinErrors = 5
+
+	defaultAnomalyLimit = 100
+	maxAnomalyLimit     = 1000
+)
+
+type anomalyWindow struct {
+	start  time.Time
+	total  int64
+	errors int64
+}
+
+type appRates struct {
+	current anomalyWindow
+	// closed windows, oldest first
+	baseline []anomalyWindow
+	// an anomaly is recorded when the rate goes up, not again until a
+	// window is normal
+	anomalous bool
+}
+
+// anomalyDetector watches the error and crash rate of every application.
+// Messages are counted into windows as they are stored. When a window
+// closes its error rate is compared with the rate of the windows before it
+// with a two proportion z test, so spikes in volume alone do not count.
+// Errors of patterns not seen before are anomalies right away.
+type anomalyDetector struct {
+	lock   sync.Mutex
+	db     *gorm.DB
+	window time.Duration
+	apps   map[string]*appRates
+	notify func(anomaly *service.Anomaly)
+}
+
+func newAnomalyDetector(db *gorm.DB, window time.Duration, notify func(anomaly *service.Anomaly)) *anomalyDetector {
+	return &anomalyDetector{
+		db:     db,
+		window: window,
+		apps:   make(map[string]*appRates),
+		notify: notify,
+	}
+}
+
+func isError(level service.LogLevel) bool {
+	return level >= service.ERROR
+}
+
+// observe counts a stored message of the application. newPattern is set
+// when the message started a pattern.
+func (d *anomalyDetector) observe(appID string, msg *service.Message, newPattern bool) {
+	for _, anomaly := range d.count(appID, msg, newPattern) {
+		d.record(anomaly)
+	}
+}
+
+// count counts a message and returns the anomalies it revealed, which are
+// recorded once the lock is released.
+func (d *anomalyDetector) count(appID string, msg *service.Message, newPattern bool) []*service.Anomaly {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := time.Now()
+	rates, ok := d.apps[appID]
+	if !ok {
+		rates = &appRates{current: anomalyWindow{start: now.Truncate(d.window)}}
+		d.apps[appID] = rates
+	}
+	anomalies := d.advance(appID, rates, now)
+	rates.current.total++
+	if !isError(msg.Level) {
+		return anomalies
+	}
+	rates.current.errors++
+
+	if newPattern && len(rates.baseline) >= anomalyMinBaselineWindows {
+		anomalies = append(anomalies, &service.Anomaly{
+			AppID:       appID,
+			Type:        service.AnomalyNewPattern,
+			WindowStart: rates.current.start,
+			WindowEnd:   rates.current.start.Add(d.window),
+			PatternID:   msg.PatternID,
+			Message:     fmt.Sprintf("new %s pattern: %s", msg.Level, msg.Msg),
+		})
+	}
+	return anomalies
+}
+
+// advance closes the windows of an application that ended before now and
+// returns the anomalies found in them. It has to be called with the lock
+// held.
+func (d *anomalyDetector) advance(appID string, rates *appRates, now time.Time) []*service.Anomaly {
+	var anomalies []*service.Anomaly
+	for !now.Before(rates.current.start.Add(d.window)) {
+		if anomaly := d.check(appID, rates); anomaly != nil {
+			anomalies = append(anomalies, anomaly)
+		}
+		rates.baseline = append(rates.baseline, rates.current)
+		if len(rates.baseline) > anomalyBaselineWindows {
+			rates.baseline = rates.baseline[1:]
+		}
+		rates.current = anomalyWindow{start: rates.current.start.Add(d.window)}
+		// long quiet periods leave nothing to compare with
+		if now.Sub(rates.current.start) > anomalyBaselineWindows*d.window {
+			rates.baseline = nil
+			rates.current.start = now.Truncate(d.window)
+		}
+	}
+	return anomalies
+}
+
+// zScore is the two proportion z statistic of errors out of total in a
+// window against baselineErrors out of baselineTotal.
+func zScore(errors, total, baselineErrors, baselineTotal int64) float64 {
+	if total == 0 || baselineTotal == 0 {
+		return 0
+	}
+	rate := float64(errors) / float64(total)
+	baseline := float64(baselineErrors) / float64(baselineTotal)
+	pooled := float64(errors+baselineErrors) / float64(total+baselineTotal)
+	se := math.Sqrt(pooled * (1 - pooled) * (1/float64(total) + 1/float64(baselineTotal)))
+	if se == 0 {
+		return 0
+	}
+	return (rate - baseline) / se
+}
+
+// check compares the current window of an application with its baseline,
+// returning an anomaly when its error rate went up.
+func (d *anomalyDetector) check(appID string, rates *appRates) *service.Anomaly {
+	if len(rates.baseline) < anomalyMinBaselineWindows {
+		return nil
+	}
+	var errors, total int64
+	for _, w := range rates.baseline {
+		errors += w.errors
+		total += w.total
+	}
+	current := rates.current
+	score := zScore(current.errors, current.total, errors, total)
+	if current.errors < anomalyMinErrors || score < anomalyMinScore {
+		rates.anomalous = false
+		return nil
+	}
+	if rates.anomalous {
+		return nil
+	}
+	rates.anomalous = true
+
+	rate := float64(current.errors) / float64(current.total)
+	baseline := float64(errors) / float64(total)
+	return &service.Anomaly{
+		AppID:        appID,
+		Type:         service.AnomalyErrorRate,
+		WindowStart:  current.start,
+		WindowEnd:    current.start.Add(d.window),
+		Errors:       current.errors,
+		Total:        current.total,
+		Rate:         rate,
+		BaselineRate: baseline,
+		Score:        score,
+		Message: fmt.Sprintf("%.1f%% of %d messages were errors, up from %.1f%% (z = %.1f)",
+			rate*100, current.total, baseline*100, score),
+	}
+}
+
+// record saves an anomaly and notifies the owner of the application, not
+// holding the lock.
+func (d *anomalyDetector) record(anomaly *service.Anomaly) {
+	if err := d.db.Create(anomaly).Error; err != nil {
+		log.Printf("failed to record anomaly of %s: %v", anomaly.AppID, err)
+	}
+	log.Printf("Anomaly in %s: %s", anomaly.AppID, anomaly.Message)
+	d.notify(anomaly)
+}
+
+// run closes the windows of applications that stopped sending messages.
+func (d *anomalyDetector) run() {
+	ticker := time.NewTicker(d.window)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		var anomalies []*service.Anomaly
+		d.lock.Lock()
+		for appID, rates := range d.apps {
+			anomalies = append(anomalies, d.advance(appID, rates, now)...)
+		}
+		d.lock.Unlock()
+		for _, anomaly := range anomalies {
+			d.record(anomaly)
+		}
+	}
+}
+
+func anomalyToPb(anomaly *service.Anomaly) *pb.Anomaly {
+	return &pb.Anomaly{
+		Id:           int32(anomaly.ID),
+		Appid:        anomaly.AppID,
+		Type:         pb.Anomaly_Type(anomaly.Type),
+		WindowStart:  timestamppb.New(anomaly.WindowStart),
+		WindowEnd:    timestamppb.New(anomaly.WindowEnd),
+		Errors:       anomaly.Errors,
+		Total:        anomaly.Total,
+		Rate:         anomaly.Rate,
+		BaselineRate: anomaly.BaselineRate,
+		Score:        anomaly.Score,
+		PatternId:    anomaly.PatternID,
+		Message:      anomaly.Message,
+		CreatedAt:    timestamppb.New(anomaly.CreatedAt),
+	}
+}
+
+func (l *loggyServer) notifyAnomaly(anomaly *service.Anomaly) {
+	kind := NotificationAnomalyErrorRate
+	if anomaly.Type == service.AnomalyNewPattern {
+		kind = NotificationAnomalyNewPattern
+	}
+	l.notifyApp(anomaly.AppID, kind, anomaly.Message, anomalyToPb(anomaly))
+}
+
+// ListAnomalies lists the anomalies of an application, newest first.
+func (l *loggyServer) ListAnomalies(ctx context.Context, request *pb.AnomalyQuery) (*pb.AnomalyList, error) {
+	if _, err := l.ownedApp(ctx, request.Appid); err != nil {
+		return nil, err
+	}
+	limit := int(request.Limit)
+	if limit <= 0 {
+		limit = defaultAnomalyLimit
+	}
+	if limit > maxAnomalyLimit {
+		limit = maxAnomalyLimit
+	}
+	// zero times leave that end of the range open
+	var start, end time.Time
+	if request.Start != nil {
+		start = request.Start.AsTime()
+	}
+	if request.End != nil {
+		end = request.End.AsTime()
+	}
+	entries, err := l.anomalyStore.ListAnomalies(request.Appid, start, end, limit)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list anomalies: %v", err)
+	}
+	list := &pb.AnomalyList{}
+	for _, anomaly := range entries {
+		list.Anomalies = append(list.Anomalies, anomalyToPb(anomaly))
+	}
+	return list, nil
+}
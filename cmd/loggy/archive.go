@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"gorm.io/gorm"
+
+	pb "github.com/loggysh/loggy/loggy"
+	"github.com/loggysh/loggy/service"
+)
+
+const (
+	// sessions and messages written to one segment, at most
+	maxSegmentSessions = 1000
+	maxSegmentMessages = 1000000
+	// archived messages deleted from the table and the index at a time
+	archiveBatchSize = 1000
+)
+
+// sessionArchiver moves the messages of sessions that ended long ago out of
+// the messages table and the search index, into compressed segment files
+// of an application. The session rows stay, with their segment.
+type sessionArchiver struct {
+	// one run at a time, runs would archive the same sessions
+	lock     sync.Mutex
+	db       *gorm.DB
+	indexer  bleve.Index
+	segments *service.Segments
+	// sessions are archived this long after they ended
+	after time.Duration
+	// exported is set when messages are exported to Parquet, the export
+	// only reads the messages table
+	exported bool
+}
+
+func newSessionArchiver(db *gorm.DB, indexer bleve.Index, segments *service.Segments, after time.Duration, exported bool) *sessionArchiver {
+	return &sessionArchiver{db: db, indexer: indexer, segments: segments, after: after, exported: exported}
+}
+
+// archivable selects the sessions that ended before cutoff and are not
+// archived yet. With the Parquet export, sessions wait until all of their
+// messages are exported.
+func (a *sessionArchiver) archivable(cutoff time.Time) *gorm.DB {
+	tx := a.db.Model(&service.Session{}).
+		Where("status <> ? AND ended_at < ? AND segment_id = 0", service.SessionLive, cutoff)
+	if a.exported {
+		tx = tx.Where("NOT EXISTS (SELECT 1 FROM messages WHERE messages.session_id = sessions.id AND messages.id > " +
+			"COALESCE((SELECT last_message_id FROM export_watermarks WHERE export_watermarks.application_id = sessions.application_id), 0))")
+	}
+	return tx
+}
+
+// archiveApp writes the next sessions of an application to a new segment,
+// then removes their messages. It returns nothing if there are none.
+func (a *sessionArchiver) archiveApp(ctx context.Context, appID string, cutoff time.Time) (*service.Segment, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	var sessions []*service.Session
+	err := a.archivable(cutoff).Where("application_id = ?", appID).
+		Order("id").Limit(maxSegmentSessions).Find(&sessions).Error
+	if err != nil || len(sessions) == 0 {
+		return nil, err
+	}
+	var deviceIDs []string
+	for _, session := range sessions {
+		deviceIDs = append(deviceIDs, session.DeviceID.String())
+	}
+	var devices []*service.Device
+	if err := a.db.Where("id IN ?", deviceIDs).Find(&devices).Error; err != nil {
+		return nil, err
+	}
+	details := make(map[string]string)
+	for _, device := range devices {
+		details[device.ID.String()] = device.Details
+	}
+
+	segment := &service.Segment{
+		AppID: appID,
+		Path:  filepath.Join(url.PathEscape(appID), fmt.Sprintf("%012d.seg", sessions[0].ID)),
+	}
+	w, err := a.segments.Create(segment.Path, appID)
+	if err != nil {
+		return nil, err
+	}
+	var archived []int32
+	var messageIDs []int
+	for _, session := range sessions {
+		if segment.Messages >= maxSegmentMessages {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			w.Abort()
+			return nil, err
+		}
+		var messages []*service.Message
+		if err := a.db.Where("session_id = ?", session.ID).Order("timestamp, id").Find(&messages).Error; err != nil {
+			w.Abort()
+			return nil, err
+		}
+		if err := w.Add(session, details[session.DeviceID.String()], messages); err != nil {
+			w.Abort()
+			return nil, err
+		}
+		archived = append(archived, session.ID)
+		for _, msg := range messages {
+			messageIDs = append(messageIDs, msg.ID)
+		}
+		segment.Sessions++
+		segment.Messages += int64(len(messages))
+	}
+	index, size, err := w.Close()
+	if err != nil {
+		w.Abort()
+		return nil, err
+	}
+	segment.Bytes = size
+	for _, entry := range index.Sessions {
+		if entry.Messages == 0 {
+			continue
+		}
+		if segment.FirstMessageAt.IsZero() || entry.First.Before(segment.FirstMessageAt) {
+			segment.FirstMessageAt = entry.First
+		}
+		if entry.Last.After(segment.LastMessageAt) {
+			segment.LastMessageAt = entry.Last
+		}
+		if segment.FirstMessageID == 0 || entry.MinID < segment.FirstMessageID {
+			segment.FirstMessageID = entry.MinID
+		}
+		if entry.MaxID > segment.LastMessageID {
+			segment.LastMessageID = entry.MaxID
+		}
+	}
+
+	err = a.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(segment).Error; err != nil {
+			return err
+		}
+		err := tx.Model(&service.Session{}).Where("id IN ?", archived).Update("segment_id", segment.ID).Error
+		if err != nil {
+			return err
+		}
+		// only the messages written to the segment, rows added since are
+		// left in the table rather than deleted without being archived
+		for start := 0; start < len(messageIDs); start += archiveBatchSize {
+			end := start + archiveBatchSize
+			if end > len(messageIDs) {
+				end = len(messageIDs)
+			}
+			if err := tx.Where("id IN ?", messageIDs[start:end]).Delete(&service.Message{}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		a.segments.Remove(segment)
+		return nil, err
+	}
+
+	// the messages are only in the segment now, documents left in the
+	// index only match searches until the next rebuild
+	for start := 0; start < len(messageIDs); start += archiveBatchSize {
+		end := start + archiveBatchSize
+		if end > len(messageIDs) {
+			end = len(messageIDs)
+		}
+		batch := a.indexer.NewBatch()
+		for _, id := range messageIDs[start:end] {
+			batch.Delete(strconv.Itoa(id))
+		}
+		if err := a.indexer.Batch(batch); err != nil {
+			log.Printf("failed to remove archived messages from the index: %v", err)
+			break
+		}
+	}
+	return segment, nil
+}
+
+// archiveAll archives the sessions of every application that ended before
+// the archive threshold.
+func (a *sessionArchiver) archiveAll(ctx context.Context) error {
+	cutoff := time.Now().Add(-a.after)
+	var appIDs []string
+	if err := a.archivable(cutoff).Distinct("application_id").Pluck("application_id", &appIDs).Error; err != nil {
+		return err
+	}
+	for _, appID := range appIDs {
+		for {
+			segment, err := a.archiveApp(ctx, appID, cutoff)
+			if err != nil {
+				return fmt.Errorf("application %s: %w", appID, err)
+			}
+			if segment == nil {
+				break
+			}
+			log.Printf("Archived %d sessions of %s with %d messages to %s (%d bytes)", segment.Sessions, appID, segment.Messages, segment.Path, segment.Bytes)
+		}
+	}
+	return nil
+}
+
+func (a *sessionArchiver) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := a.archiveAll(context.Background()); err != nil {
+			log.Printf("failed to archive sessions: %v", err)
+		}
+	}
+}
+
+// archivedEntry returns the segment entry of an archived session.
+func (l *loggyServer) archivedEntry(session *service.Session) (*service.SegmentEntry, error) {
+	segment, err := l.segmentStore.Segment(session.SegmentID)
+	if err != nil {
+		return nil, err
+	}
+	index, err := l.segments.Index(segment)
+	if err != nil {
+		return nil, err
+	}
+	entry := index.Session(session.ID)
+	if entry == nil {
+		return nil, fmt.Errorf("session %d is missing from segment %s", session.ID, segment.Path)
+	}
+	return entry, nil
+}
+
+// archivedCandidate reports whether a session of a segment can have
+// messages matching the filters of a search.
+func archivedCandidate(entry *service.SegmentEntry, request *pb.Query) bool {
+	if entry.Messages == 0 {
+		return false
+	}
+	if request.Sessionid != 0 && entry.SessionID != request.Sessionid {
+		return false
+	}
+	if len(request.Deviceid) != 0 && entry.DeviceID != request.Deviceid {
+		return false
+	}
+	if request.Levels != nil && !entry.HasLevels(service.LogLevel(request.Levels.Min), service.LogLevel(request.Levels.Max)) {
+		return false
+	}
+	if request.Start != nil && entry.Last.Before(request.Start.AsTime()) {
+		return false
+	}
+	if request.End != nil && entry.First.After(request.End.AsTime()) {
+		return false
+	}
+	return true
+}
+
+// archivedHit is a search hit in an archived session.
+type archivedHit struct {
+	msg *service.Message
+	hit *search.DocumentMatch
+}
+
+// sortArchivedHits orders hits from different sessions like the index
+// orders them. Scores of different sessions are only roughly comparable.
+func sortArchivedHits(hits []*archivedHit, order pb.PageRequest_Sort) {
+	sort.SliceStable(hits, func(i, j int) bool {
+		a, b := hits[i].msg, hits[j].msg
+		switch order {
+		case pb.PageRequest_NEWEST:
+			if !a.Timestamp.Equal(b.Timestamp) {
+				return a.Timestamp.After(b.Timestamp)
+			}
+		case pb.PageRequest_OLDEST:
+			if !a.Timestamp.Equal(b.Timestamp) {
+				return a.Timestamp.Before(b.Timestamp)
+			}
+		default:
+			if hits[i].hit.Score != hits[j].hit.Score {
+				return hits[i].hit.Score > hits[j].hit.Score
+			}
+		}
+		return a.ID < b.ID
+	})
+}
+
+// matchArchived searches the messages of an archived session in an index
+// of their own, returning up to size hits and the number of matches.
+func (l *loggyServer) matchArchived(request *bleve.SearchRequest, userID string, index *service.SegmentIndex, entry *service.SegmentEntry, messages []*service.Message) ([]*archivedHit, uint64, error) {
+	matcher, err := bleve.NewMemOnly(l.indexer.Mapping())
+	if err != nil {
+		return nil, 0, err
+	}
+	defer matcher.Close()
+	batch := matcher.NewBatch()
+	byID := make(map[string]*service.Message, len(messages))
+	for _, msg := range messages {
+		id := strconv.Itoa(msg.ID)
+		byID[id] = msg
+		if err := batch.Index(id, index.Document(entry, userID, msg)); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := matcher.Batch(batch); err != nil {
+		return nil, 0, err
+	}
+	result, err := matcher.Search(request)
+	if err != nil {
+		return nil, 0, err
+	}
+	hits := make([]*archivedHit, 0, len(result.Hits))
+	for _, hit := range result.Hits {
+		hits = append(hits, &archivedHit{msg: byID[hit.ID], hit: hit})
+	}
+	return hits, result.Total, nil
+}
+
+// searchArchived runs a search on the messages of archived sessions. Every
+// session of the segments that could hold matches is read and matched, so
+// it is much slower than searching the index. Facets are not counted.
+func (l *loggyServer) searchArchived(ctx context.Context, userID string, request *pb.Query, page *page, contextSize int) (*pb.SearchResponse, error) {
+	start := time.Now()
+	if len(request.Query) != 0 {
+		if err := bleve.NewQueryStringQuery(request.Query).Validate(); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid query: %v", err)
+		}
+	}
+	filter := service.SegmentFilter{UserID: userID, AppID: request.Appid, SessionID: request.Sessionid}
+	if request.Start != nil {
+		filter.Start = request.Start.AsTime()
+	}
+	if request.End != nil {
+		filter.End = request.End.AsTime()
+	}
+	segments, err := l.segmentStore.ListSegments(filter)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list segments: %v", err)
+	}
+
+	// every session returns the hits up to the end of the page, the page
+	// is cut from all of them
+	want := page.offset() + page.size
+	search := bleve.NewSearchRequestOptions(scopedQuery(userID, request), want, 0, false)
+	switch page.sort {
+	case pb.PageRequest_NEWEST:
+		search.SortBy([]string{"-timestamp", "_id"})
+	case pb.PageRequest_OLDEST:
+		search.SortBy([]string{"timestamp", "_id"})
+	}
+	search.Highlight = bleve.NewHighlight()
+	search.Highlight.AddField("msg")
+
+	var hits []*archivedHit
+	var total uint64
+	for _, segment := range segments {
+		index, err := l.segments.Index(segment)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to read segment %s: %v", segment.Path, err)
+		}
+		for _, entry := range index.Sessions {
+			if err := ctx.Err(); err != nil {
+				return nil, status.FromContextError(err).Err()
+			}
+			if !archivedCandidate(entry, request) {
+				continue
+			}
+			messages, err := l.segments.ReadSession(segment, entry)
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to read segment %s: %v", segment.Path, err)
+			}
+			matched, n, err := l.matchArchived(search, userID, index, entry, messages)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "failed to search: %v", err)
+			}
+			total += n
+			hits = append(hits, matched...)
+			sortArchivedHits(hits, page.sort)
+			if len(hits) > want {
+				hits = hits[:want]
+			}
+		}
+	}
+
+	if page.offset() < len(hits) {
+		hits = hits[page.offset():]
+	} else {
+		hits = nil
+	}
+	response := &pb.SearchResponse{
+		NextPageToken: page.nextOffset(len(hits)),
+		TotalCount:    int64(total),
+		Took:          durationpb.New(time.Since(start)),
+	}
+	for _, hit := range hits {
+		h, err := l.searchHit(hit.msg, hit.hit, contextSize)
+		if err != nil {
+			return nil, err
+		}
+		response.Messages = append(response.Messages, h.Message)
+		response.Hits = append(response.Hits, h)
+	}
+	return response, nil
+}
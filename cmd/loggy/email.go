@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	empty "google.golang.org/protobuf/types/known/emptypb"
+
+	pb "github.com/loggysh/loggy/loggy"
+	"github.com/loggysh/loggy/service"
+)
+
+const (
+	// repeated crash and quota emails for an application are held back
+	emailThrottle = 10 * time.Minute
+	// contacts are fetched from the auth service at most this often
+	contactTTL = 5 * time.Minute
+)
+
+// mailer sends plain text email over SMTP.
+type mailer struct {
+	addr     string
+	username string
+	password string
+	from     string
+}
+
+func (m *mailer) send(to, subject, body string) error {
+	// subjects hold application names, which users choose, so line breaks
+	// are encoded rather than written into the headers
+	for _, addr := range []string{m.from, to} {
+		if strings.ContainsAny(addr, "\r\n") {
+			return fmt.Errorf("invalid email address %q", addr)
+		}
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("UTF-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if len(m.username) != 0 {
+		host, _, _ := net.SplitHostPort(m.addr)
+		auth = smtp.PlainAuth("", m.username, m.password, host)
+	}
+	return smtp.SendMail(m.addr, auth, m.from, []string{to}, msg.Bytes())
+}
+
+type emailEvent struct {
+	userID       string
+	notification *pb.Notification
+}
+
+type cachedContact struct {
+	contact *service.Contact
+	fetched time.Time
+}
+
+// emailNotifier emails alert and issue notifications to users that turned
+// on email alerts in the auth service.
+type emailNotifier struct {
+	mailer *mailer
+	events chan emailEvent
+
+	lock     sync.Mutex
+	contacts map[string]cachedContact
+	lastSent map[string]time.Time
+}
+
+func newEmailNotifier(m *mailer) *emailNotifier {
+	return &emailNotifier{
+		mailer:   m,
+		events:   make(chan emailEvent, 1000),
+		contacts: make(map[string]cachedContact),
+		lastSent: make(map[string]time.Time),
+	}
+}
+
+// emailed reports whether notifications of this type go out by email.
+func emailed(kind string) bool {
+	switch kind {
+	case NotificationAlertFiring, NotificationAlertResolved, NotificationCrash, NotificationQuotaExceeded,
+		NotificationAnomalyErrorRate:
+		return true
+	}
+	return false
+}
+
+// dispatch queues a notification without blocking the caller.
+func (e *emailNotifier) dispatch(userID string, notification *pb.Notification) {
+	if e == nil || !emailed(notification.Type) {
+		return
+	}
+	select {
+	case e.events <- emailEvent{userID, notification}:
+	default:
+		log.Printf("email queue is full, dropping %s notification", notification.Type)
+	}
+}
+
+func (e *emailNotifier) run() {
+	for event := range e.events {
+		if e.throttled(event) {
+			continue
+		}
+		contact, err := e.contact(event.userID)
+		if err != nil {
+			log.Printf("failed to email %s notification: %v", event.notification.Type, err)
+			continue
+		}
+		if !contact.EmailAlerts || len(contact.Email) == 0 {
+			continue
+		}
+		n := event.notification
+		subject := fmt.Sprintf("[loggy] %s: %s", n.Type, n.Appid)
+		body := fmt.Sprintf("%s\n\nApplication: %s\nTime: %s\n", n.Message, n.Appid, n.Timestamp.AsTime().Format(time.RFC1123))
+		if err := e.mailer.send(contact.Email, subject, body); err != nil {
+			log.Printf("failed to email %s notification to %s: %v", n.Type, contact.Email, err)
+		}
+	}
+}
+
+// throttled holds back repeated crash and quota emails for an application.
+// Alerts are already deduplicated by the alert engine.
+func (e *emailNotifier) throttled(event emailEvent) bool {
+	kind := event.notification.Type
+	if kind != NotificationCrash && kind != NotificationQuotaExceeded {
+		return false
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	key := event.userID + "|" + event.notification.Appid + "|" + kind
+	if last, ok := e.lastSent[key]; ok && time.Since(last) < emailThrottle {
+		return true
+	}
+	e.lastSent[key] = time.Now()
+	return false
+}
+
+func (e *emailNotifier) contact(userID string) (*service.Contact, error) {
+	e.lock.Lock()
+	cached, ok := e.contacts[userID]
+	e.lock.Unlock()
+	if ok && time.Since(cached.fetched) < contactTTL {
+		return cached.contact, nil
+	}
+
+	contact, err := service.FetchContact(userID)
+	if err != nil {
+		return nil, err
+	}
+	e.lock.Lock()
+	e.contacts[userID] = cachedContact{contact, time.Now()}
+	e.lock.Unlock()
+	return contact, nil
+}
+
+// digest summarizes one day of an application.
+type digest struct {
+	app     *service.Application
+	day     time.Time
+	counts  map[service.LogLevel]int64
+	before  map[service.LogLevel]int64
+	issues  []service.Issue
+	devices []*service.Device
+}
+
+// buildDigest collects the day starting at day, comparing it with the day
+// before. New issues are errors and crashes whose pattern was first seen
+// that day.
+func buildDigest(stats service.StatsStore, app *service.Application, day time.Time) (*digest, error) {
+	end := day.Add(24 * time.Hour)
+	d := &digest{app: app, day: day}
+
+	var err error
+	if d.counts, err = stats.AppLevelCounts(app.ID, day, end); err != nil {
+		return nil, err
+	}
+	if d.before, err = stats.AppLevelCounts(app.ID, day.Add(-24*time.Hour), day); err != nil {
+		return nil, err
+	}
+	if d.issues, err = stats.NewIssues(app.ID, day, end, 10); err != nil {
+		return nil, err
+	}
+	if d.devices, err = stats.NewDevices(app.ID, day, end); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *digest) subject() string {
+	return fmt.Sprintf("[loggy] Daily digest for %s, %s", d.app.Name, d.day.Format("Jan 2"))
+}
+
+func (d *digest) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s (%s) on %s\n\n", d.app.Name, d.app.ID, d.day.Format("Monday, January 2 2006"))
+
+	fmt.Fprintf(&b, "Messages compared to the day before\n")
+	for level := service.DEBUG; level <= service.CRASH; level++ {
+		fmt.Fprintf(&b, "  %-6s %8d  (%+d)\n", levelName(level), d.counts[level], d.counts[level]-d.before[level])
+	}
+
+	fmt.Fprintf(&b, "\nTop new issues\n")
+	if len(d.issues) == 0 {
+		fmt.Fprintf(&b, "  none\n")
+	}
+	for _, issue := range d.issues {
+		fmt.Fprintf(&b, "  %6d  %s\n", issue.Count, issue.Msg)
+	}
+
+	fmt.Fprintf(&b, "\nNew devices: %d\n", len(d.devices))
+	for _, device := range d.devices {
+		fmt.Fprintf(&b, "  %s %s\n", device.ID, device.Details)
+	}
+	return b.String()
+}
+
+func (l *loggyServer) sendDigest(app *service.Application, day time.Time) error {
+	if l.email == nil {
+		return fmt.Errorf("email is not configured")
+	}
+	contact, err := l.email.contact(app.UserID)
+	if err != nil {
+		return err
+	}
+	if len(contact.Email) == 0 {
+		return fmt.Errorf("user %s has no email", app.UserID)
+	}
+	d, err := buildDigest(l.statsStore, app, day)
+	if err != nil {
+		return err
+	}
+	return l.email.mailer.send(contact.Email, d.subject(), d.String())
+}
+
+// runDigests sends the digest of the previous day to every application
+// with digests enabled, each day at hour UTC.
+func (l *loggyServer) runDigests(hour int) {
+	for {
+		now := time.Now().UTC()
+		next := time.Date(now.Year(), now.Month(), now.Day(), hour, 0, 0, 0, time.UTC)
+		if !next.After(now) {
+			next = next.Add(24 * time.Hour)
+		}
+		time.Sleep(time.Until(next))
+
+		apps, err := l.store.DigestApplications()
+		if err != nil {
+			log.Printf("failed to load applications for digests: %v", err)
+			continue
+		}
+		day := next.Truncate(24 * time.Hour).Add(-24 * time.Hour)
+		for _, app := range apps {
+			if err := l.sendDigest(app, day); err != nil {
+				log.Printf("failed to send digest for %s: %v", app.ID, err)
+			}
+		}
+	}
+}
+
+func (l *loggyServer) SetDigest(ctx context.Context, settings *pb.DigestSettings) (*pb.DigestSettings, error) {
+	app, err := l.ownedApp(ctx, settings.Appid)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.store.SetDigest(app.ID, settings.Enabled); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to update digest: %v", err)
+	}
+	return &pb.DigestSettings{Appid: app.ID, Enabled: settings.Enabled}, nil
+}
+
+// SendDigest emails the digest of the previous day right away.
+func (l *loggyServer) SendDigest(ctx context.Context, appid *pb.ApplicationId) (*empty.Empty, error) {
+	app, err := l.ownedApp(ctx, appid.Id)
+	if err != nil {
+		return nil, err
+	}
+	day := time.Now().UTC().Truncate(24 * time.Hour).Add(-24 * time.Hour)
+	if err := l.sendDigest(app, day); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "failed to send digest: %v", err)
+	}
+	return &empty.Empty{}, nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	pb "github.com/loggysh/loggy/loggy"
+	"github.com/loggysh/loggy/service"
+)
+
+const (
+	// messages loaded from the database at a time
+	exportBatchSize = 500
+	// bytes sent per ExportChunk
+	exportChunkSize = 64 * 1024
+)
+
+// messageEncoder writes messages in one of the export formats.
+type messageEncoder interface {
+	encode(msg *service.Message) error
+	flush() error
+}
+
+func newMessageEncoder(format pb.ExportRequest_Format, w io.Writer) (messageEncoder, error) {
+	switch format {
+	case pb.ExportRequest_NDJSON:
+		return &ndjsonEncoder{w: bufio.NewWriterSize(w, exportChunkSize)}, nil
+	case pb.ExportRequest_CSV:
+		e := &csvEncoder{w: csv.NewWriter(w)}
+		return e, e.w.Write([]string{"id", "session_id", "timestamp", "level", "msg"})
+	case pb.ExportRequest_LOGCAT:
+		return &logcatEncoder{w: bufio.NewWriterSize(w, exportChunkSize)}, nil
+	}
+	return nil, status.Errorf(codes.InvalidArgument, "unknown export format %s", format)
+}
+
+// ndjsonEncoder writes one JSON message per line.
+type ndjsonEncoder struct {
+	w *bufio.Writer
+}
+
+func (e *ndjsonEncoder) encode(msg *service.Message) error {
+	data, err := protojson.Marshal(messageToPb(msg))
+	if err != nil {
+		return err
+	}
+	e.w.Write(data)
+	return e.w.WriteByte('\n')
+}
+
+func (e *ndjsonEncoder) flush() error {
+	return e.w.Flush()
+}
+
+type csvEncoder struct {
+	w *csv.Writer
+}
+
+func (e *csvEncoder) encode(msg *service.Message) error {
+	return e.w.Write([]string{
+		strconv.Itoa(msg.ID),
+		strconv.Itoa(int(msg.SessionID)),
+		msg.Timestamp.UTC().Format(time.RFC3339Nano),
+		levelName(msg.Level),
+		msg.Msg,
+	})
+}
+
+func (e *csvEncoder) flush() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// logcatPriorities are the logcat priority letters of the levels, crashes
+// are printed as fatal.
+var logcatPriorities = map[service.LogLevel]byte{
+	service.DEBUG: 'D',
+	service.INFO:  'I',
+	service.WARN:  'W',
+	service.ERROR: 'E',
+	service.CRASH: 'F',
+}
+
+// logcatEncoder writes messages like `adb logcat -v time` prints them.
+type logcatEncoder struct {
+	w *bufio.Writer
+}
+
+func (e *logcatEncoder) encode(msg *service.Message) error {
+	priority, ok := logcatPriorities[msg.Level]
+	if !ok {
+		priority = 'V'
+	}
+	_, err := fmt.Fprintf(e.w, "%s %c/loggy: %s\n", msg.Timestamp.UTC().Format("01-02 15:04:05.000"), priority, msg.Msg)
+	return err
+}
+
+func (e *logcatEncoder) flush() error {
+	return e.w.Flush()
+}
+
+// exportSession writes the messages of a session oldest first. Messages are
+// loaded in batches, so memory use does not grow with the session.
+func (l *loggyServer) exportSession(ctx context.Context, sessionID int32, format pb.ExportRequest_Format, w io.Writer) error {
+	encoder, err := newMessageEncoder(format, w)
+	if err != nil {
+		return err
+	}
+	p := &page{size: exportBatchSize, sort: pb.PageRequest_OLDEST}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		batch, err := l.store.ListMessages(service.MessageFilter{SessionID: sessionID}, p.query())
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to load messages: %v", err)
+		}
+		for _, msg := range batch {
+			if err := encoder.encode(msg); err != nil {
+				return err
+			}
+		}
+		if len(batch) < p.size {
+			return encoder.flush()
+		}
+		last := batch[len(batch)-1]
+		p.after = &pageToken{Time: &last.Timestamp, ID: int64(last.ID)}
+	}
+}
+
+// chunkWriter sends everything written to it as ExportChunks.
+type chunkWriter struct {
+	stream pb.LoggyService_ExportSessionMessagesServer
+}
+
+func (w *chunkWriter) Write(data []byte) (int, error) {
+	for sent := 0; sent < len(data); sent += exportChunkSize {
+		end := sent + exportChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		if err := w.stream.Send(&pb.ExportChunk{Data: data[sent:end]}); err != nil {
+			return sent, err
+		}
+	}
+	return len(data), nil
+}
+
+func (l *loggyServer) ExportSessionMessages(request *pb.ExportRequest, stream pb.LoggyService_ExportSessionMessagesServer) error {
+	if _, err := l.ownedSession(stream.Context(), request.Sessionid); err != nil {
+		return err
+	}
+	// buffer so chunks are not as small as single messages
+	w := bufio.NewWriterSize(&chunkWriter{stream}, exportChunkSize)
+	if err := l.exportSession(stream.Context(), request.Sessionid, request.Format, w); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+var exportContentTypes = map[pb.ExportRequest_Format]string{
+	pb.ExportRequest_NDJSON: "application/x-ndjson",
+	pb.ExportRequest_CSV:    "text/csv; charset=utf-8",
+	pb.ExportRequest_LOGCAT: "text/plain; charset=utf-8",
+}
+
+var exportExtensions = map[pb.ExportRequest_Format]string{
+	pb.ExportRequest_NDJSON: "ndjson",
+	pb.ExportRequest_CSV:    "csv",
+	pb.ExportRequest_LOGCAT: "log",
+}
+
+var httpStatus = map[codes.Code]int{
+	codes.InvalidArgument:  http.StatusBadRequest,
+	codes.Unauthenticated:  http.StatusUnauthorized,
+	codes.PermissionDenied: http.StatusForbidden,
+	codes.NotFound:         http.StatusNotFound,
+}
+
+func httpError(w http.ResponseWriter, err error) {
+	s := status.Convert(err)
+	code, ok := httpStatus[s.Code()]
+	if !ok {
+		code = http.StatusInternalServerError
+	}
+	http.Error(w, s.Message(), code)
+}
+
+// exportHandler downloads the messages of a session over HTTP, e.g.
+// GET /api/export/session?session_id=1&format=csv with the same authorization
+// and user_id headers as gRPC calls.
+func (l *loggyServer) exportHandler(interceptor *service.AuthInterceptor) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctx, err := interceptor.AuthorizeHTTP(r)
+		if err != nil {
+			httpError(w, err)
+			return
+		}
+		sessionID, err := strconv.Atoi(r.URL.Query().Get("session_id"))
+		if err != nil {
+			http.Error(w, "invalid session_id", http.StatusBadRequest)
+			return
+		}
+		format := pb.ExportRequest_NDJSON
+		if name := r.URL.Query().Get("format"); len(name) != 0 {
+			value, ok := pb.ExportRequest_Format_value[strings.ToUpper(name)]
+			if !ok {
+				http.Error(w, "unknown format "+name, http.StatusBadRequest)
+				return
+			}
+			format = pb.ExportRequest_Format(value)
+		}
+		if _, err := l.ownedSession(ctx, int32(sessionID)); err != nil {
+			httpError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", exportContentTypes[format])
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=session-%d.%s", sessionID, exportExtensions[format]))
+		// the status is sent with the first chunk, later errors can only
+		// cut the download short
+		if err := l.exportSession(ctx, int32(sessionID), format, w); err != nil && !errors.Is(err, context.Canceled) {
+			log.Printf("failed to export session %d: %v", sessionID, err)
+		}
+	}
+}
@@ -2,82 +2,144 @@ package main
 
 import (
 	"fmt"
-	"io"
 	"log"
-
-	"github.com/loggysh/loggy/service"
-
-	"golang.org/x/net/context"
-	"google.golang.org/grpc"
+	"time"
 
 	"github.com/blevesearch/bleve/v2"
+
 	pb "github.com/loggysh/loggy/loggy"
-	empty "google.golang.org/protobuf/types/known/emptypb"
-	"gorm.io/gorm"
+	"github.com/loggysh/loggy/service"
 )
 
-func logger(prefix, server *string, indexer bleve.Index, db *gorm.DB) {
-	conn, err := grpc.Dial(fmt.Sprintf("%s:50111", *server), grpc.WithInsecure())
-	if err != nil {
-		log.Fatalf("failed to connect: %s", err)
-	}
-	defer conn.Close()
+const (
+	// messages are stored by this many workers, those of a session always
+	// by the same one so they are stored in the order they were sent
+	loggerWorkers   = 8
+	loggerQueueSize = 1000
+	// sessions without messages for this long are forgotten by the logger
+	loggerSourceIdle = 10 * time.Minute
+)
 
-	client := pb.NewLoggyServiceClient(conn)
+// loggedMessage is a message received by Send, waiting to be stored.
+type loggedMessage struct {
+	session *service.Session
+	msg     *pb.Message
+}
 
-	stream, err := client.Notify(context.Background(), &empty.Empty{})
-	if err != nil {
-		log.Fatalf("failed to listen: %s", err)
-	}
+// messageSource is the session a message came from, with its application
+// and device, which the message is indexed with.
+type messageSource struct {
+	session *service.Session
+	app     *service.Application
+	device  *service.Device
+	// when the last message of the session was stored
+	used time.Time
+}
 
-	for {
-		session, err := stream.Recv()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			log.Printf("failed to receive session: %s", err)
-		}
-		log.Println(session)
+// messageLogger stores, indexes and mines the messages received by Send.
+type messageLogger struct {
+	indexer   bleve.Index
+	store     service.Store
+	rollups   *rollupWriter
+	patterns  *patternMiner
+	anomalies *anomalyDetector
+	standing  *standingQueries
+	queues    []chan loggedMessage
+}
 
-		receiverid, err := client.RegisterReceive(context.Background(), &pb.SessionId{Id: session.Id})
-		if err != nil {
-			log.Printf("failed to register receive: %s", err)
-		}
+func newMessageLogger(indexer bleve.Index, store service.Store, rollups *rollupWriter, patterns *patternMiner, anomalies *anomalyDetector, standing *standingQueries) *messageLogger {
+	queues := make([]chan loggedMessage, loggerWorkers)
+	for i := range queues {
+		queues[i] = make(chan loggedMessage, loggerQueueSize)
+	}
+	return &messageLogger{
+		indexer:   indexer,
+		store:     store,
+		rollups:   rollups,
+		patterns:  patterns,
+		anomalies: anomalies,
+		standing:  standing,
+		queues:    queues,
+	}
+}
 
-		log.Println(receiverid)
+// log queues a message of a session to be stored. Senders wait when the
+// queue is full rather than lose messages.
+func (m *messageLogger) log(session *service.Session, msg *pb.Message) {
+	m.queues[int(session.ID)%len(m.queues)] <- loggedMessage{session: session, msg: msg}
+}
 
-		go func(session *pb.Session, receiverid *pb.ReceiverId, indexer bleve.Index, db *gorm.DB) {
-			stream, err := client.Receive(context.Background(), receiverid)
-			if err != nil {
-				log.Printf("failed to receive: %s", err)
-			}
+func (m *messageLogger) run() {
+	for _, queue := range m.queues {
+		go m.work(queue)
+	}
+}
 
-			log.Printf("Started logger for session: %d\n", session.Id)
+func (m *messageLogger) work(queue chan loggedMessage) {
+	sources := make(map[int32]*messageSource)
+	ticker := time.NewTicker(loggerSourceIdle / 2)
+	defer ticker.Stop()
 
-			for {
-				in, err := stream.Recv()
-				if err == io.EOF {
-					break
-				}
-				if err != nil {
-					log.Printf("failed to connect: %s", err)
-				}
-				msg := service.Message{
-					SessionID: in.Sessionid,
-					Msg:       in.Msg,
-					Timestamp: in.Timestamp.AsTime(),
-					Level:     service.LogLevel(in.Level),
-				}
-				if db.Create(&msg).Error != nil {
-					log.Println("unable to create message")
-					continue
+	for {
+		select {
+		case queued := <-queue:
+			source, ok := sources[queued.session.ID]
+			if !ok {
+				source = m.source(queued.session)
+				sources[queued.session.ID] = source
+			}
+			source.used = time.Now()
+			m.save(source, queued.msg)
+		case <-ticker.C:
+			cutoff := time.Now().Add(-loggerSourceIdle)
+			for id, source := range sources {
+				if source.used.Before(cutoff) {
+					delete(sources, id)
 				}
-				log.Println(msg.String())
-				indexer.Index(fmt.Sprintf("%d", msg.ID), in)
 			}
-			stream.CloseSend()
-		}(session, receiverid, indexer, db)
-		stream.CloseSend()
+		}
+	}
+}
+
+func (m *messageLogger) source(session *service.Session) *messageSource {
+	log.Printf("Started logger for session: %d\n", session.ID)
+	source := &messageSource{session: session, app: &service.Application{}, device: &service.Device{}}
+	if app, err := m.store.Application(session.AppID); err == nil {
+		source.app = app
+	} else {
+		log.Printf("failed to find application %s: %v", session.AppID, err)
+	}
+	if device, err := m.store.Device(session.DeviceID.String()); err == nil {
+		source.device = device
+	} else {
+		log.Printf("failed to find device %s: %v", session.DeviceID, err)
+	}
+	return source
+}
+
+func (m *messageLogger) save(source *messageSource, in *pb.Message) {
+	msg := service.Message{
+		SessionID: source.session.ID,
+		Msg:       in.Msg,
+		Timestamp: in.Timestamp.AsTime(),
+		Level:     service.LogLevel(in.Level),
+		TraceID:   in.TraceId,
+		SpanID:    in.SpanId,
+	}
+	newPattern := m.patterns.assign(source.session.AppID, &msg)
+	if err := m.store.CreateMessage(&msg); err != nil {
+		log.Printf("unable to create message: %v", err)
+		return
+	}
+	log.Println(msg.String())
+	m.rollups.message(source.session, &msg)
+	m.anomalies.observe(source.session.AppID, &msg, newPattern)
+	if err := m.store.AddSessionMessage(msg.SessionID, time.Now(), msg.Level == service.CRASH); err != nil {
+		log.Printf("unable to update session %d: %v", msg.SessionID, err)
+	}
+	if err := m.indexer.Index(fmt.Sprintf("%d", msg.ID), service.NewIndexedMessage(&msg, source.session, source.app, source.device)); err != nil {
+		log.Printf("unable to index message %d: %v", msg.ID, err)
 	}
+	// matches are streamed with their id, like listed messages
+	m.standing.match(source, &msg)
 }
@@ -8,8 +8,10 @@ import (
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"sync"
+	"time"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -18,30 +20,67 @@ import (
 	"google.golang.org/protobuf/types/known/timestamppb"
 
 	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/analysis/analyzer/standard"
 	uuid "github.com/satori/go.uuid"
 	empty "google.golang.org/protobuf/types/known/emptypb"
 
-	"gorm.io/driver/sqlite"
-	"gorm.io/gorm"
-
 	"github.com/loggysh/loggy/loggy"
 	pb "github.com/loggysh/loggy/loggy"
+	"github.com/loggysh/loggy/query"
 	"github.com/loggysh/loggy/service"
 )
 
 var IndexPath = "loggy.index"
 
 type loggyServer struct {
-	lock          sync.RWMutex
-	db            *gorm.DB
-	indexer       bleve.Index
-	notifications chan *pb.Session
-	receivers     map[int32]chan *pb.Message
-	listeners     map[int32][]int32 // sessionid -> []receivers
+	lock      sync.RWMutex
+	store     service.Store
+	indexer   bleve.Index
+	sessions  *service.Broadcaster[*pb.Session]
+	quota     *messageQuota
+	alerts    *alertEngine
+	webhooks  *webhookDispatcher
+	rollups   *rollupWriter
+	patterns  *patternMiner
+	anomalies *anomalyDetector
+	email     *emailNotifier
+	standing  *standingQueries
+	retention *retentionJob
+	segments  *service.Segments
+	archiver  *sessionArchiver
+	// parquet is nil when Parquet export is not enabled
+	parquet   *parquetExporter
+	logger    *messageLogger
+	receivers map[int32]*receiver
+	listeners map[int32][]int32 // sessionid -> []receivers
+	// receivers are numbered from 1
+	lastReceiver int32
+
+	// stores of the other RPCs, all the GormStore of store when served
+	alertStore     service.AlertStore
+	webhookStore   service.WebhookStore
+	searchStore    service.SavedSearchStore
+	retentionStore service.RetentionStore
+	anomalyStore   service.AnomalyStore
+	patternStore   service.PatternStore
+	segmentStore   service.SegmentStore
+	statsStore     service.StatsStore
+	records        query.Source
+
+	notifications       *service.Broadcaster[*pb.Notification]
+	notificationSenders *service.Broadcaster[*pb.UserId]
 
 	loggy.UnimplementedLoggyServiceServer
 }
 
+// receiver streams the messages sent to a session to the owner of the
+// session.
+type receiver struct {
+	userID    string
+	sessionID int32
+	c         chan *pb.Message
+}
+
 func getUserIdFromMetaData(ctx context.Context) (string, error) {
 	md, _ := metadata.FromIncomingContext(ctx)
 	if len(md["user_id"]) == 0 {
@@ -52,10 +91,9 @@ func getUserIdFromMetaData(ctx context.Context) (string, error) {
 }
 
 func (l *loggyServer) InsertWaitListUser(ctx context.Context, app *pb.WaitListUser) (*empty.Empty, error) {
-	entry := &service.WaitlistUser{
-		Email: app.Email,
+	if err := l.store.AddWaitlistUser(app.Email); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to add user to waitlist: %v", err)
 	}
-	l.db.Where(entry).FirstOrCreate(&entry)
 	return &empty.Empty{}, nil
 }
 
@@ -75,8 +113,10 @@ func (l *loggyServer) GetOrInsertApplication(ctx context.Context, app *pb.Applic
 		Name:        app.Name,
 		Icon:        app.Icon,
 	}
-	exists := &service.Application{}
-	l.db.Where(entry).FirstOrCreate(&exists)
+	exists, err := l.store.GetOrCreateApplication(entry)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to add application: %v", err)
+	}
 	return &pb.Application{
 		Id:          exists.ID,
 		Packagename: exists.PackageName,
@@ -85,10 +125,28 @@ func (l *loggyServer) GetOrInsertApplication(ctx context.Context, app *pb.Applic
 	}, nil
 }
 
-func (l *loggyServer) ListApplications(ctx context.Context, userid *pb.UserId) (*pb.ApplicationList, error) {
-	var entries []*service.Application
+func (l *loggyServer) ListApplications(ctx context.Context, request *pb.ListApplicationsRequest) (*pb.ApplicationList, error) {
+	userID, err := getUserIdFromMetaData(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "user not found")
+	}
+	// the user is the authenticated one, the request may only repeat it
+	if len(request.Userid) != 0 && request.Userid != userID {
+		return nil, status.Errorf(codes.PermissionDenied, "applications of another user")
+	}
+	page, err := parsePage(request.Page, pb.PageRequest_OLDEST, pb.PageRequest_NEWEST)
+	if err != nil {
+		return nil, err
+	}
 	var apps []*pb.Application
-	l.db.Where("user_id = ?", userid.Id).Find(&entries)
+	total, err := l.store.CountApplications(userID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to count applications: %v", err)
+	}
+	entries, err := l.store.ListApplications(userID, page.query())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list applications: %v", err)
+	}
 	for _, app := range entries {
 		apps = append(apps, &pb.Application{
 			Id:          app.ID,
@@ -97,35 +155,64 @@ func (l *loggyServer) ListApplications(ctx context.Context, userid *pb.UserId) (
 			Icon:        app.Icon,
 		})
 	}
-	return &pb.ApplicationList{Apps: apps}, nil
+	return &pb.ApplicationList{
+		Apps:          apps,
+		NextPageToken: page.nextOffset(len(entries)),
+		TotalCount:    total,
+	}, nil
 }
 
 func (l *loggyServer) GetOrInsertDevice(ctx context.Context, device *pb.Device) (*pb.Device, error) {
 	deviceid, err := uuid.FromString(device.Id)
 	if err != nil {
-		return nil, err
+		return nil, status.Errorf(codes.InvalidArgument, "invalid device id %q", device.Id)
 	}
 	if len(device.Appid) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "failed to add device. no app id")
 	}
+	if _, err := l.ownedApp(ctx, device.Appid); err != nil {
+		return nil, err
+	}
 	entry := &service.Device{
 		ID:      deviceid,
 		AppID:   device.Appid,
 		Details: device.Details,
 	}
-	exists := &service.Device{}
-	l.db.Where(entry).FirstOrCreate(&exists)
-	return &pb.Device{
+	exists, isNew, err := l.store.GetOrCreateDevice(entry)
+	if errors.Is(err, service.ErrDeviceApplication) {
+		return nil, status.Errorf(codes.AlreadyExists, "device %s belongs to another application", device.Id)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to add device: %v", err)
+	}
+	created := &pb.Device{
 		Id:      exists.ID.String(),
 		Appid:   exists.AppID,
 		Details: exists.Details,
-	}, nil
+	}
+	if isNew {
+		l.notifyApp(exists.AppID, NotificationNewDevice, fmt.Sprintf("new device %s", created.Id), &pb.DeviceEvent{Device: created})
+	}
+	return created, nil
 }
 
-func (l *loggyServer) ListDevices(ctx context.Context, appid *pb.ApplicationId) (*pb.DeviceList, error) {
-	var entries []*service.Device
+func (l *loggyServer) ListDevices(ctx context.Context, request *pb.ListDevicesRequest) (*pb.DeviceList, error) {
+	if _, err := l.ownedApp(ctx, request.Appid); err != nil {
+		return nil, err
+	}
+	page, err := parsePage(request.Page, pb.PageRequest_OLDEST, pb.PageRequest_NEWEST)
+	if err != nil {
+		return nil, err
+	}
 	var devices []*pb.Device
-	l.db.Where("application_id = ?", appid.Id).Find(&entries)
+	total, err := l.store.CountDevices(request.Appid)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to count devices: %v", err)
+	}
+	entries, err := l.store.ListDevices(request.Appid, page.query())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list devices: %v", err)
+	}
 	for _, device := range entries {
 		devices = append(devices, &pb.Device{
 			Id:      device.ID.String(),
@@ -133,110 +220,205 @@ func (l *loggyServer) ListDevices(ctx context.Context, appid *pb.ApplicationId)
 			Appid:   device.AppID,
 		})
 	}
-	return &pb.DeviceList{Devices: devices}, nil
+	return &pb.DeviceList{
+		Devices:       devices,
+		NextPageToken: page.nextOffset(len(entries)),
+		TotalCount:    total,
+	}, nil
 }
 
 func (l *loggyServer) InsertSession(ctx context.Context, session *pb.Session) (*pb.SessionId, error) {
 	deviceid, err := uuid.FromString(session.Deviceid)
 	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid device id %q", session.Deviceid)
+	}
+	if _, err := l.ownedApp(ctx, session.Appid); err != nil {
 		return nil, err
 	}
+	device, err := l.store.Device(session.Deviceid)
+	if err != nil {
+		return nil, storeError(err, "device "+session.Deviceid)
+	}
+	if device.AppID != session.Appid {
+		return nil, status.Errorf(codes.InvalidArgument, "device %s does not belong to application %s", session.Deviceid, session.Appid)
+	}
+	now := time.Now()
 	exists := &service.Session{
-		AppID:    session.Appid,
-		DeviceID: deviceid,
+		AppID:         session.Appid,
+		DeviceID:      deviceid,
+		Status:        service.SessionLive,
+		StartedAt:     now,
+		LastMessageAt: now,
+	}
+	if err := l.store.CreateSession(exists); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to add session: %v", err)
 	}
-	l.db.Create(&exists)
+	l.rollups.sessionStarted(exists)
+	l.notifyApp(exists.AppID, NotificationNewSession, fmt.Sprintf("new session %d", exists.ID), &pb.SessionEvent{Session: sessionToPb(exists)})
 	return &pb.SessionId{
 		Id: exists.ID,
 	}, nil
 }
 
 func (l *loggyServer) ListSessions(ctx context.Context, query *pb.SessionQuery) (*pb.SessionList, error) {
-	var entries []*service.Session
+	if _, err := l.ownedApp(ctx, query.Appid); err != nil {
+		return nil, err
+	}
+	page, err := parsePage(query.Page, pb.PageRequest_OLDEST, pb.PageRequest_NEWEST)
+	if err != nil {
+		return nil, err
+	}
 	var sessions []*pb.Session
-	l.db.Where("application_id = ?", query.Appid).Where("device_id = ?", query.Deviceid).Find(&entries)
+	total, err := l.store.CountSessions(query.Appid, query.Deviceid)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to count sessions: %v", err)
+	}
+	entries, err := l.store.ListSessions(query.Appid, query.Deviceid, page.query())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list sessions: %v", err)
+	}
+	var last pageToken
 	for _, session := range entries {
-		sessions = append(sessions, &pb.Session{
-			Id:       session.ID,
-			Deviceid: session.DeviceID.String(),
-			Appid:    session.AppID,
-		})
+		sessions = append(sessions, sessionToPb(session))
+		last.ID = int64(session.ID)
 	}
-	return &pb.SessionList{Sessions: sessions}, nil
+	return &pb.SessionList{
+		Sessions:      sessions,
+		NextPageToken: page.next(len(entries), last),
+		TotalCount:    total,
+	}, nil
 }
 
-func (l *loggyServer) ListSessionMessages(ctx context.Context, sessionid *pb.SessionId) (*pb.MessageList, error) {
-	var entries []*service.Message
-	var messages []*pb.Message
-	l.db.Where("session_id = ?", sessionid.Id).Find(&entries)
-	for _, message := range entries {
-		messages = append(messages, &pb.Message{
-			Id:        int32(message.ID),
-			Sessionid: message.SessionID,
-			Msg:       message.Msg,
-			Timestamp: timestamppb.New(message.Timestamp),
-			Level:     loggy.Message_Level(message.Level),
-		})
+func messageToPb(message *service.Message) *pb.Message {
+	return &pb.Message{
+		Id:        int32(message.ID),
+		Sessionid: message.SessionID,
+		Msg:       message.Msg,
+		Timestamp: timestamppb.New(message.Timestamp),
+		Level:     pb.Message_Level(message.Level),
+		PatternId: message.PatternID,
+		TraceId:   message.TraceID,
+		SpanId:    message.SpanID,
 	}
-	return &pb.MessageList{Messages: messages}, nil
 }
 
-func (l *loggyServer) GetSessionStats(ctx context.Context, sessionid *pb.SessionId) (*pb.SessionStats, error) {
-	var debugCount int64
-	var infoCount int64
-	var errorCount int64
-	var warnCount int64
-	var crashCount int64
-	l.db.Model(&service.Message{}).Where("session_id = ?", sessionid.Id).Where("level = ?", 0).Count(&debugCount)
-	l.db.Model(&service.Message{}).Where("session_id = ?", sessionid.Id).Where("level = ?", 1).Count(&infoCount)
-	l.db.Model(&service.Message{}).Where("session_id = ?", sessionid.Id).Where("level = ?", 2).Count(&errorCount)
-	l.db.Model(&service.Message{}).Where("session_id = ?", sessionid.Id).Where("level = ?", 3).Count(&warnCount)
-	l.db.Model(&service.Message{}).Where("session_id = ?", sessionid.Id).Where("level = ?", 4).Count(&crashCount)
-	return &pb.SessionStats{
-		DebugCount: int32(debugCount),
-		InfoCount:  int32(infoCount),
-		ErrorCount: int32(errorCount),
-		WarnCount:  int32(warnCount),
-		CrashCount: int32(crashCount),
+func (l *loggyServer) ListSessionMessages(ctx context.Context, query *pb.SessionMessagesQuery) (*pb.MessageList, error) {
+	if _, err := l.ownedSession(ctx, query.Sessionid); err != nil {
+		return nil, err
+	}
+	page, err := parsePage(query.Page, pb.PageRequest_OLDEST, pb.PageRequest_NEWEST)
+	if err != nil {
+		return nil, err
+	}
+	var messages []*pb.Message
+	total, err := l.store.CountMessages(query.Sessionid)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to count messages: %v", err)
+	}
+	entries, err := l.store.ListMessages(service.MessageFilter{SessionID: query.Sessionid}, page.query())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list messages: %v", err)
+	}
+	var last pageToken
+	for _, message := range entries {
+		last.Time, last.ID = &message.Timestamp, int64(message.ID)
+		messages = append(messages, messageToPb(message))
+	}
+	return &pb.MessageList{
+		Messages:      messages,
+		NextPageToken: page.next(len(entries), last),
+		TotalCount:    total,
 	}, nil
 }
 
 func (l *loggyServer) Notify(e *empty.Empty, stream pb.LoggyService_NotifyServer) error {
-	log.Println("Listening")
-	for session := range l.notifications {
-		log.Println(session)
-		stream.Send(session)
+	userID, err := getUserIdFromMetaData(stream.Context())
+	if err != nil {
+		return status.Errorf(codes.Unauthenticated, "failed to listen for sessions. user not found")
+	}
+
+	sub := l.sessions.Subscribe(userID)
+	defer l.sessions.Unsubscribe(sub)
+
+	log.Printf("Listening for sessions of user %s", userID)
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case session := <-sub.C:
+			if err := stream.Send(session); err != nil {
+				return err
+			}
+		}
 	}
-	return nil
 }
 
 func (l *loggyServer) RegisterSend(ctx context.Context, sessionid *pb.SessionId) (*empty.Empty, error) {
-	session := &service.Session{}
-
-	err := l.db.Where("id = ?", sessionid.Id).First(&session).Error
+	session, err := l.ownedSession(ctx, sessionid.Id)
 	if err != nil {
-		return nil, errors.New("session not found")
-	}
-	l.notifications <- &pb.Session{
-		Id:       session.ID,
-		Deviceid: session.DeviceID.String(),
-		Appid:    session.AppID,
+		return nil, err
 	}
+	userID, _ := getUserIdFromMetaData(ctx)
+	l.sessions.Publish(userID, sessionToPb(session))
 	return &empty.Empty{}, nil
 }
 
+// RegisterReceive subscribes the owner of a session to the messages sent to
+// it, which Receive streams.
 func (l *loggyServer) RegisterReceive(ctx context.Context, sessionid *pb.SessionId) (*pb.ReceiverId, error) {
+	if _, err := l.ownedSession(ctx, sessionid.Id); err != nil {
+		return nil, err
+	}
+	userID, _ := getUserIdFromMetaData(ctx)
+
 	l.lock.Lock()
 	defer l.lock.Unlock()
 
-	id := int32(len(l.receivers) + 1)
-	l.receivers[id] = make(chan *pb.Message, 100)
+	l.lastReceiver++
+	id := l.lastReceiver
+	l.receivers[id] = &receiver{userID: userID, sessionID: sessionid.Id, c: make(chan *pb.Message, 100)}
 	l.listeners[sessionid.Id] = append(l.listeners[sessionid.Id], id)
 	return &pb.ReceiverId{Id: id}, nil
 }
 
+// removeReceiver stops passing messages to a receiver.
+func (l *loggyServer) removeReceiver(id int32) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	r, ok := l.receivers[id]
+	if !ok {
+		return
+	}
+	delete(l.receivers, id)
+	listeners := l.listeners[r.sessionID]
+	for i, receiverid := range listeners {
+		if receiverid == id {
+			listeners = append(listeners[:i], listeners[i+1:]...)
+			break
+		}
+	}
+	if len(listeners) == 0 {
+		delete(l.listeners, r.sessionID)
+	} else {
+		l.listeners[r.sessionID] = listeners
+	}
+}
+
 func (l *loggyServer) Send(stream pb.LoggyService_SendServer) error {
 	log.Println("Started stream")
+
+	// sessions sent on this stream end when the stream closes
+	sent := make(map[int32]service.SessionStatus)
+	defer func() {
+		for sessionid, reason := range sent {
+			if _, err := l.endSession(sessionid, reason); err != nil {
+				log.Printf("failed to end session %d: %v", sessionid, err)
+			}
+		}
+	}()
+
+	sessions := make(map[int32]*service.Session)
 	for {
 		in, err := stream.Recv()
 		if err == io.EOF {
@@ -245,84 +427,149 @@ func (l *loggyServer) Send(stream pb.LoggyService_SendServer) error {
 		if err != nil {
 			return err
 		}
+		session, ok := sessions[in.Sessionid]
+		if !ok {
+			// the session ends with the stream, only its owner may send to it
+			session, err = l.ownedSession(stream.Context(), in.Sessionid)
+			if err != nil {
+				return err
+			}
+			// messages of ended sessions would not be listed once the
+			// session is archived
+			if session.Status != service.SessionLive {
+				return status.Errorf(codes.FailedPrecondition, "session %d has ended", in.Sessionid)
+			}
+			sessions[in.Sessionid] = session
+		}
+		usage, exceeded := l.quota.add(session.AppID)
+		if exceeded {
+			l.notifyApp(session.AppID, NotificationQuotaExceeded,
+				fmt.Sprintf("%s exceeded its daily quota of %d messages", session.AppID, l.quota.limit),
+				&pb.QuotaEvent{
+					Appid:       session.AppID,
+					Limit:       l.quota.limit,
+					Count:       usage.count,
+					PeriodStart: timestamppb.New(usage.day),
+				})
+		}
+		l.logger.log(session, in)
+		l.alerts.observe(session.AppID, in)
+		if in.Level == pb.Message_CRASH {
+			l.notifyApp(session.AppID, NotificationCrash,
+				fmt.Sprintf("crash received in session %d", session.ID),
+				&pb.CrashEvent{Session: sessionToPb(session), Message: in})
+			sent[in.Sessionid] = service.SessionCrashed
+		} else if _, ok := sent[in.Sessionid]; !ok {
+			sent[in.Sessionid] = service.SessionEnded
+		}
+		// receivers that fall behind miss messages, the stream does not
+		// wait for them
 		l.lock.RLock()
 		listeners := l.listeners[in.Sessionid]
 		for _, receiverid := range listeners {
-			if client, ok := l.receivers[receiverid]; ok {
-				client <- in
+			if r, ok := l.receivers[receiverid]; ok {
+				select {
+				case r.c <- in:
+				default:
+					log.Printf("receiver %d is behind, dropping message", receiverid)
+				}
 			}
 		}
 		l.lock.RUnlock()
 	}
 }
 
+// Receive streams the messages of a receiver registered by the caller. The
+// receiver is removed when the stream ends.
 func (l *loggyServer) Receive(receiverid *pb.ReceiverId, stream pb.LoggyService_ReceiveServer) error {
+	userID, err := getUserIdFromMetaData(stream.Context())
+	if err != nil {
+		return status.Errorf(codes.Unauthenticated, "failed to receive. user not found")
+	}
 	l.lock.RLock()
-	client := l.receivers[receiverid.Id]
+	r, ok := l.receivers[receiverid.Id]
 	l.lock.RUnlock()
-
-	for in := range client {
-		stream.Send(in)
+	if !ok || r.userID != userID {
+		return status.Errorf(codes.NotFound, "receiver %d not found", receiverid.Id)
 	}
-	return nil
-}
+	defer l.removeReceiver(receiverid.Id)
 
-func (l *loggyServer) Search(ctx context.Context, query *pb.Query) (*pb.MessageList, error) {
-	result, err := l.indexer.Search(bleve.NewSearchRequest(bleve.NewQueryStringQuery(query.Query)))
-	if err != nil {
-		log.Println(err)
-	}
-	var messages []*pb.Message
-	for _, hit := range result.Hits {
-		msg := &service.Message{}
-		err := l.db.Where("id = ?", hit.ID).First(&msg).Error
-		if err != nil {
-			return nil, errors.New("msg not found")
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case in := <-r.c:
+			if err := stream.Send(in); err != nil {
+				return err
+			}
 		}
-		messages = append(messages, &pb.Message{
-			Id:        int32(msg.ID),
-			Sessionid: msg.SessionID,
-			Msg:       msg.Msg,
-			Timestamp: timestamppb.New(msg.Timestamp),
-			Level:     pb.Message_Level(msg.Level),
-		})
 	}
-	return &pb.MessageList{Messages: messages}, nil
 }
 
 func main() {
-	prefix := flag.String("prefix", "logs", "Prefix for logs. (logs)")
-	server := flag.String("server", "localhost", "Server to connect to. (localhost)")
+	dailyQuota := flag.Int64("daily-quota", 0, "Messages per application and day above which the owner is notified, 0 for no quota. Messages over it are still stored. (0)")
+	smtpAddr := flag.String("smtp-addr", "", "SMTP server for email notifications, disabled when empty. (host:port)")
+	smtpUser := flag.String("smtp-user", "", "SMTP user name.")
+	smtpPassword := flag.String("smtp-password", os.Getenv("SMTP_PASSWORD"), "SMTP password. ($SMTP_PASSWORD)")
+	smtpFrom := flag.String("smtp-from", "loggy@loggy.sh", "Sender of email notifications. (loggy@loggy.sh)")
+	digestHour := flag.Int("digest-hour", 8, "Hour of the day (UTC) daily digests are sent at. (8)")
+	sessionTimeout := flag.Duration("session-timeout", 30*time.Minute, "End sessions without messages for this long. (30m)")
+	indexAnalyzer := flag.String("index-analyzer", standard.Name, "Analyzer of message bodies in the search index, e.g. standard, simple, web or en. Changing it rebuilds the index. (standard)")
+	httpAddr := flag.String("http-addr", ":50112", "Address of the HTTP server for downloads. (:50112)")
+	anomalyWindow := flag.Duration("anomaly-window", 5*time.Minute, "Window error rates are compared over to detect anomalies. (5m)")
+	rollupInterval := flag.Duration("rollup-interval", 10*time.Second, "How often message and session counts are written to the stats rollups. (10s)")
+	database := service.DatabaseFlags("db/test.db")
+	parquetDir := flag.String("parquet-dir", "", "Directory messages are exported to as Parquet files, disabled when empty.")
+	parquetInterval := flag.Duration("parquet-interval", time.Hour, "How often new messages are exported to Parquet files. (1h)")
+	parquetLag := flag.Duration("parquet-lag", time.Minute, "Messages are exported to Parquet files once they are this old, so none still being stored is skipped. (1m)")
+	segmentDir := flag.String("segment-dir", "segments", "Directory archived sessions are stored in. (segments)")
+	archiveAfter := flag.Duration("archive-after", 30*24*time.Hour, "Archive sessions this long after they ended, 0 to never archive. (720h)")
+	archiveInterval := flag.Duration("archive-interval", time.Hour, "How often ended sessions are archived. (1h)")
+	retentionInterval := flag.Duration("retention-interval", time.Hour, "How often messages past the retention policy of their application are deleted. (1h)")
+	webhookPrivate := flag.Bool("webhook-private", false, "Allow webhooks to loopback, private and link-local addresses, e.g. for development. (false)")
 	flag.Parse()
 
-	db, err := gorm.Open(sqlite.Open("db/test.db"), &gorm.Config{})
+	db, err := service.OpenDatabase(database)
 	if err != nil {
 		log.Fatalf("failed to connect database: %v", err)
 	}
 
 	// Migrate the schema
-	db.AutoMigrate(&service.Application{})
-	db.AutoMigrate(&service.Device{})
-	db.AutoMigrate(&service.Session{})
-	db.AutoMigrate(&service.Message{})
-	db.AutoMigrate(&service.WaitlistUser{})
-
-	var indexer bleve.Index
-	if _, err := os.Stat(IndexPath); os.IsNotExist(err) {
-		indexer, err = bleve.New(IndexPath, bleve.NewIndexMapping())
-		if err != nil {
-			log.Fatalf("failed to create new index: %v", err)
-		}
-
-	} else {
-		indexer, err = bleve.Open(IndexPath)
-		if err != nil {
-			log.Fatalf("failed to open index: %v", err)
-		}
+	err = db.AutoMigrate(
+		&service.Application{},
+		&service.Device{},
+		&service.Session{},
+		&service.Message{},
+		&service.WaitlistUser{},
+		&service.AlertRule{},
+		&service.AlertEvent{},
+		&service.Webhook{},
+		&service.WebhookDelivery{},
+		&service.Rollup{},
+		&service.RollupDevice{},
+		&service.SavedSearch{},
+		&service.Pattern{},
+		&service.Anomaly{},
+		&service.ExportWatermark{},
+		&service.RetentionPolicy{},
+		&service.RetentionReport{},
+		&service.Segment{},
+	)
+	if err != nil {
+		log.Fatalf("database migration failed: %v", err)
 	}
 
+	indexer, rebuild, err := service.OpenIndex(IndexPath, *indexAnalyzer)
 	if err != nil {
-		log.Fatalf("failed to create index: %v", err)
+		log.Fatalf("failed to open index: %v", err)
+	}
+	if rebuild {
+		// searches only see part of the messages until this is done
+		go func() {
+			if err := service.RebuildIndex(db, indexer, 1000); err != nil {
+				log.Printf("failed to rebuild index: %v", err)
+			}
+		}()
 	}
 
 	interceptor := service.NewAuthInterceptor("Auth")
@@ -330,20 +577,90 @@ func main() {
 		grpc.UnaryInterceptor(interceptor.Unary()),
 		grpc.StreamInterceptor(interceptor.Stream()),
 	)
-	pb.RegisterLoggyServiceServer(grpcServer, &loggyServer{
-		db:            db,
-		indexer:       indexer,
-		notifications: make(chan *pb.Session),
-		receivers:     make(map[int32]chan *pb.Message),
-		listeners:     make(map[int32][]int32),
-	})
+	sessions := service.NewBroadcaster[*pb.Session]("sessions", 100)
+	segments := service.NewSegments(*segmentDir)
+	store := service.NewGormStore(db, segments)
+	srv := &loggyServer{
+		store:     store,
+		indexer:   indexer,
+		sessions:  sessions,
+		quota:     newMessageQuota(*dailyQuota),
+		webhooks:  newWebhookDispatcher(db, *webhookPrivate),
+		rollups:   newRollupWriter(db),
+		patterns:  newPatternMiner(db),
+		retention: newRetentionJob(db, indexer, segments),
+		segments:  segments,
+		archiver:  newSessionArchiver(db, indexer, segments, *archiveAfter, len(*parquetDir) != 0),
+		receivers: make(map[int32]*receiver),
+		listeners: make(map[int32][]int32),
+
+		alertStore:     store,
+		webhookStore:   store,
+		searchStore:    store,
+		retentionStore: store,
+		anomalyStore:   store,
+		patternStore:   store,
+		segmentStore:   store,
+		statsStore:     store,
+		records:        query.NewGormSource(db),
+
+		notifications:       service.NewBroadcaster[*pb.Notification]("notifications", 100),
+		notificationSenders: service.NewBroadcaster[*pb.UserId]("notification senders", 10),
+	}
+	if len(*parquetDir) != 0 {
+		srv.parquet = newParquetExporter(db, *parquetDir, *parquetLag)
+	}
+	if len(*smtpAddr) != 0 {
+		srv.email = newEmailNotifier(&mailer{
+			addr:     *smtpAddr,
+			username: *smtpUser,
+			password: *smtpPassword,
+			from:     *smtpFrom,
+		})
+	}
+	srv.alerts, err = newAlertEngine(db, *indexAnalyzer, srv.notifyAlert)
+	if err != nil {
+		log.Fatalf("failed to load alert rules: %v", err)
+	}
+	srv.anomalies = newAnomalyDetector(db, *anomalyWindow, srv.notifyAnomaly)
+	srv.standing, err = newStandingQueries(*indexAnalyzer)
+	if err != nil {
+		log.Fatalf("failed to create standing queries: %v", err)
+	}
+	srv.logger = newMessageLogger(indexer, store, srv.rollups, srv.patterns, srv.anomalies, srv.standing)
+	pb.RegisterLoggyServiceServer(grpcServer, srv)
 
 	l, err := net.Listen("tcp", ":50111")
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
 
-	go logger(prefix, server, indexer, db)
+	go srv.logger.run()
+	go srv.expireSessions(*sessionTimeout)
+	go srv.alerts.run()
+	go srv.standing.run()
+	go srv.webhooks.run()
+	go srv.rollups.run(*rollupInterval)
+	go srv.patterns.run(patternFlushInterval)
+	go srv.anomalies.run()
+	go srv.retention.run(*retentionInterval)
+	if *archiveAfter > 0 {
+		go srv.archiver.run(*archiveInterval)
+	}
+	if srv.parquet != nil {
+		go srv.parquet.run(*parquetInterval)
+	}
+	if srv.email != nil {
+		go srv.email.run()
+		go srv.runDigests(*digestHour)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/export/session", srv.exportHandler(interceptor))
+	go func() {
+		log.Printf("Listening on http://%s", *httpAddr)
+		log.Fatal(http.ListenAndServe(*httpAddr, mux))
+	}()
 
 	log.Println("Listening on tcp://localhost:50111")
 	grpcServer.Serve(l)
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/loggysh/loggy/loggy"
+	"github.com/loggysh/loggy/service"
+)
+
+const (
+	defaultMessageContext = 10
+	maxMessageContext     = 1000
+)
+
+// messagesAround loads up to before and after messages of the session
+// around msg, in timestamp order. A window keeps only messages that close
+// to msg.
+func (l *loggyServer) messagesAround(msg *service.Message, before, after int, window time.Duration) (*pb.MessageContext, error) {
+	load := func(order pb.PageRequest_Sort, size int) ([]*service.Message, bool, error) {
+		// one more than asked for tells if there are more
+		p := &page{size: size + 1, sort: order, after: &pageToken{Time: &msg.Timestamp, ID: int64(msg.ID)}}
+		filter := service.MessageFilter{SessionID: msg.SessionID}
+		if window > 0 {
+			filter.Start, filter.End = msg.Timestamp.Add(-window), msg.Timestamp.Add(window)
+		}
+		messages, err := l.store.ListMessages(filter, p.query())
+		if err != nil {
+			return nil, false, err
+		}
+		if len(messages) > size {
+			return messages[:size], true, nil
+		}
+		return messages, false, nil
+	}
+
+	result := &pb.MessageContext{Message: messageToPb(msg)}
+	previous, more, err := load(pb.PageRequest_NEWEST, before)
+	if err != nil {
+		return nil, err
+	}
+	result.MoreBefore = more
+	for i := len(previous) - 1; i >= 0; i-- {
+		result.Before = append(result.Before, messageToPb(previous[i]))
+	}
+	next, more, err := load(pb.PageRequest_OLDEST, after)
+	if err != nil {
+		return nil, err
+	}
+	result.MoreAfter = more
+	for _, m := range next {
+		result.After = append(result.After, messageToPb(m))
+	}
+	return result, nil
+}
+
+// messageContextSize is the number of messages returned on one side of a
+// message, the default when the request leaves it unset.
+func messageContextSize(size *int32) int {
+	if size == nil {
+		return defaultMessageContext
+	}
+	if *size < 0 {
+		return 0
+	}
+	if *size > maxMessageContext {
+		return maxMessageContext
+	}
+	return int(*size)
+}
+
+// GetMessageContext returns the messages logged around a message of the
+// caller, e.g. to expand a search hit.
+func (l *loggyServer) GetMessageContext(ctx context.Context, request *pb.MessageContextRequest) (*pb.MessageContext, error) {
+	msg, err := l.store.Message(int(request.MessageId))
+	if err != nil {
+		return nil, storeError(err, fmt.Sprintf("message %d", request.MessageId))
+	}
+	// messages of other users are not found either, their ids are not
+	// given away
+	if _, err := l.ownedSession(ctx, msg.SessionID); status.Code(err) == codes.PermissionDenied {
+		return nil, status.Errorf(codes.NotFound, "message %d not found", request.MessageId)
+	} else if err != nil {
+		return nil, err
+	}
+	result, err := l.messagesAround(msg, messageContextSize(request.Before), messageContextSize(request.After), request.Window.AsDuration())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to load messages around %d: %v", request.MessageId, err)
+	}
+	return result, nil
+}
+
+// messages a trace returns at most
+const maxTraceMessages = 10000
+
+// GetTrace returns the messages of a trace in time order, from every
+// application, device and session of the caller.
+func (l *loggyServer) GetTrace(ctx context.Context, request *pb.TraceRequest) (*pb.Trace, error) {
+	userID, err := getUserIdFromMetaData(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get trace. user not found")
+	}
+	if len(request.TraceId) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "trace id is required")
+	}
+	records, err := l.records.Trace(userID, request.TraceId, maxTraceMessages+1)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to load trace: %v", err)
+	}
+	trace := &pb.Trace{TraceId: request.TraceId}
+	if len(records) > maxTraceMessages {
+		records = records[:maxTraceMessages]
+		trace.Truncated = true
+	}
+	for _, record := range records {
+		trace.Messages = append(trace.Messages, &pb.TraceMessage{
+			Message:  messageToPb(&record.Message),
+			Appid:    record.AppID,
+			Deviceid: record.DeviceID,
+		})
+	}
+	return trace, nil
+}
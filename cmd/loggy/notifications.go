@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"log"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	empty "google.golang.org/protobuf/types/known/emptypb"
+
+	pb "github.com/loggysh/loggy/loggy"
+)
+
+// Notification types sent to a user's dashboard.
+const (
+	NotificationNewDevice     = "device.new"
+	NotificationNewSession    = "session.new"
+	NotificationCrash         = "crash.received"
+	NotificationQuotaExceeded = "quota.exceeded"
+)
+
+// notify publishes a notification about one of the user's applications.
+func (l *loggyServer) notify(userID, appID, kind, message string, detail proto.Message) {
+	notification := &pb.Notification{
+		Type:      kind,
+		Message:   message,
+		Timestamp: timestamppb.Now(),
+		Appid:     appID,
+	}
+	if detail != nil {
+		any, err := anypb.New(detail)
+		if err != nil {
+			log.Printf("failed to pack %s notification: %v", kind, err)
+			return
+		}
+		notification.Detail = any
+	}
+	l.notifications.Publish(userID, notification)
+	l.webhooks.dispatch(notification)
+	l.email.dispatch(userID, notification)
+}
+
+// notifyApp publishes a notification to the owner of the application.
+func (l *loggyServer) notifyApp(appID, kind, message string, detail proto.Message) {
+	userID, err := l.appOwner(appID)
+	if err != nil {
+		log.Printf("failed to send %s notification: %v", kind, err)
+		return
+	}
+	l.notify(userID, appID, kind, message, detail)
+}
+
+// notificationUser returns the authenticated user, refusing requests for
+// any other user's notifications.
+func notificationUser(ctx context.Context, userid *pb.UserId) (string, error) {
+	userID, err := getUserIdFromMetaData(ctx)
+	if err != nil {
+		return "", status.Errorf(codes.Unauthenticated, "user not found")
+	}
+	if len(userid.GetId()) != 0 && userid.GetId() != userID {
+		return "", status.Errorf(codes.PermissionDenied, "notifications of user %s are not accessible", userid.GetId())
+	}
+	return userID, nil
+}
+
+func (l *loggyServer) NotificationRegistry(e *empty.Empty, stream pb.LoggyService_NotificationRegistryServer) error {
+	userID, err := notificationUser(stream.Context(), &pb.UserId{})
+	if err != nil {
+		return err
+	}
+
+	sub := l.notificationSenders.Subscribe(userID)
+	defer l.notificationSenders.Unsubscribe(sub)
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case sender := <-sub.C:
+			if err := stream.Send(sender); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (l *loggyServer) RegisterNotificationSend(ctx context.Context, userid *pb.UserId) (*empty.Empty, error) {
+	userID, err := notificationUser(ctx, userid)
+	if err != nil {
+		return nil, err
+	}
+	l.notificationSenders.Publish(userID, &pb.UserId{Id: userID})
+	return &empty.Empty{}, nil
+}
+
+func (l *loggyServer) RegisterNotificationRecieve(ctx context.Context, userid *pb.UserId) (*pb.UserId, error) {
+	userID, err := notificationUser(ctx, userid)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.UserId{Id: userID}, nil
+}
+
+func (l *loggyServer) ReceiveNotification(userid *pb.UserId, stream pb.LoggyService_ReceiveNotificationServer) error {
+	userID, err := notificationUser(stream.Context(), userid)
+	if err != nil {
+		return err
+	}
+
+	sub := l.notifications.Subscribe(userID)
+	defer l.notifications.Unsubscribe(sub)
+
+	log.Printf("Streaming notifications of user %s", userID)
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case notification := <-sub.C:
+			if err := stream.Send(notification); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/loggysh/loggy/service"
+)
+
+// storeError converts an error of the store about what was loaded to a
+// gRPC status.
+func storeError(err error, what string) error {
+	if errors.Is(err, service.ErrNotFound) {
+		return status.Errorf(codes.NotFound, "%s not found", what)
+	}
+	return status.Errorf(codes.Internal, "failed to load %s: %v", what, err)
+}
+
+// appOwner returns the id of the user the application belongs to.
+func (l *loggyServer) appOwner(appID string) (string, error) {
+	app, err := l.store.Application(appID)
+	if err != nil {
+		return "", fmt.Errorf("application %s: %w", appID, err)
+	}
+	return app.UserID, nil
+}
+
+// ownedApp loads an application and checks that it belongs to the user
+// making the request.
+func (l *loggyServer) ownedApp(ctx context.Context, appID string) (*service.Application, error) {
+	userID, err := getUserIdFromMetaData(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "user not found")
+	}
+	app, err := l.store.Application(appID)
+	if err != nil {
+		return nil, storeError(err, "application "+appID)
+	}
+	if app.UserID != userID {
+		return nil, status.Errorf(codes.PermissionDenied, "application %s does not belong to user", appID)
+	}
+	return app, nil
+}
+
+// ownedSession loads a session and checks that its application belongs to
+// the user making the request.
+func (l *loggyServer) ownedSession(ctx context.Context, sessionID int32) (*service.Session, error) {
+	userID, err := getUserIdFromMetaData(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "user not found")
+	}
+	session, err := l.store.Session(sessionID)
+	if err != nil {
+		return nil, storeError(err, fmt.Sprintf("session %d", sessionID))
+	}
+	owner, err := l.appOwner(session.AppID)
+	if err != nil && !errors.Is(err, service.ErrNotFound) {
+		return nil, status.Errorf(codes.Internal, "failed to load %v", err)
+	}
+	if owner != userID {
+		return nil, status.Errorf(codes.PermissionDenied, "session %d does not belong to user", sessionID)
+	}
+	return session, nil
+}
+
+// ownedDevice loads a device and checks that its application belongs to
+// the user making the request.
+func (l *loggyServer) ownedDevice(ctx context.Context, deviceID string) (*service.Device, error) {
+	userID, err := getUserIdFromMetaData(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "user not found")
+	}
+	device, err := l.store.Device(deviceID)
+	if err != nil {
+		return nil, storeError(err, "device "+deviceID)
+	}
+	owner, err := l.appOwner(device.AppID)
+	if err != nil && !errors.Is(err, service.ErrNotFound) {
+		return nil, status.Errorf(codes.Internal, "failed to load %v", err)
+	}
+	if owner != userID {
+		return nil, status.Errorf(codes.PermissionDenied, "device %s does not belong to user", deviceID)
+	}
+	return device, nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/loggysh/loggy/loggy"
+	"github.com/loggysh/loggy/service"
+)
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// pageToken is the position after the last row of a page. Small lists page
+// by offset, large ones by the sort key of the last row so that deep pages
+// stay cheap.
+type pageToken struct {
+	Sort   pb.PageRequest_Sort `json:"s"`
+	Offset int                 `json:"o,omitempty"`
+	Time   *time.Time          `json:"t,omitempty"`
+	ID     int64               `json:"i,omitempty"`
+}
+
+type page struct {
+	size  int
+	sort  pb.PageRequest_Sort
+	after *pageToken
+}
+
+// parsePage validates the page request. Tokens only continue the sort they
+// were issued for.
+func parsePage(request *pb.PageRequest, defaultSort pb.PageRequest_Sort, sorts ...pb.PageRequest_Sort) (*page, error) {
+	p := &page{
+		size: int(request.GetPageSize()),
+		sort: request.GetSort(),
+	}
+	if p.size <= 0 {
+		p.size = defaultPageSize
+	}
+	if p.size > maxPageSize {
+		p.size = maxPageSize
+	}
+	if p.sort == pb.PageRequest_DEFAULT {
+		p.sort = defaultSort
+	}
+	supported := false
+	for _, sort := range append(sorts, defaultSort) {
+		supported = supported || sort == p.sort
+	}
+	if !supported {
+		return nil, status.Errorf(codes.InvalidArgument, "sort %s is not supported here", p.sort)
+	}
+
+	if len(request.GetPageToken()) == 0 {
+		return p, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(request.GetPageToken())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid page token")
+	}
+	p.after = &pageToken{}
+	if err := json.Unmarshal(data, p.after); err != nil || p.after.Sort != p.sort {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid page token")
+	}
+	return p, nil
+}
+
+func (p *page) offset() int {
+	if p.after == nil {
+		return 0
+	}
+	return p.after.Offset
+}
+
+// desc reports whether rows are sorted newest first.
+func (p *page) desc() bool {
+	return p.sort == pb.PageRequest_NEWEST
+}
+
+// next returns the token of the page after this one, or nothing when fewer
+// rows than the page size came back.
+func (p *page) next(rows int, token pageToken) string {
+	if rows < p.size {
+		return ""
+	}
+	token.Sort = p.sort
+	data, _ := json.Marshal(token)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// nextOffset is next for lists paged by offset.
+func (p *page) nextOffset(rows int) string {
+	return p.next(rows, pageToken{Offset: p.offset() + rows})
+}
+
+// query is the page as the store selects it.
+func (p *page) query() service.Page {
+	q := service.Page{Size: p.size, Desc: p.desc(), Offset: p.offset()}
+	if p.after != nil {
+		q.After = &service.Cursor{Time: p.after.Time, ID: p.after.ID}
+	}
+	return q
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/xitongsys/parquet-go/writer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	pb "github.com/loggysh/loggy/loggy"
+	"github.com/loggysh/loggy/service"
+)
+
+const (
+	// messages loaded from the database at a time
+	parquetBatchSize = 10000
+	// messages of an application written by one run, later runs go on
+	// from the watermark
+	maxParquetRows = 1000000
+	// rows are buffered in memory until a row group is this large
+	parquetRowGroupSize = 16 * 1024 * 1024
+)
+
+// parquetRow is a message with its session, device and application, the
+// way it is written to Parquet files.
+type parquetRow struct {
+	ID               int64  `parquet:"name=id, type=INT64"`
+	Timestamp        int64  `parquet:"name=timestamp, type=INT64, convertedtype=TIMESTAMP_MICROS"`
+	Level            int32  `parquet:"name=level, type=INT32"`
+	LevelName        string `parquet:"name=level_name, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Msg              string `parquet:"name=msg, type=BYTE_ARRAY, convertedtype=UTF8"`
+	PatternID        int64  `parquet:"name=pattern_id, type=INT64"`
+	TraceID          string `parquet:"name=trace_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	SpanID           string `parquet:"name=span_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	SessionID        int32  `parquet:"name=session_id, type=INT32"`
+	SessionStatus    string `parquet:"name=session_status, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	SessionStartedAt int64  `parquet:"name=session_started_at, type=INT64, convertedtype=TIMESTAMP_MICROS"`
+	SessionEndedAt   *int64 `parquet:"name=session_ended_at, type=INT64, convertedtype=TIMESTAMP_MICROS, repetitiontype=OPTIONAL"`
+	DeviceID         string `parquet:"name=device_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	AppVersion       string `parquet:"name=app_version, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	DeviceDetails    string `parquet:"name=device_details, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	AppID            string `parquet:"name=app_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	AppPackage       string `parquet:"name=app_package, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	AppName          string `parquet:"name=app_name, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+}
+
+// parquetRecord is a message joined with the dimensions written with it.
+type parquetRecord struct {
+	service.Message
+	DeviceID         string
+	SessionStatus    service.SessionStatus
+	SessionStartedAt time.Time
+	SessionCreatedAt time.Time
+	SessionEndedAt   *time.Time
+	Details          string
+	PackageName      string
+	AppName          string
+}
+
+var sessionStatusNames = map[service.SessionStatus]string{
+	service.SessionLive:     "live",
+	service.SessionEnded:    "ended",
+	service.SessionCrashed:  "crashed",
+	service.SessionTimedOut: "timed_out",
+}
+
+func newParquetRow(appID string, r *parquetRecord) *parquetRow {
+	started := r.SessionStartedAt
+	if started.IsZero() {
+		started = r.SessionCreatedAt
+	}
+	row := &parquetRow{
+		ID:               int64(r.ID),
+		Timestamp:        r.Timestamp.UnixMicro(),
+		Level:            int32(r.Level),
+		LevelName:        levelName(r.Level),
+		Msg:              r.Msg,
+		PatternID:        r.PatternID,
+		TraceID:          r.TraceID,
+		SpanID:           r.SpanID,
+		SessionID:        r.SessionID,
+		SessionStatus:    sessionStatusNames[r.SessionStatus],
+		SessionStartedAt: started.UnixMicro(),
+		DeviceID:         r.DeviceID,
+		AppVersion:       service.DeviceAttributes(r.Details)["application_version"],
+		DeviceDetails:    r.Details,
+		AppID:            appID,
+		AppPackage:       r.PackageName,
+		AppName:          r.AppName,
+	}
+	if r.SessionEndedAt != nil {
+		ended := r.SessionEndedAt.UnixMicro()
+		row.SessionEndedAt = &ended
+	}
+	return row
+}
+
+// parquetFile is a file of an export that is still being written. It is
+// renamed to its name once complete, so readers never see part of it.
+type parquetFile struct {
+	name string
+	file *os.File
+	buf  *bufio.Writer
+	w    *writer.ParquetWriter
+}
+
+func createParquetFile(dir, name string) (*parquetFile, error) {
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	f := &parquetFile{name: name, file: file, buf: bufio.NewWriter(file)}
+	f.w, err = writer.NewParquetWriterFromWriter(f.buf, new(parquetRow), 1)
+	if err != nil {
+		f.abort()
+		return nil, err
+	}
+	f.w.RowGroupSize = parquetRowGroupSize
+	return f, nil
+}
+
+func (f *parquetFile) close(dir string) error {
+	if err := f.w.WriteStop(); err != nil {
+		return err
+	}
+	if err := f.buf.Flush(); err != nil {
+		return err
+	}
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, f.name)
+	return os.Rename(path+".tmp", path)
+}
+
+func (f *parquetFile) abort() {
+	f.file.Close()
+	os.Remove(f.file.Name())
+}
+
+// parquetExporter writes the messages of every application to Parquet
+// files partitioned by application and day, like
+// app_id=<appid>/date=2022-10-01/part-<first message id>.parquet with the
+// application id escaped, so query engines like DuckDB or Spark read the
+// partitions from the path. Every run writes the messages after the
+// watermark of the application into new files and moves the watermark on.
+// A run that fails before the watermark is written is repeated by the next
+// one, which writes the same files.
+//
+// Message ids are handed out before the messages are committed, so a
+// message can show up after one with a higher id was read. Runs stop at the
+// first message stored less than lag ago, leaving time for the ones before
+// it to be committed, so none of them falls behind the watermark.
+type parquetExporter struct {
+	// one run at a time, runs of the same application would write the
+	// same files
+	lock sync.Mutex
+	db   *gorm.DB
+	dir  string
+	lag  time.Duration
+}
+
+func newParquetExporter(db *gorm.DB, dir string, lag time.Duration) *parquetExporter {
+	return &parquetExporter{db: db, dir: dir, lag: lag}
+}
+
+func (e *parquetExporter) records(appID string, after int) *gorm.DB {
+	return e.db.Table("messages").
+		Select("messages.*, sessions.device_id AS device_id, sessions.status AS session_status, "+
+			"sessions.started_at AS session_started_at, sessions.created_at AS session_created_at, "+
+			"sessions.ended_at AS session_ended_at, COALESCE(devices.details, '') AS details, "+
+			"applications.package_name AS package_name, applications.name AS app_name").
+		Joins("JOIN sessions ON sessions.id = messages.session_id").
+		Joins("JOIN applications ON applications.id = sessions.application_id").
+		Joins("LEFT JOIN devices ON devices.id = sessions.device_id").
+		Where("sessions.application_id = ? AND messages.id > ?", appID, after).
+		Order("messages.id").
+		Limit(parquetBatchSize)
+}
+
+// exportApp writes the messages of an application stored since its last
+// export, up to the first one stored less than lag ago.
+func (e *parquetExporter) exportApp(ctx context.Context, appID string) (*pb.ParquetExportResult, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	cutoff := time.Now().Add(-e.lag)
+
+	watermark := service.ExportWatermark{AppID: appID}
+	if err := e.db.Where(&watermark).Limit(1).Find(&watermark).Error; err != nil {
+		return nil, err
+	}
+	result := &pb.ParquetExportResult{Appid: appID, Watermark: int64(watermark.LastMessageID)}
+	files := make(map[string]*parquetFile) // day -> file
+	defer func() {
+		for _, f := range files {
+			f.abort()
+		}
+	}()
+
+	last := watermark.LastMessageID
+	recent := false
+	for !recent && result.Rows < maxParquetRows {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		var batch []*parquetRecord
+		if err := e.records(appID, last).Scan(&batch).Error; err != nil {
+			return nil, err
+		}
+		for _, record := range batch {
+			if !record.CreatedAt.Before(cutoff) {
+				recent = true
+				break
+			}
+			day := record.Timestamp.UTC().Format("2006-01-02")
+			f, ok := files[day]
+			if !ok {
+				name := filepath.Join("app_id="+url.PathEscape(appID), "date="+day, fmt.Sprintf("part-%012d.parquet", record.ID))
+				var err error
+				if f, err = createParquetFile(e.dir, name); err != nil {
+					return nil, err
+				}
+				files[day] = f
+			}
+			if err := f.w.Write(newParquetRow(appID, record)); err != nil {
+				return nil, err
+			}
+			last = record.ID
+			result.Rows++
+		}
+		if len(batch) < parquetBatchSize {
+			break
+		}
+	}
+	if result.Rows == 0 {
+		return result, nil
+	}
+
+	for day, f := range files {
+		if err := f.close(e.dir); err != nil {
+			return nil, err
+		}
+		delete(files, day)
+		result.Files = append(result.Files, f.name)
+	}
+	watermark.LastMessageID = last
+	err := e.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(&watermark).Error
+	if err != nil {
+		return nil, err
+	}
+	result.Watermark = int64(last)
+	return result, nil
+}
+
+// exportAll exports the messages of every application.
+func (e *parquetExporter) exportAll(ctx context.Context) error {
+	var appIDs []string
+	if err := e.db.Model(&service.Application{}).Pluck("id", &appIDs).Error; err != nil {
+		return err
+	}
+	for _, appID := range appIDs {
+		result, err := e.exportApp(ctx, appID)
+		if err != nil {
+			return fmt.Errorf("application %s: %w", appID, err)
+		}
+		if result.Rows != 0 {
+			log.Printf("Exported %d messages of %s to %d Parquet files", result.Rows, appID, len(result.Files))
+		}
+	}
+	return nil
+}
+
+func (e *parquetExporter) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := e.exportAll(context.Background()); err != nil {
+			log.Printf("failed to export Parquet files: %v", err)
+		}
+	}
+}
+
+// ExportParquet exports the messages of an application stored since the
+// last export, without waiting for the next scheduled run.
+func (l *loggyServer) ExportParquet(ctx context.Context, request *pb.ParquetExportRequest) (*pb.ParquetExportResult, error) {
+	if l.parquet == nil {
+		return nil, status.Error(codes.FailedPrecondition, "Parquet export is not enabled")
+	}
+	if _, err := l.ownedApp(ctx, request.Appid); err != nil {
+		return nil, err
+	}
+	result, err := l.parquet.exportApp(ctx, request.Appid)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to export messages: %v", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+
+	pb "github.com/loggysh/loggy/loggy"
+	"github.com/loggysh/loggy/service"
+)
+
+const (
+	patternFlushInterval = 10 * time.Second
+	defaultPatternLimit  = 100
+	maxPatternLimit      = 1000
+	// applications without messages for this long are dropped from memory
+	// and loaded again with their next message
+	patternAppIdle = time.Hour
+)
+
+// minedApp is the Drain of an application and its patterns.
+type minedApp struct {
+	lock sync.Mutex
+	// nil until the patterns of the application are loaded
+	drain    *service.Drain
+	patterns map[int64]*service.Pattern
+	dirty    map[int64]bool
+	// patterns of clusters whose row could not be created yet
+	pending map[*service.DrainCluster]*service.Pattern
+	// set with the lock of the miner
+	used time.Time
+}
+
+// patternMiner assigns messages to the patterns of their application as
+// they are stored. Each application has its own Drain, loaded from the
+// patterns table the first time the application sends a message, and its
+// own lock. New patterns are written right away so messages can refer to
+// them, counts and templates that change are written by flush.
+type patternMiner struct {
+	lock sync.Mutex
+	db   *gorm.DB
+	apps map[string]*minedApp
+}
+
+func newPatternMiner(db *gorm.DB) *patternMiner {
+	return &patternMiner{
+		db:   db,
+		apps: make(map[string]*minedApp),
+	}
+}
+
+// app returns the patterns of an application, not loaded yet when it is
+// new.
+func (m *patternMiner) app(appID string) *minedApp {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	app, ok := m.apps[appID]
+	if !ok {
+		app = &minedApp{
+			patterns: make(map[int64]*service.Pattern),
+			dirty:    make(map[int64]bool),
+			pending:  make(map[*service.DrainCluster]*service.Pattern),
+		}
+		m.apps[appID] = app
+	}
+	app.used = time.Now()
+	return app
+}
+
+// load reads the patterns of an application into its Drain. It has to be
+// called with the lock of the application held.
+func (m *patternMiner) load(appID string, app *minedApp) error {
+	var patterns []*service.Pattern
+	if err := m.db.Where("application_id = ?", appID).Order("id").Find(&patterns).Error; err != nil {
+		return err
+	}
+	app.drain = service.NewDrain()
+	for _, pattern := range patterns {
+		app.drain.Load(pattern.ID, pattern.Template)
+		app.patterns[pattern.ID] = pattern
+	}
+	return nil
+}
+
+// countPattern adds a message to a pattern.
+func countPattern(pattern *service.Pattern, cluster *service.DrainCluster, changed bool, msg *service.Message) {
+	pattern.Count++
+	if pattern.FirstSeen.IsZero() || msg.Timestamp.Before(pattern.FirstSeen) {
+		pattern.FirstSeen = msg.Timestamp
+	}
+	if msg.Timestamp.After(pattern.LastSeen) {
+		pattern.LastSeen = msg.Timestamp
+	}
+	if changed {
+		pattern.Template = cluster.Template()
+	}
+	pattern.AddSample(msg.Msg)
+}
+
+// create writes the row of a new pattern and gives its cluster the id. It
+// has to be called with the lock of the application held. Patterns that
+// fail are kept pending, and created with the next message of the cluster
+// or by flush.
+func (m *patternMiner) create(app *minedApp, cluster *service.DrainCluster, pattern *service.Pattern) error {
+	if err := m.db.Create(pattern).Error; err != nil {
+		app.pending[cluster] = pattern
+		return err
+	}
+	delete(app.pending, cluster)
+	cluster.ID = pattern.ID
+	app.patterns[pattern.ID] = pattern
+	return nil
+}
+
+// assign sets the pattern of a message of the application. It reports
+// whether the message started a new pattern. Only messages of the same
+// application wait for each other.
+func (m *patternMiner) assign(appID string, msg *service.Message) (created bool) {
+	app := m.app(appID)
+	app.lock.Lock()
+	defer app.lock.Unlock()
+
+	if app.drain == nil {
+		if err := m.load(appID, app); err != nil {
+			log.Printf("failed to load patterns of %s: %v", appID, err)
+			return false
+		}
+	}
+	cluster, changed := app.drain.Add(msg.Msg)
+	if cluster.ID == 0 {
+		pattern, ok := app.pending[cluster]
+		if !ok {
+			pattern = &service.Pattern{AppID: appID, Template: cluster.Template()}
+		}
+		countPattern(pattern, cluster, changed, msg)
+		if err := m.create(app, cluster, pattern); err != nil {
+			log.Printf("failed to create pattern for %s: %v", appID, err)
+			return false
+		}
+		msg.PatternID = pattern.ID
+		return true
+	}
+
+	pattern := app.patterns[cluster.ID]
+	countPattern(pattern, cluster, changed, msg)
+	app.dirty[pattern.ID] = true
+	msg.PatternID = pattern.ID
+	return false
+}
+
+// flush writes the patterns that changed since the last flush and the
+// pending ones, then drops idle applications.
+func (m *patternMiner) flush() error {
+	m.lock.Lock()
+	apps := make(map[string]*minedApp, len(m.apps))
+	for appID, app := range m.apps {
+		apps[appID] = app
+	}
+	m.lock.Unlock()
+
+	for appID, app := range apps {
+		if err := m.flushApp(app); err != nil {
+			return fmt.Errorf("application %s: %w", appID, err)
+		}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	cutoff := time.Now().Add(-patternAppIdle)
+	for appID, app := range m.apps {
+		// an application that is locked is in use, and waiting for it
+		// would hold up every other one
+		if !app.used.Before(cutoff) || !app.lock.TryLock() {
+			continue
+		}
+		if len(app.dirty) == 0 && len(app.pending) == 0 {
+			delete(m.apps, appID)
+		}
+		app.lock.Unlock()
+	}
+	return nil
+}
+
+func (m *patternMiner) flushApp(app *minedApp) error {
+	app.lock.Lock()
+	defer app.lock.Unlock()
+
+	for cluster, pattern := range app.pending {
+		if err := m.create(app, cluster, pattern); err != nil {
+			return err
+		}
+	}
+	for id := range app.dirty {
+		pattern := app.patterns[id]
+		err := m.db.Model(pattern).Updates(map[string]interface{}{
+			"template":   pattern.Template,
+			"count":      pattern.Count,
+			"first_seen": pattern.FirstSeen,
+			"last_seen":  pattern.LastSeen,
+			"samples":    pattern.Samples,
+		}).Error
+		if err != nil {
+			return err
+		}
+		delete(app.dirty, id)
+	}
+	return nil
+}
+
+func (m *patternMiner) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := m.flush(); err != nil {
+			log.Printf("failed to write patterns: %v", err)
+		}
+	}
+}
+
+func patternToPb(pattern *service.Pattern) *pb.Pattern {
+	return &pb.Pattern{
+		Id:        pattern.ID,
+		Template:  pattern.Template,
+		Count:     pattern.Count,
+		FirstSeen: timestamppb.New(pattern.FirstSeen),
+		LastSeen:  timestamppb.New(pattern.LastSeen),
+		Samples:   pattern.SampleLines(),
+	}
+}
+
+// ListPatterns lists the patterns of an application or session, the most
+// frequent or the newest first.
+func (l *loggyServer) ListPatterns(ctx context.Context, request *pb.PatternQuery) (*pb.PatternList, error) {
+	limit := int(request.Limit)
+	if limit <= 0 {
+		limit = defaultPatternLimit
+	}
+	if limit > maxPatternLimit {
+		limit = maxPatternLimit
+	}
+	var since time.Time
+	if request.Since != nil {
+		since = request.Since.AsTime()
+	}
+
+	var patterns []*service.Pattern
+	switch {
+	case request.Sessionid != 0:
+		if _, err := l.ownedSession(ctx, request.Sessionid); err != nil {
+			return nil, err
+		}
+		all, err := l.patternStore.SessionPatterns(request.Sessionid)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to list patterns: %v", err)
+		}
+		for _, pattern := range all {
+			if !pattern.FirstSeen.Before(since) {
+				patterns = append(patterns, pattern)
+			}
+		}
+		sortPatterns(patterns, request.Order)
+		if len(patterns) > limit {
+			patterns = patterns[:limit]
+		}
+	case len(request.Appid) != 0:
+		if _, err := l.ownedApp(ctx, request.Appid); err != nil {
+			return nil, err
+		}
+		if err := l.patterns.flush(); err != nil {
+			log.Printf("failed to write patterns: %v", err)
+		}
+		var err error
+		patterns, err = l.patternStore.ListPatterns(request.Appid, since, request.Order == pb.PatternQuery_NEWEST, limit)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to list patterns: %v", err)
+		}
+	default:
+		return nil, status.Error(codes.InvalidArgument, "patterns need an application or session")
+	}
+
+	list := &pb.PatternList{}
+	for _, pattern := range patterns {
+		list.Patterns = append(list.Patterns, patternToPb(pattern))
+	}
+	return list, nil
+}
+
+// sortPatterns orders patterns the way ListPatterns orders the patterns of
+// an application in SQL.
+func sortPatterns(patterns []*service.Pattern, order pb.PatternQuery_Order) {
+	sort.Slice(patterns, func(i, j int) bool {
+		a, b := patterns[i], patterns[j]
+		if order == pb.PatternQuery_NEWEST && !a.FirstSeen.Equal(b.FirstSeen) {
+			return a.FirstSeen.After(b.FirstSeen)
+		}
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.ID < b.ID
+	})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/loggysh/loggy/loggy"
+	"github.com/loggysh/loggy/query"
+)
+
+const (
+	defaultQueryLimit = 100
+	maxQueryLimit     = 1000
+	// messages a query looks at before it gives up
+	maxQueryScan   = 100000
+	queryBatchSize = 1000
+)
+
+// scanDatabase pushes the messages of a plan into the pipeline, newest
+// first.
+func (l *loggyServer) scanDatabase(ctx context.Context, plan *query.Plan, pipeline *query.Pipeline) (scanned int64, truncated bool, err error) {
+	lastID := -1
+	for {
+		if err := ctx.Err(); err != nil {
+			return scanned, false, err
+		}
+		records, err := l.records.Scan(plan, lastID, queryBatchSize)
+		if err != nil {
+			return scanned, false, err
+		}
+		for _, record := range records {
+			scanned++
+			if !pipeline.Push(record) {
+				return scanned, false, nil
+			}
+			if scanned >= maxQueryScan {
+				return scanned, true, nil
+			}
+		}
+		if len(records) < queryBatchSize {
+			return scanned, false, nil
+		}
+		lastID = records[len(records)-1].ID
+	}
+}
+
+// scanIndex pushes the messages the index finds for a plan into the
+// pipeline, newest first.
+func (l *loggyServer) scanIndex(ctx context.Context, plan *query.Plan, pipeline *query.Pipeline) (scanned int64, truncated bool, err error) {
+	var after []string
+	for {
+		if err := ctx.Err(); err != nil {
+			return scanned, false, err
+		}
+		search := bleve.NewSearchRequestOptions(plan.IndexQuery(), queryBatchSize, 0, false)
+		search.SortBy([]string{"-timestamp", "-_id"})
+		if after != nil {
+			search.SetSearchAfter(after)
+		}
+		result, err := l.indexer.Search(search)
+		if err != nil {
+			return scanned, false, status.Errorf(codes.InvalidArgument, "failed to search: %v", err)
+		}
+		if len(result.Hits) == 0 {
+			return scanned, false, nil
+		}
+
+		ids := make([]int, len(result.Hits))
+		for i, hit := range result.Hits {
+			ids[i], _ = strconv.Atoi(hit.ID)
+		}
+		records, err := l.records.Records(ids)
+		if err != nil {
+			return scanned, false, err
+		}
+		byID := make(map[int]*query.Record, len(records))
+		for _, record := range records {
+			byID[record.ID] = record
+		}
+		for _, id := range ids {
+			record, ok := byID[id]
+			if !ok {
+				continue
+			}
+			scanned++
+			if !pipeline.Push(record) {
+				return scanned, false, nil
+			}
+			if scanned >= maxQueryScan {
+				return scanned, true, nil
+			}
+		}
+		after = result.Hits[len(result.Hits)-1].Sort
+	}
+}
+
+// Query runs a query of the pipeline query language over the messages
+// of the caller.
+func (l *loggyServer) Query(ctx context.Context, request *pb.PipelineQuery) (*pb.PipelineResult, error) {
+	userID, err := getUserIdFromMetaData(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to run query. user not found")
+	}
+	q, err := query.Parse(request.Query)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid query: %v", err)
+	}
+	limit := int(request.Limit)
+	if limit <= 0 {
+		limit = defaultQueryLimit
+	}
+	if limit > maxQueryLimit {
+		limit = maxQueryLimit
+	}
+	// zero times leave that end of the range open
+	var start, end time.Time
+	if request.Start != nil {
+		start = request.Start.AsTime()
+	}
+	if request.End != nil {
+		end = request.End.AsTime()
+	}
+
+	began := time.Now()
+	plan := q.Plan(userID, start, end)
+	pipeline := plan.Pipeline(limit)
+	var scanned int64
+	var truncated bool
+	if plan.UseIndex {
+		scanned, truncated, err = l.scanIndex(ctx, plan, pipeline)
+	} else {
+		scanned, truncated, err = l.scanDatabase(ctx, plan, pipeline)
+	}
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
+		return nil, status.Errorf(codes.Internal, "failed to run query: %v", err)
+	}
+
+	result := &pb.PipelineResult{
+		Plan:      plan.String(),
+		Scanned:   scanned,
+		Truncated: truncated,
+		Took:      durationpb.New(time.Since(began)),
+	}
+	for _, record := range pipeline.Records() {
+		result.Records = append(result.Records, &pb.PipelineRecord{
+			Message: messageToPb(&record.Message),
+			Fields:  record.Fields,
+		})
+	}
+	for _, row := range pipeline.Rows() {
+		r := &pb.PipelineRow{Labels: row.Labels, Count: row.Count}
+		if !row.Bucket.IsZero() {
+			r.Bucket = timestamppb.New(row.Bucket)
+		}
+		result.Rows = append(result.Rows, r)
+	}
+	return result, nil
+}
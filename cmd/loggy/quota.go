@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type appUsage struct {
+	day      time.Time
+	count    int64
+	notified bool
+}
+
+// messageQuota counts messages per application and day, so owners are told
+// when an application goes over its quota. Messages over it are still
+// stored.
+type messageQuota struct {
+	lock  sync.Mutex
+	limit int64
+	usage map[string]*appUsage
+}
+
+func newMessageQuota(limit int64) *messageQuota {
+	return &messageQuota{
+		limit: limit,
+		usage: make(map[string]*appUsage),
+	}
+}
+
+// add counts a message for the application. It reports whether this
+// message is the first one over the daily quota, so the owner is notified
+// once per day.
+func (q *messageQuota) add(appID string) (usage appUsage, exceeded bool) {
+	if q.limit <= 0 {
+		return appUsage{}, false
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	day := time.Now().UTC().Truncate(24 * time.Hour)
+	u, ok := q.usage[appID]
+	if !ok || !u.day.Equal(day) {
+		u = &appUsage{day: day}
+		q.usage[appID] = u
+	}
+	u.count++
+	if u.count <= q.limit {
+		return *u, false
+	}
+	exceeded = !u.notified
+	u.notified = true
+	return *u, exceeded
+}
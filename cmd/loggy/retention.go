@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+
+	pb "github.com/loggysh/loggy/loggy"
+	"github.com/loggysh/loggy/service"
+)
+
+const (
+	// messages deleted at a time, each batch is its own transaction
+	retentionBatchSize = 1000
+	maxRetentionDays   = 3650
+	// size of a message row and its index entries besides its text, for
+	// the estimate of the bytes deleted
+	messageRowBytes = 128
+	// reports listed by ListRetentionReports
+	maxRetentionReports = 100
+)
+
+// expiredMessage is what is needed to delete a message and account for it.
+type expiredMessage struct {
+	ID        int
+	SessionID int32
+	Msg       string
+	TraceID   string
+	SpanID    string
+}
+
+// retentionJob deletes messages older than the retention policy of their
+// application, and the sessions left without messages. Segments of archived
+// sessions are immutable, they are deleted once all of their messages are
+// past the policy.
+type retentionJob struct {
+	// one run at a time, so reports do not count the same messages
+	lock     sync.Mutex
+	db       *gorm.DB
+	indexer  bleve.Index
+	segments *service.Segments
+}
+
+func newRetentionJob(db *gorm.DB, indexer bleve.Index, segments *service.Segments) *retentionJob {
+	return &retentionJob{db: db, indexer: indexer, segments: segments}
+}
+
+// deleteBatch deletes a batch of messages, takes them off the message counts
+// of their sessions and removes them from the search index.
+func (j *retentionJob) deleteBatch(batch []expiredMessage) error {
+	ids := make([]int, len(batch))
+	counts := make(map[int32]int)
+	for i, msg := range batch {
+		ids[i] = msg.ID
+		counts[msg.SessionID]++
+	}
+	err := j.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("id IN ?", ids).Delete(&service.Message{}).Error; err != nil {
+			return err
+		}
+		for sessionID, n := range counts {
+			err := tx.Model(&service.Session{}).Where("id = ?", sessionID).
+				Update("message_count", gorm.Expr("CASE WHEN message_count > ? THEN message_count - ? ELSE 0 END", n, n)).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// the rows are gone either way, documents left in the index only
+	// match searches until the next rebuild
+	index := j.indexer.NewBatch()
+	for _, id := range ids {
+		index.Delete(strconv.Itoa(id))
+	}
+	if err := j.indexer.Batch(index); err != nil {
+		log.Printf("failed to remove %d expired messages from the index: %v", len(ids), err)
+	}
+	return nil
+}
+
+// apply deletes the messages of an application that are older than its
+// policy allows, and the ended sessions that have no messages left.
+func (j *retentionJob) apply(ctx context.Context, policy *service.RetentionPolicy) (*service.RetentionReport, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	now := time.Now()
+	report := &service.RetentionReport{AppID: policy.AppID, StartedAt: now}
+	sessions := j.db.Model(&service.Session{}).Select("id").Where("application_id = ?", policy.AppID)
+	shortest, longest := 0, 0
+	for level := service.DEBUG; level <= service.CRASH; level++ {
+		days := policy.Days(level)
+		if days == 0 {
+			// messages of this level are kept forever, and with them
+			// the segments
+			longest = -1
+			continue
+		}
+		if shortest == 0 || days < shortest {
+			shortest = days
+		}
+		if longest != -1 && days > longest {
+			longest = days
+		}
+		cutoff := now.AddDate(0, 0, -days)
+		for {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			var batch []expiredMessage
+			err := j.db.Model(&service.Message{}).
+				Select("id, session_id, msg, trace_id, span_id").
+				Where("session_id IN (?) AND level = ? AND timestamp < ?", sessions, level, cutoff).
+				Order("id").Limit(retentionBatchSize).Scan(&batch).Error
+			if err != nil {
+				return nil, err
+			}
+			if len(batch) == 0 {
+				break
+			}
+			if err := j.deleteBatch(batch); err != nil {
+				return nil, err
+			}
+			report.Messages += int64(len(batch))
+			for _, msg := range batch {
+				report.EstimatedBytes += int64(len(msg.Msg) + len(msg.TraceID) + len(msg.SpanID) + messageRowBytes)
+			}
+			if len(batch) < retentionBatchSize {
+				break
+			}
+		}
+	}
+
+	if longest > 0 {
+		if err := j.expireSegments(policy.AppID, now.AddDate(0, 0, -longest), report); err != nil {
+			return nil, err
+		}
+	}
+
+	// sessions ended before the shortest cutoff could only have kept
+	// messages of levels with a longer one
+	if shortest != 0 {
+		result := j.db.
+			Where("application_id = ? AND status <> ? AND ended_at < ? AND segment_id = 0", policy.AppID, service.SessionLive, now.AddDate(0, 0, -shortest)).
+			Where("NOT EXISTS (SELECT 1 FROM messages WHERE messages.session_id = sessions.id)").
+			Delete(&service.Session{})
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		report.Sessions += result.RowsAffected
+	}
+	report.FinishedAt = time.Now()
+	return report, nil
+}
+
+// expireSegments deletes the segments of an application without messages
+// since cutoff, with their sessions.
+func (j *retentionJob) expireSegments(appID string, cutoff time.Time, report *service.RetentionReport) error {
+	var segments []*service.Segment
+	if err := j.db.Where("application_id = ? AND last_message_at < ?", appID, cutoff).Find(&segments).Error; err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		var sessions int64
+		err := j.db.Transaction(func(tx *gorm.DB) error {
+			result := tx.Where("segment_id = ?", segment.ID).Delete(&service.Session{})
+			if result.Error != nil {
+				return result.Error
+			}
+			sessions = result.RowsAffected
+			return tx.Delete(segment).Error
+		})
+		if err != nil {
+			return err
+		}
+		if err := j.segments.Remove(segment); err != nil {
+			log.Printf("failed to remove segment %s: %v", segment.Path, err)
+		}
+		report.Messages += segment.Messages
+		report.Sessions += sessions
+		report.EstimatedBytes += segment.Bytes
+	}
+	return nil
+}
+
+// applyAll applies the retention policy of every application that has one,
+// keeping a report of the runs that deleted anything.
+func (j *retentionJob) applyAll(ctx context.Context) error {
+	var policies []*service.RetentionPolicy
+	if err := j.db.Find(&policies).Error; err != nil {
+		return err
+	}
+	for _, policy := range policies {
+		report, err := j.apply(ctx, policy)
+		if err != nil {
+			return fmt.Errorf("application %s: %w", policy.AppID, err)
+		}
+		if report.Messages == 0 && report.Sessions == 0 {
+			continue
+		}
+		if err := j.db.Create(report).Error; err != nil {
+			return err
+		}
+		log.Printf("Deleted %d expired messages and %d sessions of %s", report.Messages, report.Sessions, policy.AppID)
+	}
+	return nil
+}
+
+func (j *retentionJob) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := j.applyAll(context.Background()); err != nil {
+			log.Printf("failed to apply retention policies: %v", err)
+		}
+	}
+}
+
+func retentionPolicyToPb(policy *service.RetentionPolicy) *pb.RetentionPolicy {
+	return &pb.RetentionPolicy{
+		Appid:     policy.AppID,
+		DebugDays: int32(policy.DebugDays),
+		InfoDays:  int32(policy.InfoDays),
+		WarnDays:  int32(policy.WarnDays),
+		ErrorDays: int32(policy.ErrorDays),
+		CrashDays: int32(policy.CrashDays),
+	}
+}
+
+func retentionReportToPb(report *service.RetentionReport) *pb.RetentionReport {
+	return &pb.RetentionReport{
+		Id:                    report.ID,
+		Appid:                 report.AppID,
+		StartedAt:             timestamppb.New(report.StartedAt),
+		FinishedAt:            timestamppb.New(report.FinishedAt),
+		MessagesDeleted:       report.Messages,
+		SessionsDeleted:       report.Sessions,
+		EstimatedBytesDeleted: report.EstimatedBytes,
+	}
+}
+
+func (l *loggyServer) GetRetentionPolicy(ctx context.Context, appid *pb.ApplicationId) (*pb.RetentionPolicy, error) {
+	if _, err := l.ownedApp(ctx, appid.Id); err != nil {
+		return nil, err
+	}
+	policy, err := l.retentionStore.RetentionPolicy(appid.Id)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to load retention policy: %v", err)
+	}
+	return retentionPolicyToPb(policy), nil
+}
+
+func (l *loggyServer) SetRetentionPolicy(ctx context.Context, request *pb.RetentionPolicy) (*pb.RetentionPolicy, error) {
+	if _, err := l.ownedApp(ctx, request.Appid); err != nil {
+		return nil, err
+	}
+	for _, days := range []int32{request.DebugDays, request.InfoDays, request.WarnDays, request.ErrorDays, request.CrashDays} {
+		if days < 0 || days > maxRetentionDays {
+			return nil, status.Errorf(codes.InvalidArgument, "retention must be between 0 and %d days", maxRetentionDays)
+		}
+	}
+	policy := &service.RetentionPolicy{
+		AppID:     request.Appid,
+		DebugDays: int(request.DebugDays),
+		InfoDays:  int(request.InfoDays),
+		WarnDays:  int(request.WarnDays),
+		ErrorDays: int(request.ErrorDays),
+		CrashDays: int(request.CrashDays),
+	}
+	if err := l.retentionStore.SaveRetentionPolicy(policy); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to save retention policy: %v", err)
+	}
+	return retentionPolicyToPb(policy), nil
+}
+
+// RunRetention applies the retention policy of an application right away
+// and reports what it deleted. The bytes are an estimate of the data
+// deleted rather than the space freed on disk, which the database keeps
+// for later rows and shares between applications.
+func (l *loggyServer) RunRetention(ctx context.Context, appid *pb.ApplicationId) (*pb.RetentionReport, error) {
+	if _, err := l.ownedApp(ctx, appid.Id); err != nil {
+		return nil, err
+	}
+	policy, err := l.retentionStore.RetentionPolicy(appid.Id)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to load retention policy: %v", err)
+	}
+	report, err := l.retention.apply(ctx, policy)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to apply retention policy: %v", err)
+	}
+	if err := l.retentionStore.CreateRetentionReport(report); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to save retention report: %v", err)
+	}
+	return retentionReportToPb(report), nil
+}
+
+// ListRetentionReports lists the latest retention runs of an application,
+// newest first.
+func (l *loggyServer) ListRetentionReports(ctx context.Context, appid *pb.ApplicationId) (*pb.RetentionReportList, error) {
+	if _, err := l.ownedApp(ctx, appid.Id); err != nil {
+		return nil, err
+	}
+	reports, err := l.retentionStore.ListRetentionReports(appid.Id, maxRetentionReports)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list retention reports: %v", err)
+	}
+	list := &pb.RetentionReportList{}
+	for _, report := range reports {
+		list.Reports = append(list.Reports, retentionReportToPb(report))
+	}
+	return list, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+
+	"github.com/loggysh/loggy/service"
+)
+
+type rollupKey struct {
+	appID    string
+	deviceID string
+	period   service.RollupPeriod
+	start    time.Time
+}
+
+// rollupWriter counts messages and sessions into rollups as they arrive
+// and adds the counts to the rollup tables every interval, so ingest does
+// not write a row per message. Counts not yet flushed are lost when the
+// server stops.
+type rollupWriter struct {
+	lock    sync.Mutex
+	db      *gorm.DB
+	pending map[rollupKey]*service.Rollup
+	devices map[service.RollupDevice]bool
+}
+
+func newRollupWriter(db *gorm.DB) *rollupWriter {
+	return &rollupWriter{
+		db:      db,
+		pending: make(map[rollupKey]*service.Rollup),
+		devices: make(map[service.RollupDevice]bool),
+	}
+}
+
+// rollups calls fn with the application and device rollups of every period
+// t falls in. It has to be called with the lock held.
+func (w *rollupWriter) rollups(appID, deviceID string, t time.Time, fn func(r *service.Rollup)) {
+	for _, period := range service.RollupPeriods {
+		start := period.Start(t)
+		for _, id := range []string{"", deviceID} {
+			key := rollupKey{appID, id, period, start}
+			r, ok := w.pending[key]
+			if !ok {
+				r = &service.Rollup{AppID: appID, DeviceID: id, Period: period, Start: start}
+				w.pending[key] = r
+			}
+			fn(r)
+		}
+		w.devices[service.RollupDevice{AppID: appID, DeviceID: deviceID, Period: period, Start: start}] = true
+	}
+}
+
+func (w *rollupWriter) message(session *service.Session, msg *service.Message) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.rollups(session.AppID, session.DeviceID.String(), msg.Timestamp, func(r *service.Rollup) {
+		r.Add(msg.Level, 1)
+	})
+}
+
+// sessionStart is when a session started, sessions from before StartedAt
+// existed have their creation time.
+func sessionStart(session *service.Session) time.Time {
+	if session.StartedAt.IsZero() {
+		return session.CreatedAt
+	}
+	return session.StartedAt
+}
+
+func (w *rollupWriter) sessionStarted(session *service.Session) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.rollups(session.AppID, session.DeviceID.String(), sessionStart(session), func(r *service.Rollup) {
+		r.Sessions++
+	})
+}
+
+func (w *rollupWriter) sessionCrashed(session *service.Session) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.rollups(session.AppID, session.DeviceID.String(), sessionStart(session), func(r *service.Rollup) {
+		r.CrashedSessions++
+	})
+}
+
+// flush adds the pending counts to the rollup tables. Counts that fail to
+// be written stay pending for the next flush.
+func (w *rollupWriter) flush() error {
+	w.lock.Lock()
+	pending, devices := w.pending, w.devices
+	w.pending = make(map[rollupKey]*service.Rollup)
+	w.devices = make(map[service.RollupDevice]bool)
+	w.lock.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	err := w.db.Transaction(func(tx *gorm.DB) error {
+		for device := range devices {
+			device := device
+			result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&device)
+			if result.Error != nil {
+				return result.Error
+			}
+			// the first time the device is seen in the period
+			if result.RowsAffected == 1 {
+				pending[rollupKey{device.AppID, "", device.Period, device.Start}].ActiveDevices++
+			}
+		}
+		for _, r := range pending {
+			err := tx.Clauses(clause.OnConflict{
+				Columns: []clause.Column{{Name: "application_id"}, {Name: "device_id"}, {Name: "period"}, {Name: "start"}},
+				DoUpdates: clause.Assignments(map[string]interface{}{
+					"debug_count":      gorm.Expr("rollups.debug_count + excluded.debug_count"),
+					"info_count":       gorm.Expr("rollups.info_count + excluded.info_count"),
+					"warn_count":       gorm.Expr("rollups.warn_count + excluded.warn_count"),
+					"error_count":      gorm.Expr("rollups.error_count + excluded.error_count"),
+					"crash_count":      gorm.Expr("rollups.crash_count + excluded.crash_count"),
+					"sessions":         gorm.Expr("rollups.sessions + excluded.sessions"),
+					"crashed_sessions": gorm.Expr("rollups.crashed_sessions + excluded.crashed_sessions"),
+					"active_devices":   gorm.Expr("rollups.active_devices + excluded.active_devices"),
+				}),
+			}).Create(r).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		w.restore(pending, devices)
+	}
+	return err
+}
+
+// restore puts counts that failed to flush back, adding them to the ones
+// that arrived since.
+func (w *rollupWriter) restore(pending map[rollupKey]*service.Rollup, devices map[service.RollupDevice]bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for key, r := range pending {
+		if current, ok := w.pending[key]; ok {
+			current.DebugCount += r.DebugCount
+			current.InfoCount += r.InfoCount
+			current.WarnCount += r.WarnCount
+			current.ErrorCount += r.ErrorCount
+			current.CrashCount += r.CrashCount
+			current.Sessions += r.Sessions
+			current.CrashedSessions += r.CrashedSessions
+			continue
+		}
+		// active devices are counted again from the devices below
+		r.ActiveDevices = 0
+		w.pending[key] = r
+	}
+	for device := range devices {
+		w.devices[device] = true
+	}
+}
+
+func (w *rollupWriter) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := w.flush(); err != nil {
+			log.Printf("failed to write rollups: %v", err)
+		}
+	}
+}
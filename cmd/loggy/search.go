@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search"
+	"github.com/blevesearch/bleve/v2/search/query"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+
+	pb "github.com/loggysh/loggy/loggy"
+	"github.com/loggysh/loggy/service"
+)
+
+func termQuery(field, term string) query.Query {
+	q := bleve.NewTermQuery(term)
+	q.SetField(field)
+	return q
+}
+
+// scopedQuery restricts a search to the messages of userID and the filters
+// of the request. The restrictions are part of the index query, so nothing
+// outside of them is ever scored or returned.
+func scopedQuery(userID string, request *pb.Query) query.Query {
+	conjuncts := []query.Query{termQuery("user_id", userID)}
+	if len(request.Appid) != 0 {
+		conjuncts = append(conjuncts, termQuery("app_id", request.Appid))
+	}
+	if len(request.Deviceid) != 0 {
+		conjuncts = append(conjuncts, termQuery("device_id", request.Deviceid))
+	}
+	if request.Sessionid != 0 {
+		conjuncts = append(conjuncts, termQuery("session_id", strconv.Itoa(int(request.Sessionid))))
+	}
+	if request.Levels != nil {
+		min, max := float64(request.Levels.Min), float64(request.Levels.Max)
+		inclusive := true
+		levels := bleve.NewNumericRangeInclusiveQuery(&min, &max, &inclusive, &inclusive)
+		levels.SetField("severity")
+		conjuncts = append(conjuncts, levels)
+	}
+	if request.Start != nil || request.End != nil {
+		// zero times leave that end of the range open
+		var start, end time.Time
+		if request.Start != nil {
+			start = request.Start.AsTime()
+		}
+		if request.End != nil {
+			end = request.End.AsTime()
+		}
+		timestamps := bleve.NewDateRangeQuery(start, end)
+		timestamps.SetField("timestamp")
+		conjuncts = append(conjuncts, timestamps)
+	}
+	if len(request.Query) != 0 {
+		conjuncts = append(conjuncts, bleve.NewQueryStringQuery(request.Query))
+	}
+	return bleve.NewConjunctionQuery(conjuncts...)
+}
+
+const (
+	// messages around a hit are capped, they are loaded per hit
+	maxHitContext = 10
+	termFacetSize = 10
+	// days in the day facet when the search has no time range
+	defaultFacetDays = 7
+	maxFacetDays     = 31
+)
+
+// Facets of search responses, in the order they are returned.
+var facetNames = []string{"level", "app_id", "device_id", "day"}
+
+// addFacets counts the hits per level, application and device.
+func addFacets(search *bleve.SearchRequest) {
+	search.AddFacet("level", bleve.NewFacetRequest("level", int(pb.Message_CRASH)+1))
+	search.AddFacet("app_id", bleve.NewFacetRequest("app_id", termFacetSize))
+	search.AddFacet("device_id", bleve.NewFacetRequest("device_id", termFacetSize))
+}
+
+// addDayFacet counts the hits per day. Days cover the time range of the
+// request, or the last week.
+func addDayFacet(search *bleve.SearchRequest, request *pb.Query) {
+	end := time.Now().UTC()
+	if request.End != nil {
+		end = request.End.AsTime().UTC()
+	}
+	start := end.Add(-(defaultFacetDays - 1) * 24 * time.Hour)
+	if request.Start != nil {
+		start = request.Start.AsTime().UTC()
+	}
+	day := start.Truncate(24 * time.Hour)
+	if min := end.Truncate(24 * time.Hour).Add(-(maxFacetDays - 1) * 24 * time.Hour); day.Before(min) {
+		day = min
+	}
+	if day.After(end) {
+		return
+	}
+	days := bleve.NewFacetRequest("timestamp", maxFacetDays)
+	for ; !day.After(end); day = day.Add(24 * time.Hour) {
+		days.AddDateTimeRange(day.Format("2006-01-02"), day, day.Add(24*time.Hour))
+	}
+	search.AddFacet("day", days)
+}
+
+func facetsToPb(results search.FacetResults) []*pb.Facet {
+	var facets []*pb.Facet
+	for _, name := range facetNames {
+		result, ok := results[name]
+		if !ok {
+			continue
+		}
+		facet := &pb.Facet{
+			Name:    name,
+			Total:   int64(result.Total),
+			Missing: int64(result.Missing),
+			Other:   int64(result.Other),
+		}
+		if result.Terms != nil {
+			for _, term := range result.Terms.Terms() {
+				facet.Terms = append(facet.Terms, &pb.FacetTerm{Term: term.Term, Count: int64(term.Count)})
+			}
+		}
+		// days are listed in order, not by count
+		sort.Slice(result.DateRanges, func(i, j int) bool {
+			return result.DateRanges[i].Name < result.DateRanges[j].Name
+		})
+		for _, day := range result.DateRanges {
+			facet.Terms = append(facet.Terms, &pb.FacetTerm{Term: day.Name, Count: int64(day.Count)})
+		}
+		facets = append(facets, facet)
+	}
+	return facets
+}
+
+func (l *loggyServer) Search(ctx context.Context, request *pb.Query) (*pb.SearchResponse, error) {
+	userID, err := getUserIdFromMetaData(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to search. user not found")
+	}
+	if len(request.Appid) != 0 {
+		if _, err := l.ownedApp(ctx, request.Appid); err != nil {
+			return nil, err
+		}
+	}
+
+	page, err := parsePage(request.Page, pb.PageRequest_RELEVANCE, pb.PageRequest_NEWEST, pb.PageRequest_OLDEST)
+	if err != nil {
+		return nil, err
+	}
+	contextSize := int(request.Context)
+	if contextSize > maxHitContext {
+		contextSize = maxHitContext
+	}
+	if request.Archived {
+		return l.searchArchived(ctx, userID, request, page, contextSize)
+	}
+
+	q := scopedQuery(userID, request)
+	search := bleve.NewSearchRequestOptions(q, page.size, page.offset(), false)
+	days := search
+	switch page.sort {
+	case pb.PageRequest_NEWEST:
+		search.SortBy([]string{"-timestamp", "_id"})
+	case pb.PageRequest_OLDEST:
+		search.SortBy([]string{"timestamp", "_id"})
+	}
+	if page.sort != pb.PageRequest_RELEVANCE {
+		// bleve's top N collector appends the facet fields to the sort
+		// fields without removing duplicates, and scorch visits the doc
+		// values of every listed field. Sorted on the timestamp, each hit
+		// would be counted twice in the day facet, so that facet gets a
+		// search of its own.
+		days = bleve.NewSearchRequestOptions(q, 0, 0, false)
+	}
+	search.Highlight = bleve.NewHighlight()
+	search.Highlight.AddField("msg")
+	addFacets(search)
+	addDayFacet(days, request)
+
+	result, err := l.indexer.Search(search)
+	if err != nil {
+		log.Println(err)
+		return nil, status.Errorf(codes.InvalidArgument, "failed to search: %v", err)
+	}
+	if days != search {
+		dayResult, err := l.indexer.Search(days)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to count facets: %v", err)
+		}
+		if facet, ok := dayResult.Facets["day"]; ok {
+			result.Facets["day"] = facet
+		}
+		result.Took += dayResult.Took
+	}
+	response := &pb.SearchResponse{
+		NextPageToken: page.nextOffset(len(result.Hits)),
+		TotalCount:    int64(result.Total),
+		Facets:        facetsToPb(result.Facets),
+		Took:          durationpb.New(result.Took),
+	}
+	for _, hit := range result.Hits {
+		id, _ := strconv.Atoi(hit.ID)
+		msg, err := l.store.Message(id)
+		if errors.Is(err, service.ErrNotFound) {
+			log.Printf("message %s is in the index but not in the database", hit.ID)
+			continue
+		}
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to load message %s: %v", hit.ID, err)
+		}
+		h, err := l.searchHit(msg, hit, contextSize)
+		if err != nil {
+			return nil, err
+		}
+		response.Messages = append(response.Messages, h.Message)
+		response.Hits = append(response.Hits, h)
+	}
+	return response, nil
+}
+
+// searchHit returns a hit with its highlights and the messages around it.
+func (l *loggyServer) searchHit(msg *service.Message, hit *search.DocumentMatch, contextSize int) (*pb.SearchHit, error) {
+	h := &pb.SearchHit{
+		Message: messageToPb(msg),
+		Score:   hit.Score,
+	}
+	for field, fragments := range hit.Fragments {
+		h.Highlights = append(h.Highlights, &pb.Highlight{Field: field, Fragments: fragments})
+	}
+	if contextSize > 0 {
+		around, err := l.messagesAround(msg, contextSize, contextSize, 0)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to load messages around %d: %v", msg.ID, err)
+		}
+		h.Before, h.After = around.Before, around.After
+	}
+	return h, nil
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/search/query"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	empty "google.golang.org/protobuf/types/known/emptypb"
+
+	pb "github.com/loggysh/loggy/loggy"
+	"github.com/loggysh/loggy/service"
+)
+
+func savedSearchToPb(search *service.SavedSearch) *pb.SavedSearch {
+	q := &pb.Query{
+		Query:     search.Query,
+		Appid:     search.AppID,
+		Deviceid:  search.DeviceID,
+		Sessionid: search.SessionID,
+	}
+	if search.MinLevel != nil && search.MaxLevel != nil {
+		q.Levels = &pb.LevelRange{Min: pb.Message_Level(*search.MinLevel), Max: pb.Message_Level(*search.MaxLevel)}
+	}
+	if search.Start != nil {
+		q.Start = timestamppb.New(*search.Start)
+	}
+	if search.End != nil {
+		q.End = timestamppb.New(*search.End)
+	}
+	s := &pb.SavedSearch{
+		Id:        search.ID,
+		Name:      search.Name,
+		Query:     q,
+		Userid:    search.UserID,
+		CreatedAt: timestamppb.New(search.CreatedAt),
+	}
+	if search.Range != 0 {
+		s.Range = durationpb.New(search.Range)
+	}
+	return s
+}
+
+// setSavedSearch copies the fields a user can change into a saved search.
+func setSavedSearch(entry *service.SavedSearch, search *pb.SavedSearch) {
+	q := search.Query
+	entry.Name = search.Name
+	entry.Query = q.Query
+	entry.AppID = q.Appid
+	entry.DeviceID = q.Deviceid
+	entry.SessionID = q.Sessionid
+	entry.MinLevel, entry.MaxLevel = nil, nil
+	if q.Levels != nil {
+		min, max := service.LogLevel(q.Levels.Min), service.LogLevel(q.Levels.Max)
+		entry.MinLevel, entry.MaxLevel = &min, &max
+	}
+	entry.Start, entry.End = nil, nil
+	if q.Start != nil {
+		start := q.Start.AsTime()
+		entry.Start = &start
+	}
+	if q.End != nil {
+		end := q.End.AsTime()
+		entry.End = &end
+	}
+	entry.Range = search.Range.AsDuration()
+}
+
+// validateSavedSearch checks a saved search, and that the application it
+// searches belongs to the user.
+func (l *loggyServer) validateSavedSearch(ctx context.Context, search *pb.SavedSearch) error {
+	if len(search.Name) == 0 {
+		return status.Error(codes.InvalidArgument, "saved search needs a name")
+	}
+	if search.Query == nil {
+		return status.Error(codes.InvalidArgument, "saved search needs a query")
+	}
+	if len(search.Query.Query) != 0 {
+		if err := bleve.NewQueryStringQuery(search.Query.Query).Validate(); err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid saved search query: %v", err)
+		}
+	}
+	if search.Range.AsDuration() < 0 {
+		return status.Error(codes.InvalidArgument, "saved search range must not be negative")
+	}
+	if len(search.Query.Appid) != 0 {
+		if _, err := l.ownedApp(ctx, search.Query.Appid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ownedSavedSearch loads a saved search and checks that it belongs to the
+// user making the request.
+func (l *loggyServer) ownedSavedSearch(ctx context.Context, searchID int32) (*service.SavedSearch, error) {
+	userID, err := getUserIdFromMetaData(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "user not found")
+	}
+	search, err := l.searchStore.SavedSearch(searchID, userID)
+	if err != nil {
+		return nil, storeError(err, fmt.Sprintf("saved search %d", searchID))
+	}
+	return search, nil
+}
+
+func (l *loggyServer) CreateSavedSearch(ctx context.Context, search *pb.SavedSearch) (*pb.SavedSearch, error) {
+	userID, err := getUserIdFromMetaData(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to save search. user not found")
+	}
+	if err := l.validateSavedSearch(ctx, search); err != nil {
+		return nil, err
+	}
+	entry := &service.SavedSearch{UserID: userID}
+	setSavedSearch(entry, search)
+	if err := l.searchStore.CreateSavedSearch(entry); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to save search: %v", err)
+	}
+	return savedSearchToPb(entry), nil
+}
+
+func (l *loggyServer) UpdateSavedSearch(ctx context.Context, search *pb.SavedSearch) (*pb.SavedSearch, error) {
+	entry, err := l.ownedSavedSearch(ctx, search.Id)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.validateSavedSearch(ctx, search); err != nil {
+		return nil, err
+	}
+	setSavedSearch(entry, search)
+	if err := l.searchStore.UpdateSavedSearch(entry); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to update saved search: %v", err)
+	}
+	return savedSearchToPb(entry), nil
+}
+
+func (l *loggyServer) DeleteSavedSearch(ctx context.Context, searchid *pb.SavedSearchId) (*empty.Empty, error) {
+	entry, err := l.ownedSavedSearch(ctx, searchid.Id)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.searchStore.DeleteSavedSearch(entry); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to delete saved search: %v", err)
+	}
+	return &empty.Empty{}, nil
+}
+
+func (l *loggyServer) ListSavedSearches(ctx context.Context, request *pb.SavedSearchQuery) (*pb.SavedSearchList, error) {
+	userID, err := getUserIdFromMetaData(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to list saved searches. user not found")
+	}
+	if len(request.Appid) != 0 {
+		if _, err := l.ownedApp(ctx, request.Appid); err != nil {
+			return nil, err
+		}
+	}
+	entries, err := l.searchStore.ListSavedSearches(userID, request.Appid)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list saved searches: %v", err)
+	}
+	list := &pb.SavedSearchList{}
+	for _, search := range entries {
+		list.Searches = append(list.Searches, savedSearchToPb(search))
+	}
+	return list, nil
+}
+
+// RunSavedSearch searches with the filters of a saved search. Searches with
+// a range cover the range up to now.
+func (l *loggyServer) RunSavedSearch(ctx context.Context, request *pb.RunSavedSearchRequest) (*pb.SearchResponse, error) {
+	entry, err := l.ownedSavedSearch(ctx, request.Id)
+	if err != nil {
+		return nil, err
+	}
+	search := savedSearchToPb(entry)
+	q := search.Query
+	if entry.Range != 0 {
+		q.Start, q.End = timestamppb.New(time.Now().Add(-entry.Range)), nil
+	}
+	q.Page = request.Page
+	return l.Search(ctx, q)
+}
+
+const (
+	// messages waiting to be matched against standing queries
+	standingQueueSize = 10000
+	// standing queries that are not received by then are removed
+	standingQueryTimeout = time.Minute
+)
+
+type standingQuery struct {
+	receiver   int32
+	userID     string
+	query      query.Query
+	c          chan *pb.Message
+	registered time.Time
+	// set while the query is streamed
+	receiving bool
+}
+
+// standingMessage is a stored message waiting to be matched.
+type standingMessage struct {
+	source *messageSource
+	msg    *service.Message
+}
+
+// standingQueries matches stored messages against the standing queries of
+// their owner and passes the matches to the receivers of the queries.
+// Messages are matched the way alert match rules are, by indexing them
+// alone and searching with the query, on the goroutine of run so the
+// logger does not wait for it.
+type standingQueries struct {
+	lock    sync.Mutex
+	queries map[string]map[int32]*standingQuery // userid -> receiver -> query
+	queue   chan standingMessage
+
+	// only used by run
+	matcher bleve.Index
+}
+
+func newStandingQueries(analyzer string) (*standingQueries, error) {
+	matcher, err := bleve.NewMemOnly(service.NewIndexMapping(analyzer))
+	if err != nil {
+		return nil, err
+	}
+	return &standingQueries{
+		queries: make(map[string]map[int32]*standingQuery),
+		queue:   make(chan standingMessage, standingQueueSize),
+		matcher: matcher,
+	}, nil
+}
+
+func (s *standingQueries) add(q *standingQuery) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	q.registered = time.Now()
+	if s.queries[q.userID] == nil {
+		s.queries[q.userID] = make(map[int32]*standingQuery)
+	}
+	s.queries[q.userID][q.receiver] = q
+}
+
+func (s *standingQueries) remove(receiver int32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for userID, queries := range s.queries {
+		delete(queries, receiver)
+		if len(queries) == 0 {
+			delete(s.queries, userID)
+		}
+	}
+}
+
+// receive returns the standing query of a user with the receiver id, to be
+// streamed. A query is streamed once.
+func (s *standingQueries) receive(receiver int32, userID string) (*standingQuery, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	q, ok := s.queries[userID][receiver]
+	if !ok || q.receiving {
+		return nil, false
+	}
+	q.receiving = true
+	return q, true
+}
+
+// expire removes the standing queries registered more than timeout ago
+// that were never received.
+func (s *standingQueries) expire(timeout time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	cutoff := time.Now().Add(-timeout)
+	for userID, queries := range s.queries {
+		for receiver, q := range queries {
+			if !q.receiving && q.registered.Before(cutoff) {
+				log.Printf("standing query %d was never received, removing it", receiver)
+				delete(queries, receiver)
+			}
+		}
+		if len(queries) == 0 {
+			delete(s.queries, userID)
+		}
+	}
+}
+
+// match queues a stored message to be passed to the standing queries it
+// matches. Messages are skipped rather than hold up the logger when the
+// queue is full, as they are for receivers that fall behind.
+func (s *standingQueries) match(source *messageSource, msg *service.Message) {
+	s.lock.Lock()
+	none := len(s.queries) == 0
+	s.lock.Unlock()
+	if none {
+		return
+	}
+	select {
+	case s.queue <- standingMessage{source: source, msg: msg}:
+	default:
+		log.Printf("standing query queue is full, skipping message %d", msg.ID)
+	}
+}
+
+// run matches queued messages and removes standing queries nobody
+// received.
+func (s *standingQueries) run() {
+	ticker := time.NewTicker(standingQueryTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case m := <-s.queue:
+			s.matchQueued(m.source, m.msg)
+		case <-ticker.C:
+			s.expire(standingQueryTimeout)
+		}
+	}
+}
+
+func (s *standingQueries) matchQueued(source *messageSource, msg *service.Message) {
+	s.lock.Lock()
+	var queries []*standingQuery
+	for _, q := range s.queries[source.app.UserID] {
+		queries = append(queries, q)
+	}
+	s.lock.Unlock()
+	if len(queries) == 0 {
+		return
+	}
+
+	const docID = "message"
+	if err := s.matcher.Index(docID, service.NewIndexedMessage(msg, source.session, source.app, source.device)); err != nil {
+		log.Printf("failed to match message: %v", err)
+		return
+	}
+	defer s.matcher.Delete(docID)
+
+	for _, q := range queries {
+		request := bleve.NewSearchRequest(bleve.NewConjunctionQuery(bleve.NewDocIDQuery([]string{docID}), q.query))
+		result, err := s.matcher.Search(request)
+		if err != nil {
+			log.Printf("failed to match standing query %d: %v", q.receiver, err)
+			continue
+		}
+		if result.Total == 0 {
+			continue
+		}
+		select {
+		case q.c <- messageToPb(msg):
+		default:
+			log.Printf("standing query %d is behind, dropping message", q.receiver)
+		}
+	}
+}
+
+// RegisterStandingQuery subscribes to new messages matching a saved search
+// or query. The matches are streamed by ReceiveStandingQuery.
+func (l *loggyServer) RegisterStandingQuery(ctx context.Context, request *pb.StandingQuery) (*pb.ReceiverId, error) {
+	userID, err := getUserIdFromMetaData(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to register standing query. user not found")
+	}
+	q := request.Query
+	if request.SavedSearchId != 0 {
+		entry, err := l.ownedSavedSearch(ctx, request.SavedSearchId)
+		if err != nil {
+			return nil, err
+		}
+		q = savedSearchToPb(entry).Query
+	}
+	if q == nil {
+		return nil, status.Error(codes.InvalidArgument, "standing query needs a saved search or a query")
+	}
+	if len(q.Query) != 0 {
+		if err := bleve.NewQueryStringQuery(q.Query).Validate(); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid query: %v", err)
+		}
+	}
+	if len(q.Appid) != 0 {
+		if _, err := l.ownedApp(ctx, q.Appid); err != nil {
+			return nil, err
+		}
+	}
+	// only new messages are matched, so the time range does not apply
+	scope := &pb.Query{Query: q.Query, Appid: q.Appid, Deviceid: q.Deviceid, Sessionid: q.Sessionid, Levels: q.Levels}
+
+	// numbered with the other receivers, but only streamed by
+	// ReceiveStandingQuery
+	l.lock.Lock()
+	l.lastReceiver++
+	id := l.lastReceiver
+	l.lock.Unlock()
+
+	l.standing.add(&standingQuery{receiver: id, userID: userID, query: scopedQuery(userID, scope), c: make(chan *pb.Message, 100)})
+	return &pb.ReceiverId{Id: id}, nil
+}
+
+// ReceiveStandingQuery streams the matches of a standing query of the
+// caller. The query is removed when the stream ends, and after a minute
+// when it is not received.
+func (l *loggyServer) ReceiveStandingQuery(receiverid *pb.ReceiverId, stream pb.LoggyService_ReceiveStandingQueryServer) error {
+	userID, err := getUserIdFromMetaData(stream.Context())
+	if err != nil {
+		return status.Errorf(codes.Unauthenticated, "failed to receive standing query. user not found")
+	}
+	q, ok := l.standing.receive(receiverid.Id, userID)
+	if !ok {
+		return status.Errorf(codes.NotFound, "standing query %d not found", receiverid.Id)
+	}
+	defer l.standing.remove(receiverid.Id)
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case in := <-q.c:
+			if err := stream.Send(in); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/loggysh/loggy/loggy"
+	"github.com/loggysh/loggy/service"
+)
+
+func sessionToPb(session *service.Session) *pb.Session {
+	s := &pb.Session{
+		Id:           session.ID,
+		Deviceid:     session.DeviceID.String(),
+		Appid:        session.AppID,
+		Status:       pb.Session_Status(session.Status),
+		Duration:     durationpb.New(session.Duration()),
+		MessageCount: session.MessageCount,
+		EndedInCrash: session.Status == service.SessionCrashed,
+	}
+	if !session.StartedAt.IsZero() {
+		s.StartedAt = timestamppb.New(session.StartedAt)
+	} else {
+		s.StartedAt = timestamppb.New(session.CreatedAt)
+	}
+	if session.EndedAt != nil {
+		s.EndedAt = timestamppb.New(*session.EndedAt)
+	}
+	return s
+}
+
+// endSession marks a live session as ended. Sessions that received a crash
+// always end as crashed, whatever the reason for ending them. Streams,
+// EndSession and the timeout can end a session at the same time, only one
+// of them ends it and the others return it as it ended.
+func (l *loggyServer) endSession(sessionID int32, reason service.SessionStatus) (*service.Session, error) {
+	session, err := l.store.Session(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if session.Status != service.SessionLive {
+		return session, nil
+	}
+
+	now := time.Now()
+	session.Status = reason
+	if session.Crashed {
+		session.Status = service.SessionCrashed
+	}
+	session.EndedAt = &now
+	ended, err := l.store.EndSession(session)
+	if err != nil {
+		return nil, err
+	}
+	if !ended {
+		return l.store.Session(sessionID)
+	}
+	if session.Status == service.SessionCrashed {
+		l.rollups.sessionCrashed(session)
+	}
+	log.Printf("Ended session %d with status %d", session.ID, session.Status)
+	return session, nil
+}
+
+// expireSessions ends live sessions that have not received a message for
+// longer than timeout.
+func (l *loggyServer) expireSessions(timeout time.Duration) {
+	interval := timeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		expired, err := l.store.IdleSessions(time.Now().Add(-timeout))
+		if err != nil {
+			log.Printf("failed to find inactive sessions: %v", err)
+			continue
+		}
+		for _, session := range expired {
+			if _, err := l.endSession(session.ID, service.SessionTimedOut); err != nil {
+				log.Printf("failed to end session %d: %v", session.ID, err)
+			}
+		}
+	}
+}
+
+func (l *loggyServer) EndSession(ctx context.Context, sessionid *pb.SessionId) (*pb.Session, error) {
+	if _, err := l.ownedSession(ctx, sessionid.Id); err != nil {
+		return nil, err
+	}
+	session, err := l.endSession(sessionid.Id, service.SessionEnded)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to end session: %v", err)
+	}
+	return sessionToPb(session), nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	pb "github.com/loggysh/loggy/loggy"
+	"github.com/loggysh/loggy/service"
+)
+
+const testDevice = "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+
+// newTestServer serves the RPCs of applications, devices and sessions from
+// a MemoryStore.
+func newTestServer() *loggyServer {
+	return &loggyServer{
+		store:     service.NewMemoryStore(),
+		webhooks:  newWebhookDispatcher(nil, false),
+		rollups:   newRollupWriter(nil),
+		receivers: make(map[int32]*receiver),
+		listeners: make(map[int32][]int32),
+
+		notifications:       service.NewBroadcaster[*pb.Notification]("notifications", 100),
+		notificationSenders: service.NewBroadcaster[*pb.UserId]("notification senders", 10),
+	}
+}
+
+// userContext is the context of a request of an authenticated user.
+func userContext(userID string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs("user_id", userID))
+}
+
+func TestEndSession(t *testing.T) {
+	l := newTestServer()
+	owner := userContext("owner")
+	app, err := l.GetOrInsertApplication(owner, &pb.Application{Packagename: "sh.loggy", Name: "Loggy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.GetOrInsertDevice(owner, &pb.Device{Id: testDevice, Appid: app.Id}); err != nil {
+		t.Fatal(err)
+	}
+	sid, err := l.InsertSession(owner, &pb.Session{Deviceid: testDevice, Appid: app.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := l.EndSession(userContext("other"), sid); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("EndSession by another user: got %v, want PermissionDenied", err)
+	}
+	if _, err := l.EndSession(context.Background(), sid); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("EndSession without a user: got %v, want Unauthenticated", err)
+	}
+	if _, err := l.EndSession(owner, &pb.SessionId{Id: sid.Id + 1}); status.Code(err) != codes.NotFound {
+		t.Errorf("EndSession of a missing session: got %v, want NotFound", err)
+	}
+
+	ended, err := l.EndSession(owner, sid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ended.Status != pb.Session_ENDED || ended.EndedAt == nil {
+		t.Fatalf("ended session: got status %v ended at %v", ended.Status, ended.EndedAt)
+	}
+	again, err := l.EndSession(owner, sid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Status != pb.Session_ENDED || !again.EndedAt.AsTime().Equal(ended.EndedAt.AsTime()) {
+		t.Errorf("session ended twice: got %v at %v, want %v at %v", again.Status, again.EndedAt.AsTime(), ended.Status, ended.EndedAt.AsTime())
+	}
+}
+
+func TestGetOrInsertDevice(t *testing.T) {
+	l := newTestServer()
+	owner, other := userContext("owner"), userContext("other")
+	app, err := l.GetOrInsertApplication(owner, &pb.Application{Packagename: "sh.loggy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherApp, err := l.GetOrInsertApplication(other, &pb.Application{Packagename: "sh.loggy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		device *pb.Device
+		code   codes.Code
+	}{
+		{"create", owner, &pb.Device{Id: testDevice, Appid: app.Id, Details: "{}"}, codes.OK},
+		{"get", owner, &pb.Device{Id: testDevice, Appid: app.Id}, codes.OK},
+		{"application of another user", owner, &pb.Device{Id: testDevice, Appid: otherApp.Id}, codes.PermissionDenied},
+		{"device of another application", other, &pb.Device{Id: testDevice, Appid: otherApp.Id}, codes.AlreadyExists},
+		{"invalid id", owner, &pb.Device{Id: "device", Appid: app.Id}, codes.InvalidArgument},
+		{"missing application", owner, &pb.Device{Id: testDevice, Appid: "owner/missing"}, codes.NotFound},
+	}
+	for _, test := range tests {
+		device, err := l.GetOrInsertDevice(test.ctx, test.device)
+		if status.Code(err) != test.code {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.code)
+			continue
+		}
+		if err == nil && (device.Appid != app.Id || device.Details != "{}") {
+			t.Errorf("%s: got device of %s with details %q", test.name, device.Appid, device.Details)
+		}
+	}
+}
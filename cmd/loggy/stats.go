@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/loggysh/loggy/loggy"
+	"github.com/loggysh/loggy/service"
+)
+
+const (
+	defaultHistogramRange = 24 * time.Hour
+	// buckets a histogram aims for when the request leaves the width open
+	histogramBuckets = 100
+	// buckets of all groups together
+	maxHistogramBuckets = 10000
+)
+
+// widths picked for histograms that do not ask for one
+var bucketWidths = []time.Duration{
+	time.Minute,
+	5 * time.Minute,
+	15 * time.Minute,
+	time.Hour,
+	6 * time.Hour,
+	24 * time.Hour,
+	7 * 24 * time.Hour,
+}
+
+// addCount adds n messages of a level to counts.
+func addCount(counts *pb.LevelCounts, level service.LogLevel, n int64) {
+	switch level {
+	case service.DEBUG:
+		counts.Debug += n
+	case service.INFO:
+		counts.Info += n
+	case service.WARN:
+		counts.Warn += n
+	case service.ERROR:
+		counts.Error += n
+	case service.CRASH:
+		counts.Crash += n
+	}
+	counts.Total += n
+}
+
+func (l *loggyServer) GetSessionStats(ctx context.Context, sessionid *pb.SessionId) (*pb.SessionStats, error) {
+	session, err := l.ownedSession(ctx, sessionid.Id)
+	if err != nil {
+		return nil, err
+	}
+	counts := &pb.LevelCounts{}
+	if session.SegmentID != 0 {
+		// the index of the segment counts the levels of archived sessions
+		entry, err := l.archivedEntry(session)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to read archived session: %v", err)
+		}
+		for level, count := range entry.Levels {
+			addCount(counts, service.LogLevel(level), count)
+		}
+	}
+	levels, err := l.statsStore.SessionLevelCounts(sessionid.Id)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to count messages: %v", err)
+	}
+	for level, count := range levels {
+		addCount(counts, level, count)
+	}
+	return &pb.SessionStats{
+		DebugCount: int32(counts.Debug),
+		InfoCount:  int32(counts.Info),
+		WarnCount:  int32(counts.Warn),
+		ErrorCount: int32(counts.Error),
+		CrashCount: int32(counts.Crash),
+	}, nil
+}
+
+// histogramScope selects the messages of the application, device or
+// session of a request, after checking that it belongs to the user.
+func (l *loggyServer) histogramScope(ctx context.Context, request *pb.HistogramQuery) (*service.HistogramFilter, error) {
+	if request.Appid == "" && request.Deviceid == "" && request.Sessionid == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "histogram needs an application, device or session")
+	}
+	if request.Appid != "" {
+		if _, err := l.ownedApp(ctx, request.Appid); err != nil {
+			return nil, err
+		}
+	}
+	if request.Deviceid != "" {
+		if _, err := l.ownedDevice(ctx, request.Deviceid); err != nil {
+			return nil, err
+		}
+	}
+	if request.Sessionid != 0 {
+		if _, err := l.ownedSession(ctx, request.Sessionid); err != nil {
+			return nil, err
+		}
+	}
+	return &service.HistogramFilter{
+		AppID:     request.Appid,
+		DeviceID:  request.Deviceid,
+		SessionID: request.Sessionid,
+		ByDevice:  request.Split != pb.HistogramQuery_NONE,
+	}, nil
+}
+
+// deviceVersions maps the devices of counts to the application version in
+// their details.
+func (l *loggyServer) deviceVersions(counts []service.HistogramCount) (map[string]string, error) {
+	seen := make(map[string]bool)
+	var ids []string
+	for _, count := range counts {
+		if !seen[count.DeviceID] {
+			seen[count.DeviceID] = true
+			ids = append(ids, count.DeviceID)
+		}
+	}
+	versions := make(map[string]string, len(ids))
+	if len(ids) == 0 {
+		return versions, nil
+	}
+	devices, err := l.statsStore.Devices(ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, device := range devices {
+		versions[device.ID.String()] = service.DeviceAttributes(device.Details)["application_version"]
+	}
+	return versions, nil
+}
+
+// histogramWidth returns the width of the buckets of a range, the one the
+// request asks for or the smallest that keeps the range to about
+// histogramBuckets buckets.
+func histogramWidth(request *pb.HistogramQuery, start, end time.Time) (time.Duration, error) {
+	if request.Bucket != nil {
+		width := request.Bucket.AsDuration().Truncate(time.Second)
+		if width <= 0 {
+			return 0, status.Errorf(codes.InvalidArgument, "bucket has to be at least a second")
+		}
+		return width, nil
+	}
+	for _, width := range bucketWidths {
+		if end.Sub(start)/width <= histogramBuckets {
+			return width, nil
+		}
+	}
+	return bucketWidths[len(bucketWidths)-1], nil
+}
+
+// GetHistogram counts messages by time bucket and level, optionally split
+// by device or application version, in one grouped query.
+func (l *loggyServer) GetHistogram(ctx context.Context, request *pb.HistogramQuery) (*pb.Histogram, error) {
+	filter, err := l.histogramScope(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	end := time.Now()
+	if request.End != nil {
+		end = request.End.AsTime()
+	}
+	start := end.Add(-defaultHistogramRange)
+	if request.Start != nil {
+		start = request.Start.AsTime()
+	}
+	if !start.Before(end) {
+		return nil, status.Errorf(codes.InvalidArgument, "start has to be before end")
+	}
+	width, err := histogramWidth(request, start, end)
+	if err != nil {
+		return nil, err
+	}
+	// buckets line up with the epoch, so the same width always gives the
+	// same buckets
+	seconds := int64(width / time.Second)
+	first := time.Unix(start.Unix()/seconds*seconds, 0).UTC()
+	buckets := int(end.Sub(first)/width) + 1
+	if end.Sub(first)%width == 0 {
+		buckets--
+	}
+	if buckets > maxHistogramBuckets {
+		return nil, status.Errorf(codes.InvalidArgument, "histogram has more than %d buckets, use wider buckets", maxHistogramBuckets)
+	}
+
+	filter.Start, filter.End, filter.Width = first, end.UTC(), width
+	rows, err := l.statsStore.Histogram(*filter)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to count messages: %v", err)
+	}
+	if request.Split == pb.HistogramQuery_APP_VERSION {
+		// versions are in the details of the devices, which are read here
+		// so the query works without JSON support in the database
+		versions, err := l.deviceVersions(rows)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to load devices: %v", err)
+		}
+		for i := range rows {
+			rows[i].DeviceID = versions[rows[i].DeviceID]
+		}
+	}
+
+	// every group gets every bucket, so charts need not fill gaps
+	counts := make(map[string][]*pb.LevelCounts)
+	for _, row := range rows {
+		if _, ok := counts[row.DeviceID]; !ok {
+			if (len(counts)+1)*buckets > maxHistogramBuckets {
+				return nil, status.Errorf(codes.InvalidArgument, "histogram has more than %d buckets, use wider buckets", maxHistogramBuckets)
+			}
+			counts[row.DeviceID] = make([]*pb.LevelCounts, buckets)
+		}
+		i := int((row.Bucket - first.Unix()) / seconds)
+		if i < 0 || i >= buckets {
+			continue
+		}
+		if counts[row.DeviceID][i] == nil {
+			counts[row.DeviceID][i] = &pb.LevelCounts{}
+		}
+		addCount(counts[row.DeviceID][i], row.Level, row.Count)
+	}
+	if len(counts) == 0 && request.Split == pb.HistogramQuery_NONE {
+		counts[""] = make([]*pb.LevelCounts, buckets)
+	}
+	groups := make([]string, 0, len(counts))
+	for group := range counts {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	histogram := &pb.Histogram{
+		Start:  timestamppb.New(first),
+		End:    timestamppb.New(end),
+		Bucket: durationpb.New(width),
+	}
+	for i := 0; i < buckets; i++ {
+		bucketStart := timestamppb.New(first.Add(time.Duration(i) * width))
+		for _, group := range groups {
+			c := counts[group][i]
+			if c == nil {
+				c = &pb.LevelCounts{}
+			}
+			histogram.Buckets = append(histogram.Buckets, &pb.HistogramBucket{
+				Start:  bucketStart,
+				Group:  group,
+				Counts: c,
+			})
+		}
+	}
+	return histogram, nil
+}
+
+// periods a stats series covers when the request leaves the start open
+var defaultStatsRange = map[service.RollupPeriod]time.Duration{
+	service.RollupHour: 48 * time.Hour,
+	service.RollupDay:  30 * 24 * time.Hour,
+}
+
+const maxStatsPeriods = 2000
+
+func periodStats(r *service.Rollup) *pb.PeriodStats {
+	stats := &pb.PeriodStats{
+		Start: timestamppb.New(r.Start),
+		Counts: &pb.LevelCounts{
+			Debug: r.DebugCount,
+			Info:  r.InfoCount,
+			Warn:  r.WarnCount,
+			Error: r.ErrorCount,
+			Crash: r.CrashCount,
+			Total: r.DebugCount + r.InfoCount + r.WarnCount + r.ErrorCount + r.CrashCount,
+		},
+		Sessions:        r.Sessions,
+		CrashedSessions: r.CrashedSessions,
+		ActiveDevices:   r.ActiveDevices,
+	}
+	if r.Sessions != 0 {
+		stats.CrashRate = float64(r.CrashedSessions) / float64(r.Sessions)
+	}
+	return stats
+}
+
+// rollupStats reads the rollups of an application, or of one of its
+// devices when deviceID is set, for the range of the request.
+func (l *loggyServer) rollupStats(appID, deviceID string, request *pb.StatsQuery) (*pb.StatsSeries, error) {
+	period := service.RollupPeriod(request.Period)
+	if period != service.RollupHour && period != service.RollupDay {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown period %d", request.Period)
+	}
+	end := time.Now()
+	if request.End != nil {
+		end = request.End.AsTime()
+	}
+	start := end.Add(-defaultStatsRange[period])
+	if request.Start != nil {
+		start = request.Start.AsTime()
+	}
+	if !start.Before(end) {
+		return nil, status.Errorf(codes.InvalidArgument, "start has to be before end")
+	}
+	first := period.Start(start)
+	periods := int((end.Sub(first) + period.Duration() - 1) / period.Duration())
+	if periods > maxStatsPeriods {
+		return nil, status.Errorf(codes.InvalidArgument, "stats cover more than %d periods, use a shorter range or days", maxStatsPeriods)
+	}
+
+	rollups, err := l.statsStore.Rollups(appID, deviceID, period, first, end.UTC())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to load stats: %v", err)
+	}
+	byPeriod := make([]*service.Rollup, periods)
+	total := &service.Rollup{Start: first}
+	for _, r := range rollups {
+		i := int(r.Start.Sub(first) / period.Duration())
+		if i < 0 || i >= periods {
+			continue
+		}
+		byPeriod[i] = r
+		total.DebugCount += r.DebugCount
+		total.InfoCount += r.InfoCount
+		total.WarnCount += r.WarnCount
+		total.ErrorCount += r.ErrorCount
+		total.CrashCount += r.CrashCount
+		total.Sessions += r.Sessions
+		total.CrashedSessions += r.CrashedSessions
+	}
+	if deviceID == "" {
+		// devices active in several periods count once in the total
+		total.ActiveDevices, err = l.statsStore.ActiveDevices(appID, period, first, end.UTC())
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to count devices: %v", err)
+		}
+	}
+
+	series := &pb.StatsSeries{Total: periodStats(total)}
+	for i, r := range byPeriod {
+		if r == nil {
+			r = &service.Rollup{Start: first.Add(time.Duration(i) * period.Duration())}
+		}
+		series.Periods = append(series.Periods, periodStats(r))
+	}
+	return series, nil
+}
+
+// GetApplicationStats returns the stats of an application from its
+// rollups, without looking at its messages.
+func (l *loggyServer) GetApplicationStats(ctx context.Context, request *pb.StatsQuery) (*pb.StatsSeries, error) {
+	if _, err := l.ownedApp(ctx, request.Appid); err != nil {
+		return nil, err
+	}
+	return l.rollupStats(request.Appid, "", request)
+}
+
+// GetDeviceStats returns the stats of a device from its rollups.
+func (l *loggyServer) GetDeviceStats(ctx context.Context, request *pb.StatsQuery) (*pb.StatsSeries, error) {
+	device, err := l.ownedDevice(ctx, request.Deviceid)
+	if err != nil {
+		return nil, err
+	}
+	return l.rollupStats(device.AppID, device.ID.String(), request)
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+
+	empty "google.golang.org/protobuf/types/known/emptypb"
+
+	pb "github.com/loggysh/loggy/loggy"
+	"github.com/loggysh/loggy/service"
+)
+
+// NotificationTest is delivered by SendTestWebhook.
+const NotificationTest = "webhook.test"
+
+const (
+	webhookMaxAttempts  = 8
+	webhookBaseBackoff  = 10 * time.Second
+	webhookMaxBackoff   = time.Hour
+	webhookPollInterval = time.Second
+	webhookBatchSize    = 20
+	// deliveries are attempted by this many workers, so a slow endpoint
+	// holds up one of them rather than every other webhook
+	webhookWorkers = 8
+)
+
+// webhookDispatcher turns notifications into deliveries for the webhooks of
+// the application and delivers them, retrying with exponential backoff.
+// Deliveries that run out of attempts stay in the table as dead letters.
+type webhookDispatcher struct {
+	db     *gorm.DB
+	client *http.Client
+	events chan *pb.Notification
+	// webhooks may point at private addresses, only for development
+	private bool
+
+	due      chan *service.WebhookDelivery
+	lock     sync.Mutex
+	inflight map[int32]bool
+}
+
+func newWebhookDispatcher(db *gorm.DB, private bool) *webhookDispatcher {
+	d := &webhookDispatcher{
+		db:       db,
+		events:   make(chan *pb.Notification, 1000),
+		private:  private,
+		due:      make(chan *service.WebhookDelivery),
+		inflight: make(map[int32]bool),
+	}
+	// addresses are checked when dialling as well as on create, the host
+	// may resolve to another address by the time a delivery is attempted
+	dialer := &net.Dialer{Timeout: 5 * time.Second, Control: d.checkDial}
+	d.client = &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+	}
+	return d
+}
+
+// publicIP reports whether webhooks may be delivered to the address.
+func publicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified())
+}
+
+// checkHost resolves the host of a webhook url and fails if any of its
+// addresses is not public.
+func (d *webhookDispatcher) checkHost(ctx context.Context, host string) error {
+	if d.private {
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if !publicIP(addr.IP) {
+			return fmt.Errorf("%s resolves to %s, which is not a public address", host, addr.IP)
+		}
+	}
+	return nil
+}
+
+// checkDial fails connections to addresses that are not public.
+func (d *webhookDispatcher) checkDial(network, address string, c syscall.RawConn) error {
+	if d.private {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicIP(ip) {
+		return fmt.Errorf("%s is not a public address", host)
+	}
+	return nil
+}
+
+// dispatch queues a notification without blocking the caller.
+func (d *webhookDispatcher) dispatch(notification *pb.Notification) {
+	if len(notification.Appid) == 0 {
+		return
+	}
+	select {
+	case d.events <- notification:
+	default:
+		log.Printf("webhook queue is full, dropping %s notification", notification.Type)
+	}
+}
+
+func (d *webhookDispatcher) run() {
+	go func() {
+		for notification := range d.events {
+			if err := d.enqueue(notification); err != nil {
+				log.Printf("failed to queue webhooks for %s: %v", notification.Type, err)
+			}
+		}
+	}()
+
+	for i := 0; i < webhookWorkers; i++ {
+		go d.work()
+	}
+
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var due []*service.WebhookDelivery
+		tx := d.db.Where("status IN ? AND next_attempt_at <= ?",
+			[]service.DeliveryStatus{service.DeliveryPending, service.DeliveryRetrying}, time.Now())
+		if inflight := d.inflightIDs(); len(inflight) != 0 {
+			tx = tx.Where("id NOT IN ?", inflight)
+		}
+		if err := tx.Order("next_attempt_at").Limit(webhookBatchSize).Find(&due).Error; err != nil {
+			log.Printf("failed to load webhook deliveries: %v", err)
+			continue
+		}
+		for _, delivery := range due {
+			d.lock.Lock()
+			d.inflight[delivery.ID] = true
+			d.lock.Unlock()
+			// waits for a free worker
+			d.due <- delivery
+		}
+	}
+}
+
+// work attempts the deliveries handed to it by run.
+func (d *webhookDispatcher) work() {
+	for delivery := range d.due {
+		d.attempt(delivery)
+		d.lock.Lock()
+		delete(d.inflight, delivery.ID)
+		d.lock.Unlock()
+	}
+}
+
+// inflightIDs returns the deliveries that are being attempted, which are
+// not loaded again until the attempt is over.
+func (d *webhookDispatcher) inflightIDs() []int32 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	ids := make([]int32, 0, len(d.inflight))
+	for id := range d.inflight {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// enqueue creates a delivery for every webhook of the application that is
+// subscribed to the notification type.
+func (d *webhookDispatcher) enqueue(notification *pb.Notification) error {
+	var webhooks []*service.Webhook
+	if err := d.db.Where("application_id = ?", notification.Appid).Find(&webhooks).Error; err != nil {
+		return err
+	}
+	for _, webhook := range webhooks {
+		if !webhook.Accepts(notification.Type) {
+			continue
+		}
+		if _, err := d.create(webhook, notification, time.Now()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *webhookDispatcher) create(webhook *service.Webhook, notification *pb.Notification, due time.Time) (*service.WebhookDelivery, error) {
+	payload, err := protojson.Marshal(notification)
+	if err != nil {
+		return nil, err
+	}
+	delivery := &service.WebhookDelivery{
+		WebhookID:     webhook.ID,
+		EventType:     notification.Type,
+		Payload:       string(payload),
+		Status:        service.DeliveryPending,
+		NextAttemptAt: due,
+	}
+	return delivery, d.db.Create(delivery).Error
+}
+
+// attempt posts the delivery once and schedules the next attempt if it
+// failed.
+func (d *webhookDispatcher) attempt(delivery *service.WebhookDelivery) {
+	webhook := &service.Webhook{}
+	if err := d.db.Where("id = ?", delivery.WebhookID).First(&webhook).Error; err != nil {
+		// the webhook was deleted, nothing left to deliver to
+		delivery.Status = service.DeliveryDead
+		delivery.LastError = "webhook deleted"
+		d.db.Save(delivery)
+		return
+	}
+
+	delivery.Attempts++
+	code, err := d.post(webhook, delivery)
+	delivery.ResponseCode = int32(code)
+	if err == nil {
+		now := time.Now()
+		delivery.Status = service.DeliveryDelivered
+		delivery.DeliveredAt = &now
+		delivery.LastError = ""
+	} else {
+		delivery.LastError = err.Error()
+		if delivery.Attempts >= webhookMaxAttempts {
+			delivery.Status = service.DeliveryDead
+			log.Printf("webhook delivery %d is dead after %d attempts: %v", delivery.ID, delivery.Attempts, err)
+		} else {
+			delivery.Status = service.DeliveryRetrying
+			delivery.NextAttemptAt = time.Now().Add(webhookBackoff(delivery.Attempts))
+		}
+	}
+	if err := d.db.Save(delivery).Error; err != nil {
+		log.Printf("failed to update webhook delivery %d: %v", delivery.ID, err)
+	}
+}
+
+func (d *webhookDispatcher) post(webhook *service.Webhook, delivery *service.WebhookDelivery) (int, error) {
+	body := []byte(delivery.Payload)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(service.WebhookEventHeader, delivery.EventType)
+	req.Header.Set(service.WebhookDeliveryHeader, strconv.Itoa(int(delivery.ID)))
+	req.Header.Set(service.WebhookTimestampHeader, timestamp)
+	req.Header.Set(service.WebhookSignatureHeader, service.SignWebhook(webhook.Secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("status: %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// webhookBackoff doubles the wait after every failed attempt.
+func webhookBackoff(attempts int32) time.Duration {
+	backoff := webhookBaseBackoff << (attempts - 1)
+	if backoff <= 0 || backoff > webhookMaxBackoff {
+		return webhookMaxBackoff
+	}
+	return backoff
+}
+
+func webhookToPb(webhook *service.Webhook) *pb.Webhook {
+	return &pb.Webhook{
+		Id:         webhook.ID,
+		Appid:      webhook.AppID,
+		Url:        webhook.URL,
+		EventTypes: webhook.Types(),
+	}
+}
+
+func webhookDeliveryToPb(delivery *service.WebhookDelivery) *pb.WebhookDelivery {
+	d := &pb.WebhookDelivery{
+		Id:            delivery.ID,
+		WebhookId:     delivery.WebhookID,
+		EventType:     delivery.EventType,
+		Status:        pb.WebhookDelivery_Status(delivery.Status),
+		Attempts:      delivery.Attempts,
+		ResponseCode:  delivery.ResponseCode,
+		LastError:     delivery.LastError,
+		CreatedAt:     timestamppb.New(delivery.CreatedAt),
+		NextAttemptAt: timestamppb.New(delivery.NextAttemptAt),
+		Payload:       delivery.Payload,
+	}
+	if delivery.DeliveredAt != nil {
+		d.DeliveredAt = timestamppb.New(*delivery.DeliveredAt)
+	}
+	return d
+}
+
+// ownedWebhook loads a webhook and checks that it belongs to the user
+// making the request.
+func (l *loggyServer) ownedWebhook(ctx context.Context, webhookID int32) (*service.Webhook, error) {
+	userID, err := getUserIdFromMetaData(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "user not found")
+	}
+	webhook, err := l.webhookStore.Webhook(webhookID, userID)
+	if err != nil {
+		return nil, storeError(err, fmt.Sprintf("webhook %d", webhookID))
+	}
+	return webhook, nil
+}
+
+func (l *loggyServer) CreateWebhook(ctx context.Context, webhook *pb.Webhook) (*pb.Webhook, error) {
+	app, err := l.ownedApp(ctx, webhook.Appid)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(webhook.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid webhook url %q", webhook.Url)
+	}
+	if err := l.webhooks.checkHost(ctx, u.Hostname()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid webhook url %q: %v", webhook.Url, err)
+	}
+	for _, t := range webhook.EventTypes {
+		if len(t) == 0 || strings.Contains(t, ",") {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid event type %q", t)
+		}
+	}
+
+	secret := webhook.Secret
+	if len(secret) == 0 {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to generate webhook secret: %v", err)
+		}
+		secret = hex.EncodeToString(key)
+	}
+
+	entry := &service.Webhook{
+		AppID:      app.ID,
+		UserID:     app.UserID,
+		URL:        u.String(),
+		Secret:     secret,
+		EventTypes: strings.Join(webhook.EventTypes, ","),
+	}
+	if err := l.webhookStore.CreateWebhook(entry); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create webhook: %v", err)
+	}
+	created := webhookToPb(entry)
+	created.Secret = entry.Secret
+	return created, nil
+}
+
+func (l *loggyServer) ListWebhooks(ctx context.Context, appid *pb.ApplicationId) (*pb.WebhookList, error) {
+	if _, err := l.ownedApp(ctx, appid.Id); err != nil {
+		return nil, err
+	}
+	var webhooks []*pb.Webhook
+	entries, err := l.webhookStore.ListWebhooks(appid.Id)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list webhooks: %v", err)
+	}
+	for _, webhook := range entries {
+		webhooks = append(webhooks, webhookToPb(webhook))
+	}
+	return &pb.WebhookList{Webhooks: webhooks}, nil
+}
+
+func (l *loggyServer) DeleteWebhook(ctx context.Context, webhookid *pb.WebhookId) (*empty.Empty, error) {
+	webhook, err := l.ownedWebhook(ctx, webhookid.Id)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.webhookStore.DeleteWebhook(webhook); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to delete webhook: %v", err)
+	}
+	return &empty.Empty{}, nil
+}
+
+func (l *loggyServer) ListWebhookDeliveries(ctx context.Context, query *pb.WebhookDeliveryQuery) (*pb.WebhookDeliveryList, error) {
+	webhook, err := l.ownedWebhook(ctx, query.WebhookId)
+	if err != nil {
+		return nil, err
+	}
+	var deliveries []*pb.WebhookDelivery
+	entries, err := l.webhookStore.ListWebhookDeliveries(webhook.ID, query.DeadOnly)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list webhook deliveries: %v", err)
+	}
+	for _, delivery := range entries {
+		deliveries = append(deliveries, webhookDeliveryToPb(delivery))
+	}
+	return &pb.WebhookDeliveryList{Deliveries: deliveries}, nil
+}
+
+func (l *loggyServer) RedeliverWebhook(ctx context.Context, deliveryid *pb.WebhookDeliveryId) (*pb.WebhookDelivery, error) {
+	delivery, err := l.webhookStore.WebhookDelivery(deliveryid.Id)
+	if err != nil {
+		return nil, storeError(err, fmt.Sprintf("webhook delivery %d", deliveryid.Id))
+	}
+	if _, err := l.ownedWebhook(ctx, delivery.WebhookID); err != nil {
+		return nil, err
+	}
+	if delivery.Status != service.DeliveryDead {
+		return nil, status.Errorf(codes.FailedPrecondition, "webhook delivery %d is not dead", delivery.ID)
+	}
+	delivery.Status = service.DeliveryPending
+	delivery.Attempts = 0
+	delivery.NextAttemptAt = time.Now()
+	if err := l.webhookStore.SaveWebhookDelivery(delivery); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to redeliver webhook: %v", err)
+	}
+	return webhookDeliveryToPb(delivery), nil
+}
+
+// SendTestWebhook delivers a test notification right away and returns the
+// outcome of the first attempt. Failed test deliveries are retried like
+// any other delivery.
+func (l *loggyServer) SendTestWebhook(ctx context.Context, webhookid *pb.WebhookId) (*pb.WebhookDelivery, error) {
+	webhook, err := l.ownedWebhook(ctx, webhookid.Id)
+	if err != nil {
+		return nil, err
+	}
+	// due later, so the dispatcher does not pick it up while we attempt it
+	delivery, err := l.webhooks.create(webhook, &pb.Notification{
+		Type:      NotificationTest,
+		Message:   "test event from loggy",
+		Timestamp: timestamppb.Now(),
+		Appid:     webhook.AppID,
+	}, time.Now().Add(webhookBaseBackoff))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create test delivery: %v", err)
+	}
+	l.webhooks.attempt(delivery)
+	return webhookDeliveryToPb(delivery), nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/blevesearch/bleve/v2"
+	"gorm.io/gorm"
+
+	"github.com/loggysh/loggy/service"
+)
+
+// repairCheckpointKey holds the id of the last message checked by an
+// unfinished repair.
+var repairCheckpointKey = []byte("reindex.repair")
+
+// reportLimit is the number of ids listed per kind of problem.
+const reportLimit = 20
+
+// checker compares the index with the database. Missing documents are
+// messages that are not in the index, orphaned documents are in the index
+// but their message is not in the database anymore.
+type checker struct {
+	db        *gorm.DB
+	index     bleve.Index
+	batchSize int
+	fix       bool
+
+	checked  int
+	missing  []string
+	orphaned []string
+}
+
+func (c *checker) run(restart bool) error {
+	if err := c.findMissing(restart); err != nil {
+		return err
+	}
+	return c.findOrphaned()
+}
+
+// indexed returns which of ids have a document in the index.
+func (c *checker) indexed(ids []string) (map[string]bool, error) {
+	request := bleve.NewSearchRequestOptions(bleve.NewDocIDQuery(ids), len(ids), 0, false)
+	result, err := c.index.Search(request)
+	if err != nil {
+		return nil, err
+	}
+	found := make(map[string]bool, len(result.Hits))
+	for _, hit := range result.Hits {
+		found[hit.ID] = true
+	}
+	return found, nil
+}
+
+func (c *checker) findMissing(restart bool) error {
+	var lastID int
+	if !restart {
+		checkpoint, _ := c.index.GetInternal(repairCheckpointKey)
+		lastID, _ = strconv.Atoi(string(checkpoint))
+		if lastID > 0 {
+			log.Printf("resuming repair after message %d", lastID)
+		}
+	}
+
+	for {
+		docs, err := service.LoadIndexDocuments(c.db, lastID, c.batchSize)
+		if err != nil {
+			return err
+		}
+		if len(docs) == 0 {
+			break
+		}
+		ids := make([]string, len(docs))
+		for i, doc := range docs {
+			ids[i] = doc.ID
+		}
+		found, err := c.indexed(ids)
+		if err != nil {
+			return err
+		}
+
+		batch := c.index.NewBatch()
+		for _, doc := range docs {
+			if found[doc.ID] {
+				continue
+			}
+			c.missing = append(c.missing, doc.ID)
+			if c.fix {
+				if err := batch.Index(doc.ID, doc.Doc); err != nil {
+					return err
+				}
+			}
+		}
+		lastID, _ = strconv.Atoi(ids[len(ids)-1])
+		if c.fix {
+			batch.SetInternal(repairCheckpointKey, []byte(strconv.Itoa(lastID)))
+			if err := c.index.Batch(batch); err != nil {
+				return err
+			}
+		}
+		c.checked += len(docs)
+		log.Printf("checked %d messages, %d missing from the index", c.checked, len(c.missing))
+	}
+
+	if c.fix {
+		return c.index.DeleteInternal(repairCheckpointKey)
+	}
+	return nil
+}
+
+func (c *checker) findOrphaned() error {
+	var after []string
+	var seen int
+	for {
+		request := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), c.batchSize, 0, false)
+		request.SortBy([]string{"_id"})
+		if after != nil {
+			request.SetSearchAfter(after)
+		}
+		result, err := c.index.Search(request)
+		if err != nil {
+			return err
+		}
+		if len(result.Hits) == 0 {
+			break
+		}
+
+		ids := make([]string, len(result.Hits))
+		for i, hit := range result.Hits {
+			ids[i] = hit.ID
+		}
+		var existing []int
+		if err := c.db.Model(&service.Message{}).Where("id IN ?", ids).Pluck("id", &existing).Error; err != nil {
+			return err
+		}
+		exists := make(map[string]bool, len(existing))
+		for _, id := range existing {
+			exists[strconv.Itoa(id)] = true
+		}
+
+		batch := c.index.NewBatch()
+		for _, id := range ids {
+			if !exists[id] {
+				c.orphaned = append(c.orphaned, id)
+				batch.Delete(id)
+			}
+		}
+		// the next page starts after the last id, deleting this one
+		// skips nothing
+		if c.fix && batch.Size() > 0 {
+			if err := c.index.Batch(batch); err != nil {
+				return err
+			}
+		}
+		seen += len(ids)
+		after = []string{ids[len(ids)-1]}
+		log.Printf("checked %d documents, %d orphaned", seen, len(c.orphaned))
+	}
+	return nil
+}
+
+func (c *checker) report() {
+	action := "found"
+	if c.fix {
+		action = "repaired"
+	}
+	fmt.Printf("checked %d messages\n", c.checked)
+	fmt.Printf("%s %d missing documents %s\n", action, len(c.missing), sample(c.missing))
+	fmt.Printf("%s %d orphaned documents %s\n", action, len(c.orphaned), sample(c.orphaned))
+}
+
+func sample(ids []string) string {
+	if len(ids) == 0 {
+		return ""
+	}
+	if len(ids) > reportLimit {
+		return "(" + strings.Join(ids[:reportLimit], ", ") + ", ...)"
+	}
+	return "(" + strings.Join(ids, ", ") + ")"
+}
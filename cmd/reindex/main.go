@@ -0,0 +1,97 @@
+// reindex rebuilds, repairs or verifies the search index of loggy from the
+// messages in its database. loggy has to be stopped while it runs, the
+// index can only be opened by one process.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/analysis/analyzer/standard"
+
+	"github.com/loggysh/loggy/service"
+)
+
+func main() {
+	mode := flag.String("mode", "verify", "rebuild: index every message into a new index, repair: index missing and delete orphaned documents, verify: only report them. (verify)")
+	database := service.DatabaseFlags("db/test.db")
+	dbPath := flag.String("db", "", "Database of loggy, same as -database.")
+	indexPath := flag.String("index", "loggy.index", "Search index of loggy. (loggy.index)")
+	analyzer := flag.String("index-analyzer", standard.Name, "Analyzer of message bodies, must match the one loggy runs with. (standard)")
+	batchSize := flag.Int("batch", 1000, "Messages per batch, progress is saved after each. (1000)")
+	restart := flag.Bool("restart", false, "Start over instead of resuming from the last checkpoint.")
+	flag.Parse()
+
+	if len(*dbPath) != 0 {
+		database.DSN = *dbPath
+	}
+	db, err := service.OpenDatabase(database)
+	if err != nil {
+		log.Fatalf("failed to connect database: %v", err)
+	}
+
+	switch *mode {
+	case "rebuild":
+		index, resume, err := service.OpenIndex(*indexPath, *analyzer)
+		if err != nil {
+			log.Fatalf("failed to open index: %v", err)
+		}
+		if !resume || *restart {
+			index.Close()
+			if err := os.RemoveAll(*indexPath); err != nil {
+				log.Fatalf("failed to remove index: %v", err)
+			}
+			if index, _, err = service.CreateIndex(*indexPath, *analyzer); err != nil {
+				log.Fatalf("failed to create index: %v", err)
+			}
+		}
+		defer index.Close()
+		if err := service.RebuildIndex(db, index, *batchSize); err != nil {
+			log.Fatalf("failed to rebuild index: %v", err)
+		}
+
+	case "repair":
+		index, rebuild, err := service.OpenIndex(*indexPath, *analyzer)
+		if err != nil {
+			log.Fatalf("failed to open index: %v", err)
+		}
+		defer index.Close()
+		if rebuild {
+			// nothing to repair in an index that was never complete
+			if err := service.RebuildIndex(db, index, *batchSize); err != nil {
+				log.Fatalf("failed to rebuild index: %v", err)
+			}
+			return
+		}
+		c := &checker{db: db, index: index, batchSize: *batchSize, fix: true}
+		if err := c.run(*restart); err != nil {
+			log.Fatalf("failed to repair index: %v", err)
+		}
+		c.report()
+
+	case "verify":
+		// opened as is, verify never changes the index
+		index, err := bleve.Open(*indexPath)
+		if err != nil {
+			log.Fatalf("failed to open index: %v", err)
+		}
+		defer index.Close()
+		c := &checker{db: db, index: index, batchSize: *batchSize}
+		if err := c.run(true); err != nil {
+			log.Fatalf("failed to verify index: %v", err)
+		}
+		c.report()
+		if len(c.missing) != 0 || len(c.orphaned) != 0 {
+			index.Close()
+			os.Exit(1)
+		}
+
+	default:
+		fmt.Fprintf(os.Stderr, "unknown mode %s\n", *mode)
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+}
@@ -1,19 +1,24 @@
 package main
 
 import (
+	"flag"
 	"log"
+	"os"
 
 	"github.com/loggysh/loggy/auth/controller"
 	"github.com/loggysh/loggy/auth/models"
+	"github.com/loggysh/loggy/service"
 
 	"github.com/gin-gonic/gin"
-	"gorm.io/driver/sqlite"
-	"gorm.io/gorm"
 )
 
 func main() {
+	database := service.DatabaseFlags("db/user.db")
+	internalSecret := flag.String("internal-secret", os.Getenv("INTERNAL_SECRET"), "Secret loggy sends to call internal endpoints, they are disabled without one. ($INTERNAL_SECRET)")
+	flag.Parse()
+
 	//create database
-	db, err := gorm.Open(sqlite.Open("db/user.db"), &gorm.Config{})
+	db, err := service.OpenDatabase(database)
 	if err != nil {
 		log.Fatalln("could not create database", err)
 	}
@@ -24,7 +29,8 @@ func main() {
 	}
 
 	userServer := controller.UserServer{
-		DB: db,
+		DB:             db,
+		InternalSecret: *internalSecret,
 	}
 
 	router := gin.Default()
@@ -39,6 +45,10 @@ func main() {
 	public.POST("/signup", userServer.Signup)
 	public.POST("/verify", userServer.Verify)
 	public.GET("/verify/key", userServer.VerifyAPIKey)
+	public.POST("/preferences", userServer.Preferences)
+
+	internal := api.Group("/internal", userServer.Internal)
+	internal.GET("/contact", userServer.Contact)
 
 	err = router.Run(":8080")
 	if err != nil {
@@ -0,0 +1,165 @@
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenLBrace
+	tokenRBrace
+	tokenComma
+	tokenPipe
+	// operators
+	tokenEq
+	tokenNeq
+	tokenRe
+	tokenNre
+	tokenGt
+	tokenGte
+	tokenLt
+	tokenLte
+	tokenPipeEq
+	tokenPipeRe
+)
+
+var tokenNames = map[tokenKind]string{
+	tokenEOF:    "end of query",
+	tokenIdent:  "name",
+	tokenString: "string",
+	tokenNumber: "number",
+	tokenLBrace: "{",
+	tokenRBrace: "}",
+	tokenComma:  ",",
+	tokenPipe:   "|",
+	tokenEq:     "=",
+	tokenNeq:    "!=",
+	tokenRe:     "=~",
+	tokenNre:    "!~",
+	tokenGt:     ">",
+	tokenGte:    ">=",
+	tokenLt:     "<",
+	tokenLte:    "<=",
+	tokenPipeEq: "|=",
+	tokenPipeRe: "|~",
+}
+
+func (k tokenKind) String() string {
+	return tokenNames[k]
+}
+
+// operators, longest first so "|=" is not read as "|"
+var operators = []struct {
+	text string
+	kind tokenKind
+}{
+	{"|=", tokenPipeEq},
+	{"|~", tokenPipeRe},
+	{"!=", tokenNeq},
+	{"!~", tokenNre},
+	{"=~", tokenRe},
+	{">=", tokenGte},
+	{"<=", tokenLte},
+	{"=", tokenEq},
+	{">", tokenGt},
+	{"<", tokenLt},
+	{"|", tokenPipe},
+	{"{", tokenLBrace},
+	{"}", tokenRBrace},
+	{",", tokenComma},
+}
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func (t token) String() string {
+	if t.kind == tokenEOF {
+		return t.kind.String()
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+func isIdentRune(r rune, first bool) bool {
+	if r == '_' || ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') {
+		return true
+	}
+	return !first && (r == '.' || ('0' <= r && r <= '9'))
+}
+
+// lex splits a query into tokens. Strings are quoted with double quotes,
+// which take Go escapes, or backticks, which take none and suit regexps.
+func lex(input string) ([]token, error) {
+	var tokens []token
+	pos := 0
+next:
+	for pos < len(input) {
+		// names, numbers and operators are ASCII, other runes only appear
+		// in strings, which are matched byte by byte
+		r, size := utf8.DecodeRuneInString(input[pos:])
+		switch {
+		case unicode.IsSpace(r):
+			pos += size
+			continue next
+
+		case r == '"' || r == '`':
+			end := pos + 1
+			for end < len(input) && input[end] != input[pos] {
+				if input[end] == '\\' && r == '"' {
+					end++
+				}
+				end++
+			}
+			if end >= len(input) {
+				return nil, fmt.Errorf("unterminated string at %d", pos)
+			}
+			text, err := strconv.Unquote(input[pos : end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid string at %d: %v", pos, err)
+			}
+			tokens = append(tokens, token{tokenString, text, pos})
+			pos = end + 1
+			continue next
+
+		case ('0' <= r && r <= '9') || r == '-':
+			// numbers carry their unit, e.g. 5m
+			end := pos + 1
+			for end < len(input) && (isIdentRune(rune(input[end]), false)) {
+				end++
+			}
+			tokens = append(tokens, token{tokenNumber, input[pos:end], pos})
+			pos = end
+			continue next
+
+		case isIdentRune(r, true):
+			end := pos + 1
+			for end < len(input) && isIdentRune(rune(input[end]), false) {
+				end++
+			}
+			tokens = append(tokens, token{tokenIdent, input[pos:end], pos})
+			pos = end
+			continue next
+		}
+
+		for _, op := range operators {
+			if strings.HasPrefix(input[pos:], op.text) {
+				tokens = append(tokens, token{op.kind, op.text, pos})
+				pos += len(op.text)
+				continue next
+			}
+		}
+		return nil, fmt.Errorf("unexpected %q at %d", r, pos)
+	}
+	return append(tokens, token{tokenEOF, "", pos}), nil
+}
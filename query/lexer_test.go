@@ -0,0 +1,82 @@
+package query
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLex(t *testing.T) {
+	tests := []struct {
+		input string
+		kinds []tokenKind
+		texts []string
+	}{
+		{
+			input: `{app="42/sh.loggy", level>=WARN}`,
+			kinds: []tokenKind{tokenLBrace, tokenIdent, tokenEq, tokenString, tokenComma, tokenIdent, tokenGte, tokenIdent, tokenRBrace, tokenEOF},
+			texts: []string{"{", "app", "=", "42/sh.loggy", ",", "level", ">=", "WARN", "}", ""},
+		},
+		{
+			input: "|= \"a \\\"b\\\"\" |~ `t\\d+` != \"x\" !~ `y`",
+			kinds: []tokenKind{tokenPipeEq, tokenString, tokenPipeRe, tokenString, tokenNeq, tokenString, tokenNre, tokenString, tokenEOF},
+			texts: []string{"|=", `a "b"`, "|~", `t\d+`, "!=", "x", "!~", "y", ""},
+		},
+		{
+			input: "| bucket 5m | count by tag, android.os | top 3",
+			kinds: []tokenKind{tokenPipe, tokenIdent, tokenNumber, tokenPipe, tokenIdent, tokenIdent, tokenIdent, tokenComma, tokenIdent, tokenPipe, tokenIdent, tokenNumber, tokenEOF},
+			texts: []string{"|", "bucket", "5m", "|", "count", "by", "tag", ",", "android.os", "|", "top", "3", ""},
+		},
+		{
+			input: "{n<-1.5,m<=2,o>3,p=~`a`}",
+			kinds: []tokenKind{tokenLBrace, tokenIdent, tokenLt, tokenNumber, tokenComma, tokenIdent, tokenLte, tokenNumber, tokenComma, tokenIdent, tokenGt, tokenNumber, tokenComma, tokenIdent, tokenRe, tokenString, tokenRBrace, tokenEOF},
+			texts: []string{"{", "n", "<", "-1.5", ",", "m", "<=", "2", ",", "o", ">", "3", ",", "p", "=~", "a", "}", ""},
+		},
+		{
+			// multibyte runes, some with bytes that are spaces in Latin-1
+			input: "{app=\"café\"}\u00a0|= \"à la\" |~ `ü+`",
+			kinds: []tokenKind{tokenLBrace, tokenIdent, tokenEq, tokenString, tokenRBrace, tokenPipeEq, tokenString, tokenPipeRe, tokenString, tokenEOF},
+			texts: []string{"{", "app", "=", "café", "}", "|=", "à la", "|~", "ü+", ""},
+		},
+		{
+			input: "  ",
+			kinds: []tokenKind{tokenEOF},
+			texts: []string{""},
+		},
+	}
+	for _, test := range tests {
+		tokens, err := lex(test.input)
+		if err != nil {
+			t.Errorf("lex(%q): %v", test.input, err)
+			continue
+		}
+		if len(tokens) != len(test.kinds) {
+			t.Errorf("lex(%q) = %v, want %d tokens", test.input, tokens, len(test.kinds))
+			continue
+		}
+		for i, token := range tokens {
+			if token.kind != test.kinds[i] || token.text != test.texts[i] {
+				t.Errorf("lex(%q) token %d = %s %q, want %s %q", test.input, i, token.kind, token.text, test.kinds[i], test.texts[i])
+			}
+		}
+	}
+}
+
+func TestLexErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{`{app="42`, "unterminated string at 5"},
+		{"|~ `abc", "unterminated string at 3"},
+		{`|= "\q"`, "invalid string at 3"},
+		{`{app#1}`, `unexpected '#' at 4`},
+		{`| count ; top`, `unexpected ';' at 8`},
+		{`{app§}`, `unexpected '§' at 4`},
+	}
+	for _, test := range tests {
+		_, err := lex(test.input)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("lex(%q) error = %v, want %q", test.input, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,451 @@
+// Package query implements the loggy pipeline query language.
+//
+// A query selects messages by their labels and passes them through stages:
+//
+//	{app="42/sh.loggy", level>=WARN, android_os_version="12"} |= "timeout" | json | count by tag | top 5
+//
+// The selector in braces matches labels: app, device, session, level, trace,
+// span and the details of the device the message came from. Stages are
+//
+//	|= "text"  != "text"  |~ `regexp`  !~ `regexp`   keep lines that contain or match, or not
+//	| match "query"                                   full text search, in bleve query string syntax
+//	| json                                            parse the message as a JSON object into fields
+//	| filter field op value                           keep messages whose label or field compares
+//	| bucket 5m                                       group the counts that follow by time
+//	| count [by label, ...]                           count messages
+//	| top N                                           keep the N largest counts
+//
+// Label comparisons are =, !=, =~ and !~, and >, >=, < and <= for numbers
+// and levels.
+package query
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/loggysh/loggy/service"
+)
+
+// Op is a comparison operator.
+type Op int
+
+const (
+	Eq Op = iota
+	Neq
+	Re
+	Nre
+	Gt
+	Gte
+	Lt
+	Lte
+)
+
+var opTokens = map[tokenKind]Op{
+	tokenEq:  Eq,
+	tokenNeq: Neq,
+	tokenRe:  Re,
+	tokenNre: Nre,
+	tokenGt:  Gt,
+	tokenGte: Gte,
+	tokenLt:  Lt,
+	tokenLte: Lte,
+}
+
+var opNames = []string{"=", "!=", "=~", "!~", ">", ">=", "<", "<="}
+
+func (op Op) String() string {
+	return opNames[op]
+}
+
+func (op Op) ordered() bool {
+	return op >= Gt
+}
+
+// Matcher compares a label or field with a value.
+type Matcher struct {
+	Label string
+	Op    Op
+	Value string
+
+	re     *regexp.Regexp
+	number float64
+}
+
+func (m *Matcher) String() string {
+	return fmt.Sprintf("%s%s%q", m.Label, m.Op, m.Value)
+}
+
+func newMatcher(label string, op Op, value string) (*Matcher, error) {
+	m := &Matcher{Label: label, Op: op, Value: value}
+	switch {
+	case op == Re || op == Nre:
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid regexp for %s: %v", label, err)
+		}
+		m.re = re
+	case label == LabelLevel:
+		level, ok := parseLevel(value)
+		if !ok {
+			return nil, fmt.Errorf("unknown level %s", value)
+		}
+		m.number = float64(level)
+	case op.ordered():
+		number, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s %s needs a number, not %s", label, op, value)
+		}
+		m.number = number
+	}
+	return m, nil
+}
+
+func parseLevel(value string) (service.LogLevel, bool) {
+	for level := service.DEBUG; level <= service.CRASH; level++ {
+		if strings.EqualFold(level.String(), value) || strconv.Itoa(int(level)) == value {
+			return level, true
+		}
+	}
+	return 0, false
+}
+
+// Stage is one step of the pipeline.
+type Stage interface {
+	String() string
+}
+
+// LineFilter keeps messages whose text contains or matches Text, or with
+// Neq and Nre, the ones that don't.
+type LineFilter struct {
+	Op   Op
+	Text string
+
+	re *regexp.Regexp
+}
+
+func (f *LineFilter) String() string {
+	switch f.Op {
+	case Eq:
+		return fmt.Sprintf("|= %q", f.Text)
+	case Re:
+		return fmt.Sprintf("|~ %q", f.Text)
+	}
+	return fmt.Sprintf("%s %q", f.Op, f.Text)
+}
+
+// Match is a full text search of the index.
+type Match struct {
+	Query string
+}
+
+func (m *Match) String() string {
+	return fmt.Sprintf("| match %q", m.Query)
+}
+
+// JSON parses messages as JSON objects into fields.
+type JSON struct{}
+
+func (JSON) String() string {
+	return "| json"
+}
+
+// Filter keeps messages whose label or field matches.
+type Filter struct {
+	*Matcher
+}
+
+func (f *Filter) String() string {
+	return "| filter " + f.Matcher.String()
+}
+
+// Bucket groups the counts of the pipeline by time.
+type Bucket struct {
+	Width time.Duration
+}
+
+func (b *Bucket) String() string {
+	return fmt.Sprintf("| bucket %s", b.Width)
+}
+
+// Count counts messages grouped by labels.
+type Count struct {
+	By []string
+}
+
+func (c *Count) String() string {
+	if len(c.By) == 0 {
+		return "| count"
+	}
+	return "| count by " + strings.Join(c.By, ", ")
+}
+
+// Top keeps the N largest counts, per bucket when the counts are bucketed.
+type Top struct {
+	N int
+}
+
+func (t *Top) String() string {
+	return fmt.Sprintf("| top %d", t.N)
+}
+
+// Query is a parsed query.
+type Query struct {
+	Selector []*Matcher
+	Stages   []Stage
+}
+
+func (q *Query) String() string {
+	var b strings.Builder
+	b.WriteString("{")
+	for i, m := range q.Selector {
+		if i > 0 {
+			b.WriteString(", ")
+		}
+		b.WriteString(m.String())
+	}
+	b.WriteString("}")
+	for _, stage := range q.Stages {
+		b.WriteString(" ")
+		b.WriteString(stage.String())
+	}
+	return b.String()
+}
+
+// count returns the count stage, if any.
+func (q *Query) count() *Count {
+	for _, stage := range q.Stages {
+		if count, ok := stage.(*Count); ok {
+			return count
+		}
+	}
+	return nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) expect(kind tokenKind) (token, error) {
+	t := p.next()
+	if t.kind != kind {
+		return t, fmt.Errorf("expected %s at %d, found %s", kind, t.pos, t)
+	}
+	return t, nil
+}
+
+// Parse parses a query.
+func Parse(input string) (*Query, error) {
+	tokens, err := lex(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	q := &Query{}
+
+	if p.peek().kind == tokenLBrace {
+		if q.Selector, err = p.selector(); err != nil {
+			return nil, err
+		}
+	}
+	for p.peek().kind != tokenEOF {
+		stage, err := p.stage()
+		if err != nil {
+			return nil, err
+		}
+		q.Stages = append(q.Stages, stage)
+	}
+	if err := q.validate(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (p *parser) selector() ([]*Matcher, error) {
+	p.next()
+	var matchers []*Matcher
+	if p.peek().kind == tokenRBrace {
+		p.next()
+		return matchers, nil
+	}
+	for {
+		m, err := p.matcher()
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+
+		t := p.next()
+		switch t.kind {
+		case tokenComma:
+		case tokenRBrace:
+			return matchers, nil
+		default:
+			return nil, fmt.Errorf("expected , or } at %d, found %s", t.pos, t)
+		}
+	}
+}
+
+func (p *parser) matcher() (*Matcher, error) {
+	label, err := p.expect(tokenIdent)
+	if err != nil {
+		return nil, err
+	}
+	t := p.next()
+	op, ok := opTokens[t.kind]
+	if !ok {
+		return nil, fmt.Errorf("expected comparison after %s at %d, found %s", label.text, t.pos, t)
+	}
+	value := p.next()
+	switch value.kind {
+	case tokenString, tokenNumber, tokenIdent:
+	default:
+		return nil, fmt.Errorf("expected value at %d, found %s", value.pos, value)
+	}
+	return newMatcher(label.text, op, value.text)
+}
+
+func (p *parser) stage() (Stage, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenPipeEq, tokenNeq, tokenPipeRe, tokenNre:
+		text, err := p.expect(tokenString)
+		if err != nil {
+			return nil, err
+		}
+		f := &LineFilter{Text: text.text}
+		switch t.kind {
+		case tokenPipeEq:
+			f.Op = Eq
+		case tokenNeq:
+			f.Op = Neq
+		case tokenPipeRe:
+			f.Op = Re
+		case tokenNre:
+			f.Op = Nre
+		}
+		if f.Op == Re || f.Op == Nre {
+			if f.re, err = regexp.Compile(f.Text); err != nil {
+				return nil, fmt.Errorf("invalid regexp at %d: %v", text.pos, err)
+			}
+		}
+		return f, nil
+	case tokenPipe:
+	default:
+		return nil, fmt.Errorf("expected stage at %d, found %s", t.pos, t)
+	}
+
+	name, err := p.expect(tokenIdent)
+	if err != nil {
+		return nil, err
+	}
+	switch name.text {
+	case "match":
+		text, err := p.expect(tokenString)
+		if err != nil {
+			return nil, err
+		}
+		return &Match{Query: text.text}, nil
+
+	case "json":
+		return JSON{}, nil
+
+	case "filter":
+		m, err := p.matcher()
+		if err != nil {
+			return nil, err
+		}
+		return &Filter{m}, nil
+
+	case "bucket":
+		width, err := p.expect(tokenNumber)
+		if err != nil {
+			return nil, err
+		}
+		d, err := time.ParseDuration(width.text)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid bucket width %s", width.text)
+		}
+		return &Bucket{Width: d}, nil
+
+	case "count":
+		count := &Count{}
+		if p.peek().kind == tokenIdent && p.peek().text == "by" {
+			p.next()
+			for {
+				label, err := p.expect(tokenIdent)
+				if err != nil {
+					return nil, err
+				}
+				count.By = append(count.By, label.text)
+				if p.peek().kind != tokenComma {
+					break
+				}
+				p.next()
+			}
+		}
+		return count, nil
+
+	case "top":
+		n, err := p.expect(tokenNumber)
+		if err != nil {
+			return nil, err
+		}
+		top, err := strconv.Atoi(n.text)
+		if err != nil || top <= 0 {
+			return nil, fmt.Errorf("invalid top %s", n.text)
+		}
+		return &Top{N: top}, nil
+	}
+	return nil, fmt.Errorf("unknown stage %s at %d", name.text, name.pos)
+}
+
+// validate checks the order of stages. Only top can follow count, and top
+// and bucket need a count to work on.
+func (q *Query) validate() error {
+	var counted, bucketed bool
+	for _, stage := range q.Stages {
+		switch stage.(type) {
+		case *Count:
+			if counted {
+				return fmt.Errorf("only one count per query")
+			}
+			counted = true
+		case *Top:
+			if !counted {
+				return fmt.Errorf("top needs a count before it")
+			}
+		case *Bucket:
+			if bucketed {
+				return fmt.Errorf("only one bucket per query")
+			}
+			bucketed = true
+			if counted {
+				return fmt.Errorf("bucket has to come before count")
+			}
+		default:
+			if counted {
+				return fmt.Errorf("%s cannot follow count", stage)
+			}
+		}
+	}
+	if bucketed && !counted {
+		return fmt.Errorf("bucket needs a count after it")
+	}
+	return nil
+}
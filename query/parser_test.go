@@ -0,0 +1,98 @@
+package query
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		input string
+		// queries print back in a normal form
+		want string
+	}{
+		{"", "{}"},
+		{"{}", "{}"},
+		{
+			`{app="42/sh.loggy", level>=WARN, android_os_version="12"} |= "timeout" | json | count by tag | top 5`,
+			`{app="42/sh.loggy", level>="WARN", android_os_version="12"} |= "timeout" | json | count by tag | top 5`,
+		},
+		{"{session=3}", `{session="3"}`},
+		{"{level=2}", `{level="2"}`},
+		{`!= "debug" |~ "err(or)?" !~ ` + "`^x`", `{} != "debug" |~ "err(or)?" !~ "^x"`},
+		{`| match "msg:time*"`, `{} | match "msg:time*"`},
+		{"| filter status>=500", `{} | filter status>="500"`},
+		{"| bucket 5m | count", "{} | bucket 5m0s | count"},
+		{"| count by app, device", "{} | count by app, device"},
+	}
+	for _, test := range tests {
+		q, err := Parse(test.input)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", test.input, err)
+			continue
+		}
+		if got := q.String(); got != test.want {
+			t.Errorf("Parse(%q) = %s, want %s", test.input, got, test.want)
+		}
+	}
+}
+
+func TestParseStages(t *testing.T) {
+	q, err := Parse(`{level>ERROR} |~ "a+" | bucket 1h | count by tag | top 2`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(q.Selector) != 1 || q.Selector[0].Op != Gt || q.Selector[0].number != 3 {
+		t.Errorf("selector = %v, want level > 3", q.Selector)
+	}
+	filter, ok := q.Stages[0].(*LineFilter)
+	if !ok || filter.Op != Re || filter.re == nil || !filter.re.MatchString("baac") {
+		t.Errorf("stage 0 = %v, want a compiled regexp filter", q.Stages[0])
+	}
+	if bucket, ok := q.Stages[1].(*Bucket); !ok || bucket.Width != time.Hour {
+		t.Errorf("stage 1 = %v, want bucket 1h", q.Stages[1])
+	}
+	if count := q.count(); count == nil || len(count.By) != 1 || count.By[0] != "tag" {
+		t.Errorf("count = %v, want count by tag", count)
+	}
+	if top, ok := q.Stages[3].(*Top); !ok || top.N != 2 {
+		t.Errorf("stage 3 = %v, want top 2", q.Stages[3])
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		input string
+		err   string
+	}{
+		{`{app="a"`, "expected , or } at 8, found end of query"},
+		{`{app "a"}`, `expected comparison after app at 5, found "a"`},
+		{`{="a"}`, `expected name at 1, found "="`},
+		{`{app=}`, `expected value at 5, found "}"`},
+		{`{level=LOUD}`, "unknown level LOUD"},
+		{`{n>big}`, "n > needs a number, not big"},
+		{"{tag=~`(`}", "invalid regexp for tag"},
+		{`|~ "("`, "invalid regexp at 3"},
+		{`|= timeout`, `expected string at 3, found "timeout"`},
+		{`json`, `expected stage at 0, found "json"`},
+		{`| sort`, "unknown stage sort at 2"},
+		{`| match timeout`, `expected string at 8, found "timeout"`},
+		{`| bucket 0s | count`, "invalid bucket width 0s"},
+		{`| bucket fast | count`, `expected number at 9, found "fast"`},
+		{`| count | top 0`, "invalid top 0"},
+		{`| count by`, "expected name at 10, found end of query"},
+		{`| top 3`, "top needs a count before it"},
+		{`| count | count`, "only one count per query"},
+		{`| count | json`, "| json cannot follow count"},
+		{`| bucket 1m | bucket 1m | count`, "only one bucket per query"},
+		{`| count | bucket 1m`, "bucket has to come before count"},
+		{`| bucket 1m`, "bucket needs a count after it"},
+	}
+	for _, test := range tests {
+		_, err := Parse(test.input)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("Parse(%q) error = %v, want %q", test.input, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/loggysh/loggy/service"
+)
+
+// Labels every message has. Any other label is looked up in the fields
+// parsed by json and then in the details of the device.
+const (
+	LabelApp     = "app"
+	LabelDevice  = "device"
+	LabelSession = "session"
+	LabelLevel   = "level"
+	LabelMsg     = "msg"
+	LabelTrace   = "trace"
+	LabelSpan    = "span"
+)
+
+// Record is a message passing through the pipeline.
+type Record struct {
+	service.Message
+	AppID    string
+	DeviceID string
+	Details  string
+
+	// Fields are set by the json stage
+	Fields     map[string]string `gorm:"-"`
+	attributes map[string]string
+	bucket     time.Time
+}
+
+// Label returns the value of a label of the record.
+func (r *Record) Label(name string) (string, bool) {
+	switch name {
+	case LabelApp:
+		return r.AppID, true
+	case LabelDevice:
+		return r.DeviceID, true
+	case LabelSession:
+		return strconv.Itoa(int(r.SessionID)), true
+	case LabelLevel:
+		return r.Level.String(), true
+	case LabelMsg:
+		return r.Msg, true
+	case LabelTrace:
+		return r.TraceID, true
+	case LabelSpan:
+		return r.SpanID, true
+	}
+	if value, ok := r.Fields[name]; ok {
+		return value, true
+	}
+	if r.attributes == nil {
+		r.attributes = service.DeviceAttributes(r.Details)
+	}
+	value, ok := r.attributes[name]
+	return value, ok
+}
+
+// Matches reports whether the label of the record compares to the matcher.
+// Missing labels only match != and !~.
+func (m *Matcher) Matches(r *Record) bool {
+	value, ok := r.Label(m.Label)
+	if !ok {
+		return m.Op == Neq || m.Op == Nre
+	}
+	switch m.Op {
+	case Re:
+		return m.re.MatchString(value)
+	case Nre:
+		return !m.re.MatchString(value)
+	}
+
+	if m.Label == LabelLevel {
+		return compare(float64(r.Level), m.Op, m.number)
+	}
+	if m.Op.ordered() {
+		number, err := strconv.ParseFloat(value, 64)
+		return err == nil && compare(number, m.Op, m.number)
+	}
+	if m.Op == Eq {
+		return value == m.Value
+	}
+	return value != m.Value
+}
+
+func compare(a float64, op Op, b float64) bool {
+	switch op {
+	case Eq:
+		return a == b
+	case Neq:
+		return a != b
+	case Gt:
+		return a > b
+	case Gte:
+		return a >= b
+	case Lt:
+		return a < b
+	case Lte:
+		return a <= b
+	}
+	return false
+}
+
+func (f *LineFilter) keep(r *Record) bool {
+	switch f.Op {
+	case Eq:
+		return strings.Contains(r.Msg, f.Text)
+	case Neq:
+		return !strings.Contains(r.Msg, f.Text)
+	case Re:
+		return f.re.MatchString(r.Msg)
+	}
+	return !f.re.MatchString(r.Msg)
+}
+
+// parseJSON sets the fields of a record from its message. Nested objects
+// are flattened with dots, messages that are not JSON objects get no
+// fields.
+func parseJSON(r *Record) {
+	var object map[string]interface{}
+	if err := json.Unmarshal([]byte(r.Msg), &object); err != nil {
+		return
+	}
+	if r.Fields == nil {
+		r.Fields = make(map[string]string)
+	}
+	flatten(r.Fields, "", object)
+}
+
+func flatten(fields map[string]string, prefix string, object map[string]interface{}) {
+	for key, value := range object {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			flatten(fields, prefix+key+".", v)
+		case nil:
+		case string:
+			fields[prefix+key] = v
+		default:
+			data, _ := json.Marshal(v)
+			fields[prefix+key] = string(data)
+		}
+	}
+}
+
+// Row is a count of the pipeline.
+type Row struct {
+	Labels map[string]string
+	Bucket time.Time
+	Count  int64
+}
+
+// Pipeline runs the stages of a plan that are left after the sources did
+// their part. Records are pushed into it one at a time.
+type Pipeline struct {
+	matchers []*Matcher
+	stages   []Stage
+	count    *Count
+	top      *Top
+	limit    int
+
+	records []*Record
+	rows    map[string]*Row
+}
+
+// Push runs a record through the pipeline. It returns false once the
+// pipeline needs no more records.
+func (p *Pipeline) Push(r *Record) bool {
+	for _, m := range p.matchers {
+		if !m.Matches(r) {
+			return true
+		}
+	}
+	for _, stage := range p.stages {
+		switch s := stage.(type) {
+		case *LineFilter:
+			if !s.keep(r) {
+				return true
+			}
+		case *Filter:
+			if !s.Matches(r) {
+				return true
+			}
+		case JSON:
+			parseJSON(r)
+		case *Bucket:
+			r.bucket = r.Timestamp.UTC().Truncate(s.Width)
+		}
+	}
+
+	if p.count == nil {
+		p.records = append(p.records, r)
+		return len(p.records) < p.limit
+	}
+	labels := make(map[string]string, len(p.count.By))
+	var key strings.Builder
+	fmt.Fprintf(&key, "%d", r.bucket.UnixNano())
+	for _, name := range p.count.By {
+		value, _ := r.Label(name)
+		labels[name] = value
+		fmt.Fprintf(&key, "\x00%s", value)
+	}
+	row, ok := p.rows[key.String()]
+	if !ok {
+		row = &Row{Labels: labels, Bucket: r.bucket}
+		p.rows[key.String()] = row
+	}
+	row.Count++
+	return true
+}
+
+// Records returns the records that passed the pipeline, when it does not
+// count.
+func (p *Pipeline) Records() []*Record {
+	return p.records
+}
+
+// Rows returns the counts ordered by bucket and then by count, largest
+// first.
+func (p *Pipeline) Rows() []*Row {
+	if p.count == nil {
+		return nil
+	}
+	rows := make([]*Row, 0, len(p.rows))
+	for _, row := range p.rows {
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		if !rows[i].Bucket.Equal(rows[j].Bucket) {
+			return rows[i].Bucket.Before(rows[j].Bucket)
+		}
+		if rows[i].Count != rows[j].Count {
+			return rows[i].Count > rows[j].Count
+		}
+		return fmt.Sprint(rows[i].Labels) < fmt.Sprint(rows[j].Labels)
+	})
+	if p.top == nil {
+		return rows
+	}
+
+	kept := rows[:0]
+	var n int
+	for i, row := range rows {
+		if i > 0 && !row.Bucket.Equal(rows[i-1].Bucket) {
+			n = 0
+		}
+		if n < p.top.N {
+			kept = append(kept, row)
+		}
+		n++
+	}
+	return kept
+}
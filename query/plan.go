@@ -0,0 +1,295 @@
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	bleveq "github.com/blevesearch/bleve/v2/search/query"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+// columns of the labels that can be compared in SQL
+var labelColumns = map[string]string{
+	LabelApp:     "sessions.application_id",
+	LabelDevice:  "sessions.device_id",
+	LabelSession: "messages.session_id",
+	LabelLevel:   "messages.level",
+	LabelTrace:   "messages.trace_id",
+	LabelSpan:    "messages.span_id",
+}
+
+// index fields of the labels, other labels are device attributes
+var labelFields = map[string]string{
+	LabelApp:     "app_id",
+	LabelDevice:  "device_id",
+	LabelSession: "session_id",
+	LabelTrace:   "trace_id",
+	LabelSpan:    "span_id",
+}
+
+var sqlOps = map[Op]string{Eq: "=", Neq: "<>", Gt: ">", Gte: ">=", Lt: "<", Lte: "<="}
+
+// Plan is how a query runs. Messages come from the database, or from the
+// index when the query searches text. Whatever the source cannot filter is
+// left to the pipeline.
+type Plan struct {
+	UseIndex bool
+
+	query  *Query
+	userID string
+	start  time.Time
+	end    time.Time
+
+	// conditions of the source
+	conditions []string
+	args       []interface{}
+	index      []bleveq.Query
+	// matchers of the selector the source cannot check
+	residual []*Matcher
+}
+
+// Plan plans the query for the messages of userID between start and end.
+// Zero times leave that end open.
+func (q *Query) Plan(userID string, start, end time.Time) *Plan {
+	p := &Plan{query: q, userID: userID, start: start, end: end}
+	for _, stage := range q.Stages {
+		if _, ok := stage.(*Match); ok {
+			p.UseIndex = true
+		}
+	}
+
+	if p.UseIndex {
+		p.planIndex()
+	} else {
+		p.planSQL()
+	}
+	return p
+}
+
+func (p *Plan) where(condition string, args ...interface{}) {
+	p.conditions = append(p.conditions, condition)
+	p.args = append(p.args, args...)
+}
+
+func (p *Plan) planSQL() {
+	p.where("applications.user_id = ?", p.userID)
+	if !p.start.IsZero() {
+		p.where("messages.timestamp >= ?", p.start)
+	}
+	if !p.end.IsZero() {
+		p.where("messages.timestamp < ?", p.end)
+	}
+
+	for _, m := range p.query.Selector {
+		column, ok := labelColumns[m.Label]
+		op, comparable := sqlOps[m.Op]
+		if !ok || !comparable {
+			p.residual = append(p.residual, m)
+			continue
+		}
+		switch m.Label {
+		case LabelLevel:
+			p.where(column+" "+op+" ?", int(m.number))
+		case LabelDevice:
+			// device ids are uuid columns, which cannot be compared to
+			// other values in PostgreSQL
+			if _, err := uuid.FromString(m.Value); err != nil {
+				p.residual = append(p.residual, m)
+				continue
+			}
+			p.where(column+" "+op+" ?", m.Value)
+		case LabelSession:
+			session, err := strconv.Atoi(m.Value)
+			if err != nil {
+				p.residual = append(p.residual, m)
+				continue
+			}
+			p.where(column+" "+op+" ?", session)
+		default:
+			if m.Op.ordered() {
+				p.residual = append(p.residual, m)
+				continue
+			}
+			p.where(column+" "+op+" ?", m.Value)
+		}
+	}
+
+	// LIKE ignores case in SQLite, so it only narrows the messages down and
+	// the pipeline still checks them
+	for _, stage := range p.query.Stages {
+		if f, ok := stage.(*LineFilter); ok && f.Op == Eq {
+			p.where(`messages.msg LIKE ? ESCAPE '\'`, "%"+escapeLike(f.Text)+"%")
+		}
+	}
+}
+
+func escapeLike(text string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(text)
+}
+
+func termQuery(field, term string) bleveq.Query {
+	q := bleve.NewTermQuery(term)
+	q.SetField(field)
+	return q
+}
+
+func not(q bleveq.Query) bleveq.Query {
+	b := bleve.NewBooleanQuery()
+	b.AddMustNot(q)
+	return b
+}
+
+func (p *Plan) planIndex() {
+	p.index = append(p.index, termQuery("user_id", p.userID))
+	if !p.start.IsZero() || !p.end.IsZero() {
+		timestamps := bleve.NewDateRangeQuery(p.start, p.end)
+		timestamps.SetField("timestamp")
+		p.index = append(p.index, timestamps)
+	}
+
+	for _, m := range p.query.Selector {
+		q := p.indexMatcher(m)
+		if q == nil {
+			p.residual = append(p.residual, m)
+			continue
+		}
+		p.index = append(p.index, q)
+	}
+	for _, stage := range p.query.Stages {
+		if match, ok := stage.(*Match); ok {
+			p.index = append(p.index, bleve.NewQueryStringQuery(match.Query))
+		}
+	}
+}
+
+// indexMatcher returns the index query of a matcher, or nil when the index
+// cannot answer it.
+func (p *Plan) indexMatcher(m *Matcher) bleveq.Query {
+	if m.Label == LabelLevel {
+		if m.Op == Re || m.Op == Nre {
+			return nil
+		}
+		min, max := m.number, m.number
+		minInclusive, maxInclusive := true, true
+		var q *bleveq.NumericRangeQuery
+		switch m.Op {
+		case Gt:
+			minInclusive = false
+			q = bleve.NewNumericRangeInclusiveQuery(&min, nil, &minInclusive, nil)
+		case Gte:
+			q = bleve.NewNumericRangeInclusiveQuery(&min, nil, &minInclusive, nil)
+		case Lt:
+			maxInclusive = false
+			q = bleve.NewNumericRangeInclusiveQuery(nil, &max, nil, &maxInclusive)
+		case Lte:
+			q = bleve.NewNumericRangeInclusiveQuery(nil, &max, nil, &maxInclusive)
+		default:
+			q = bleve.NewNumericRangeInclusiveQuery(&min, &max, &minInclusive, &maxInclusive)
+		}
+		q.SetField("severity")
+		if m.Op == Neq {
+			return not(q)
+		}
+		return q
+	}
+	if m.Op.ordered() || m.Label == LabelMsg {
+		return nil
+	}
+
+	field, ok := labelFields[m.Label]
+	if !ok {
+		field = "attributes." + m.Label
+	}
+	var q bleveq.Query
+	if m.Op == Re || m.Op == Nre {
+		re := bleve.NewRegexpQuery(m.Value)
+		re.SetField(field)
+		q = re
+	} else {
+		q = termQuery(field, m.Value)
+	}
+	if m.Op == Neq || m.Op == Nre {
+		return not(q)
+	}
+	return q
+}
+
+// Records selects the messages of the user as Records, with the columns the
+// pipeline needs.
+func Records(db *gorm.DB) *gorm.DB {
+	return db.Table("messages").
+		Select("messages.*, sessions.application_id AS app_id, sessions.device_id AS device_id, COALESCE(devices.details, '') AS details").
+		Joins("JOIN sessions ON sessions.id = messages.session_id").
+		Joins("JOIN applications ON applications.id = sessions.application_id").
+		Joins("LEFT JOIN devices ON devices.id = sessions.device_id")
+}
+
+// SQL selects the messages of a plan from the database.
+func (p *Plan) SQL(db *gorm.DB) *gorm.DB {
+	tx := Records(db)
+	if len(p.conditions) != 0 {
+		tx = tx.Where(strings.Join(p.conditions, " AND "), p.args...)
+	}
+	return tx
+}
+
+// IndexQuery is the index query of a plan that uses the index.
+func (p *Plan) IndexQuery() bleveq.Query {
+	return bleve.NewConjunctionQuery(p.index...)
+}
+
+// Counts reports whether the query counts messages instead of returning
+// them.
+func (p *Plan) Counts() bool {
+	return p.query.count() != nil
+}
+
+// Pipeline returns a pipeline for the part of the query the source leaves
+// over. Without a count it keeps the first limit records.
+func (p *Plan) Pipeline(limit int) *Pipeline {
+	pipeline := &Pipeline{
+		matchers: p.residual,
+		count:    p.query.count(),
+		limit:    limit,
+		rows:     make(map[string]*Row),
+	}
+	for _, stage := range p.query.Stages {
+		switch s := stage.(type) {
+		case *Match, *Count:
+		case *Top:
+			pipeline.top = s
+		default:
+			pipeline.stages = append(pipeline.stages, s)
+		}
+	}
+	return pipeline
+}
+
+// String explains the plan.
+func (p *Plan) String() string {
+	var b strings.Builder
+	if p.UseIndex {
+		fmt.Fprintf(&b, "index: %d conditions", len(p.index))
+		for _, stage := range p.query.Stages {
+			if match, ok := stage.(*Match); ok {
+				fmt.Fprintf(&b, ", match %q", match.Query)
+			}
+		}
+	} else {
+		fmt.Fprintf(&b, "database: %s", strings.Join(p.conditions, " AND "))
+	}
+	b.WriteString("\npipeline:")
+	for _, m := range p.residual {
+		fmt.Fprintf(&b, " {%s}", m)
+	}
+	for _, stage := range p.query.Stages {
+		if _, ok := stage.(*Match); !ok {
+			fmt.Fprintf(&b, " %s", stage)
+		}
+	}
+	return b.String()
+}
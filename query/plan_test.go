@@ -0,0 +1,171 @@
+package query
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	bleveq "github.com/blevesearch/bleve/v2/search/query"
+)
+
+const planDevice = "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+
+func TestPlanSQL(t *testing.T) {
+	tests := []struct {
+		query      string
+		conditions []string
+		args       []interface{}
+		residual   []string
+	}{
+		{
+			query:      "",
+			conditions: []string{"applications.user_id = ?"},
+			args:       []interface{}{"u"},
+		},
+		{
+			query:      `{app="a", level>=WARN, session=3, device="` + planDevice + `", trace!="t"}`,
+			conditions: []string{"applications.user_id = ?", "sessions.application_id = ?", "messages.level >= ?", "messages.session_id = ?", "sessions.device_id = ?", "messages.trace_id <> ?"},
+			args:       []interface{}{"u", "a", 2, 3, planDevice, "t"},
+		},
+		{
+			// regexps, ordered comparisons of strings, values the
+			// columns cannot hold and device details are left over
+			query:      "{app=~`a.*`, trace>3, device=\"phone\", session=\"x\", os=\"12\"}",
+			conditions: []string{"applications.user_id = ?"},
+			args:       []interface{}{"u"},
+			residual:   []string{`app=~"a.*"`, `trace>"3"`, `device="phone"`, `session="x"`, `os="12"`},
+		},
+		{
+			// only contains filters narrow the query, the rest is left to
+			// the pipeline
+			query:      `|= "50%_done" != "debug" |~ "x+"`,
+			conditions: []string{"applications.user_id = ?", `messages.msg LIKE ? ESCAPE '\'`},
+			args:       []interface{}{"u", `%50\%\_done%`},
+		},
+	}
+	for _, test := range tests {
+		q, err := Parse(test.query)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", test.query, err)
+		}
+		p := q.Plan("u", time.Time{}, time.Time{})
+		if p.UseIndex {
+			t.Errorf("Plan(%q) uses the index", test.query)
+		}
+		if !reflect.DeepEqual(p.conditions, test.conditions) {
+			t.Errorf("Plan(%q) conditions = %q, want %q", test.query, p.conditions, test.conditions)
+		}
+		if !reflect.DeepEqual(p.args, test.args) {
+			t.Errorf("Plan(%q) args = %v, want %v", test.query, p.args, test.args)
+		}
+		if got := matcherStrings(p.residual); !reflect.DeepEqual(got, test.residual) {
+			t.Errorf("Plan(%q) residual = %q, want %q", test.query, got, test.residual)
+		}
+	}
+}
+
+func TestPlanSQLTimeRange(t *testing.T) {
+	start := time.Date(2021, 9, 1, 0, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	q, err := Parse("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := q.Plan("u", start, end)
+	want := []string{"applications.user_id = ?", "messages.timestamp >= ?", "messages.timestamp < ?"}
+	if !reflect.DeepEqual(p.conditions, want) {
+		t.Errorf("conditions = %q, want %q", p.conditions, want)
+	}
+	if !reflect.DeepEqual(p.args, []interface{}{"u", start, end}) {
+		t.Errorf("args = %v, want u, %s, %s", p.args, start, end)
+	}
+
+	p = q.Plan("u", start, time.Time{})
+	if len(p.conditions) != 2 || p.conditions[1] != "messages.timestamp >= ?" {
+		t.Errorf("open ended conditions = %q", p.conditions)
+	}
+}
+
+func TestPlanIndex(t *testing.T) {
+	tests := []struct {
+		query    string
+		start    time.Time
+		index    int
+		residual []string
+	}{
+		{
+			// the user
+			query: `| match "timeout"`,
+			index: 2,
+		},
+		{
+			query: `| match "timeout"`,
+			start: time.Date(2021, 9, 1, 0, 0, 0, 0, time.UTC),
+			index: 3,
+		},
+		{
+			// every comparison of levels, term and regexp matches of
+			// labels and device details
+			query: "{level>WARN, level<=ERROR, level!=INFO, app=\"a\", device!=\"d\", os=~`1.*`, tag!~`x`} | match \"a\" | match \"b\"",
+			index: 10,
+		},
+		{
+			query:    "{level=~`W.*`, n>3, msg=\"x\"} | match \"a\"",
+			index:    2,
+			residual: []string{`level=~"W.*"`, `n>"3"`, `msg="x"`},
+		},
+	}
+	for _, test := range tests {
+		q, err := Parse(test.query)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", test.query, err)
+		}
+		p := q.Plan("u", test.start, time.Time{})
+		if !p.UseIndex {
+			t.Errorf("Plan(%q) does not use the index", test.query)
+		}
+		if len(p.index) != test.index {
+			t.Errorf("Plan(%q) has %d index queries, want %d", test.query, len(p.index), test.index)
+		}
+		if got := matcherStrings(p.residual); !reflect.DeepEqual(got, test.residual) {
+			t.Errorf("Plan(%q) residual = %q, want %q", test.query, got, test.residual)
+		}
+		if err := p.IndexQuery().(bleveq.ValidatableQuery).Validate(); err != nil {
+			t.Errorf("Plan(%q) index query: %v", test.query, err)
+		}
+	}
+}
+
+func TestPlanPipeline(t *testing.T) {
+	q, err := Parse(`{n>3} |= "a" | match "b" | json | count by tag | top 3`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := q.Plan("u", time.Time{}, time.Time{})
+	if !p.Counts() {
+		t.Error("plan does not count")
+	}
+	pipeline := p.Pipeline(10)
+	var stages []string
+	for _, stage := range pipeline.stages {
+		stages = append(stages, stage.String())
+	}
+	if want := []string{`|= "a"`, "| json"}; !reflect.DeepEqual(stages, want) {
+		t.Errorf("pipeline stages = %q, want %q", stages, want)
+	}
+	if pipeline.top == nil || pipeline.top.N != 3 {
+		t.Errorf("pipeline top = %v, want top 3", pipeline.top)
+	}
+	if explained := p.String(); !strings.Contains(explained, `match "b"`) || !strings.Contains(explained, `{n>"3"}`) {
+		t.Errorf("plan explains itself as %q", explained)
+	}
+}
+
+func matcherStrings(matchers []*Matcher) []string {
+	var s []string
+	for _, m := range matchers {
+		s = append(s, m.String())
+	}
+	return s
+}
@@ -0,0 +1,53 @@
+package query
+
+import (
+	"gorm.io/gorm"
+)
+
+// Source loads the records that queries and traces read.
+type Source interface {
+	// Scan lists up to limit records of a plan with ids below beforeID,
+	// newest first. A negative beforeID starts at the newest record.
+	Scan(plan *Plan, beforeID, limit int) ([]*Record, error)
+	// Records loads records by id, in no particular order. Ids without a
+	// record are left out.
+	Records(ids []int) ([]*Record, error)
+	// Trace lists up to limit records of a trace from the applications of
+	// a user, in time order.
+	Trace(userID, traceID string, limit int) ([]*Record, error)
+}
+
+// GormSource is a Source on a gorm database.
+type GormSource struct {
+	db *gorm.DB
+}
+
+func NewGormSource(db *gorm.DB) *GormSource {
+	return &GormSource{db: db}
+}
+
+func (s *GormSource) Scan(plan *Plan, beforeID, limit int) ([]*Record, error) {
+	tx := plan.SQL(s.db)
+	if beforeID >= 0 {
+		tx = tx.Where("messages.id < ?", beforeID)
+	}
+	var records []*Record
+	err := tx.Order("messages.id DESC").Limit(limit).Scan(&records).Error
+	return records, err
+}
+
+func (s *GormSource) Records(ids []int) ([]*Record, error) {
+	var records []*Record
+	err := Records(s.db).Where("messages.id IN ?", ids).Scan(&records).Error
+	return records, err
+}
+
+func (s *GormSource) Trace(userID, traceID string, limit int) ([]*Record, error) {
+	var records []*Record
+	err := Records(s.db).
+		Where("messages.trace_id = ? AND applications.user_id = ?", traceID, userID).
+		Order("messages.timestamp, messages.id").
+		Limit(limit).
+		Scan(&records).Error
+	return records, err
+}
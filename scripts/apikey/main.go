@@ -91,8 +91,8 @@ func main() {
 
 	fmt.Printf("Device ID: %s\n", device.Id)
 
-	deviceList, err := client.ListDevices(ctx, &pb.ApplicationId{
-		Id: app.Id,
+	deviceList, err := client.ListDevices(ctx, &pb.ListDevicesRequest{
+		Appid: app.Id,
 	})
 	if err != nil {
 		log.Fatalf("failed to get device list: %s", err)
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	pb "github.com/loggysh/loggy/loggy"
+)
+
+func main() {
+	sessionid := flag.Int("sessionid", -1, "required Session id")
+	format := flag.String("format", "ndjson", "Output format (ndjson, csv, logcat)")
+	userid := flag.String("userid", "", "required User id")
+	authorization := flag.String("authorization", "", "required Authorization")
+	url := flag.String("url", "localhost:50111", "Url")
+	flag.Parse()
+
+	value, ok := pb.ExportRequest_Format_value[strings.ToUpper(*format)]
+	if *sessionid == -1 || *authorization == "" || *userid == "" || !ok {
+		flag.PrintDefaults()
+		return
+	}
+
+	conn, err := grpc.Dial(*url, grpc.WithInsecure())
+	if err != nil {
+		log.Fatalf("failed to connect: %s", err)
+	}
+	defer conn.Close()
+	header := metadata.New(map[string]string{"authorization": *authorization, "user_id": *userid})
+	ctx := metadata.NewOutgoingContext(context.Background(), header)
+	client := pb.NewLoggyServiceClient(conn)
+	stream, err := client.ExportSessionMessages(ctx, &pb.ExportRequest{
+		Sessionid: int32(*sessionid),
+		Format:    pb.ExportRequest_Format(value),
+	})
+	if err != nil {
+		log.Fatalf("failed to export: %s", err)
+	}
+
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Fatalf("failed to export: %s", err)
+		}
+		os.Stdout.Write(chunk.Data)
+	}
+}
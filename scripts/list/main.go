@@ -16,6 +16,8 @@ func main() {
 	sessionid := flag.Int("sessionid", -1, "required Session id")
 	userid := flag.String("userid", "", "required User id")
 	authorization := flag.String("authorization", "", "required Authorization")
+	pageSize := flag.Int("pagesize", 0, "Messages fetched per request")
+	newest := flag.Bool("newest", false, "List the newest messages first")
 	url := flag.String("url", "localhost:50111", "Url")
 	flag.Parse()
 
@@ -32,14 +34,25 @@ func main() {
 	header := metadata.New(map[string]string{"authorization": *authorization, "user_id": *userid})
 	ctx := metadata.NewOutgoingContext(context.Background(), header)
 	client := pb.NewLoggyServiceClient(conn)
-	messageList, err := client.ListSessionMessages(ctx, &pb.SessionId{
-		Id: int32(*sessionid),
-	})
-	if err != nil {
-		log.Fatalf("failed to search: %s", err)
+	page := &pb.PageRequest{PageSize: int32(*pageSize)}
+	if *newest {
+		page.Sort = pb.PageRequest_NEWEST
 	}
+	for {
+		messageList, err := client.ListSessionMessages(ctx, &pb.SessionMessagesQuery{
+			Sessionid: int32(*sessionid),
+			Page:      page,
+		})
+		if err != nil {
+			log.Fatalf("failed to list messages: %s", err)
+		}
 
-	for _, i := range messageList.Messages {
-		fmt.Println(i)
+		for _, i := range messageList.Messages {
+			fmt.Println(i)
+		}
+		if len(messageList.NextPageToken) == 0 {
+			break
+		}
+		page.PageToken = messageList.NextPageToken
 	}
 }
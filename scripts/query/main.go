@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "github.com/loggysh/loggy/loggy"
+)
+
+func main() {
+	query := flag.String("query", "", `required Query, e.g. {level>=WARN} | json | count by tag`)
+	since := flag.Duration("since", 0, "Only query messages newer than this")
+	limit := flag.Int("limit", 0, "Messages returned by queries that do not count")
+	userid := flag.String("userid", "", "required User id")
+	authorization := flag.String("authorization", "", "required Authorization")
+	url := flag.String("url", "localhost:50111", "Url")
+	flag.Parse()
+
+	if *query == "" || *authorization == "" || *userid == "" {
+		flag.PrintDefaults()
+		return
+	}
+
+	conn, err := grpc.Dial(*url, grpc.WithInsecure())
+	if err != nil {
+		log.Fatalf("failed to connect: %s", err)
+	}
+	defer conn.Close()
+	header := metadata.New(map[string]string{"authorization": *authorization, "user_id": *userid})
+	ctx := metadata.NewOutgoingContext(context.Background(), header)
+
+	request := &pb.PipelineQuery{Query: *query, Limit: int32(*limit)}
+	if *since > 0 {
+		request.Start = timestamppb.New(time.Now().Add(-*since))
+	}
+	client := pb.NewLoggyServiceClient(conn)
+	result, err := client.Query(ctx, request)
+	if err != nil {
+		log.Fatalf("failed to run query: %s", err)
+	}
+
+	fmt.Printf("%s\nscanned %d messages in %s\n\n", result.Plan, result.Scanned, result.Took.AsDuration())
+	for _, record := range result.Records {
+		fmt.Println(record.Message, record.Fields)
+	}
+	for _, row := range result.Rows {
+		if row.Bucket != nil {
+			fmt.Print(row.Bucket.AsTime().Format(time.RFC3339), " ")
+		}
+		fmt.Println(row.Labels, row.Count)
+	}
+}
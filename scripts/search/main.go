@@ -4,32 +4,60 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"time"
 
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/timestamppb"
 
 	pb "github.com/loggysh/loggy/loggy"
 )
 
 func main() {
 	query := flag.String("query", "", "Search query")
+	appid := flag.String("appid", "", "Only search this application")
+	deviceid := flag.String("deviceid", "", "Only search this device")
+	sessionid := flag.Int("sessionid", 0, "Only search this session")
+	minLevel := flag.Int("minlevel", -1, "Lowest level to return (0 DEBUG - 4 CRASH)")
+	maxLevel := flag.Int("maxlevel", int(pb.Message_CRASH), "Highest level to return (0 DEBUG - 4 CRASH)")
+	since := flag.Duration("since", 0, "Only search messages newer than this")
+	userid := flag.String("userid", "", "required User id")
+	authorization := flag.String("authorization", "", "required Authorization")
+	url := flag.String("url", "localhost:50111", "Url")
 	flag.Parse()
 
-	if *query == "" {
+	if *authorization == "" || *userid == "" {
 		flag.PrintDefaults()
 		return
 	}
 
-	conn, err := grpc.Dial("localhost:50111", grpc.WithInsecure())
+	conn, err := grpc.Dial(*url, grpc.WithInsecure())
 	if err != nil {
 		log.Fatalf("failed to connect: %s", err)
 	}
 	defer conn.Close()
+	header := metadata.New(map[string]string{"authorization": *authorization, "user_id": *userid})
+	ctx := metadata.NewOutgoingContext(context.Background(), header)
+
+	request := &pb.Query{
+		Query:     *query,
+		Appid:     *appid,
+		Deviceid:  *deviceid,
+		Sessionid: int32(*sessionid),
+	}
+	if *minLevel >= 0 {
+		request.Levels = &pb.LevelRange{
+			Min: pb.Message_Level(*minLevel),
+			Max: pb.Message_Level(*maxLevel),
+		}
+	}
+	if *since > 0 {
+		request.Start = timestamppb.New(time.Now().Add(-*since))
+	}
 
 	client := pb.NewLoggyServiceClient(conn)
-	results, err := client.Search(context.Background(), &pb.Query{
-		Query: *query,
-	})
+	results, err := client.Search(ctx, request)
 	if err != nil {
 		log.Fatalf("failed to search: %s", err)
 	}
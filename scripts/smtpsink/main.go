@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// smtpsink accepts every email and prints it instead of delivering it.
+func main() {
+	addr := flag.String("addr", "localhost:2525", "Address to listen on")
+	flag.Parse()
+
+	l, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatalf("failed to listen: %v", err)
+	}
+	log.Printf("Listening for email on %s", *addr)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			log.Printf("failed to accept: %v", err)
+			continue
+		}
+		go serve(conn)
+	}
+}
+
+func serve(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) {
+		fmt.Fprintf(conn, "%s\r\n", line)
+	}
+
+	reply("220 loggy smtp sink")
+	var from string
+	var to []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		command := strings.ToUpper(line)
+
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 hello")
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			from = line[len("MAIL FROM:"):]
+			reply("250 ok")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			to = append(to, line[len("RCPT TO:"):])
+			reply("250 ok")
+		case command == "DATA":
+			reply("354 end data with <CR><LF>.<CR><LF>")
+			var body strings.Builder
+			for {
+				data, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if strings.TrimRight(data, "\r\n") == "." {
+					break
+				}
+				body.WriteString(strings.TrimPrefix(data, "."))
+			}
+			log.Printf("mail from %s to %s\n%s", from, strings.Join(to, ", "), body.String())
+			from, to = "", nil
+			reply("250 ok")
+		case command == "RSET":
+			from, to = "", nil
+			reply("250 ok")
+		case command == "NOOP":
+			reply("250 ok")
+		case command == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("502 command not implemented")
+		}
+	}
+}
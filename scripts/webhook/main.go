@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/loggysh/loggy/service"
+)
+
+func main() {
+	addr := flag.String("addr", ":9000", "Address to listen on")
+	secret := flag.String("secret", "", "Webhook secret to verify signatures with")
+	fail := flag.Bool("fail", false, "Answer every delivery with 500 to exercise retries")
+	flag.Parse()
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		timestamp := r.Header.Get(service.WebhookTimestampHeader)
+		signature := r.Header.Get(service.WebhookSignatureHeader)
+		verified := "unchecked"
+		if *secret != "" {
+			verified = fmt.Sprintf("%t", service.VerifyWebhook(*secret, timestamp, body, signature))
+		}
+
+		log.Printf("delivery %s event %s signature verified: %s\n%s",
+			r.Header.Get(service.WebhookDeliveryHeader), r.Header.Get(service.WebhookEventHeader), verified, body)
+
+		if *fail {
+			http.Error(w, "failing on purpose", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	log.Printf("Listening for webhooks on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
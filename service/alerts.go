@@ -0,0 +1,67 @@
+package service
+
+import (
+	"time"
+)
+
+type AlertRuleType int
+
+const (
+	AlertThreshold AlertRuleType = iota
+	AlertMatch
+	AlertAbsence
+)
+
+type AlertState int
+
+const (
+	AlertOK AlertState = iota
+	AlertFiring
+)
+
+type AlertRule struct {
+	Base
+	ID             int32
+	AppID          string `gorm:"column:application_id;not null;index"`
+	UserID         string `gorm:"column:user_id;not null;"`
+	Name           string
+	Type           AlertRuleType
+	Level          LogLevel
+	Threshold      int32
+	Window         time.Duration
+	Query          string
+	State          AlertState
+	SilencedUntil  *time.Time
+	LastFiredAt    *time.Time
+	LastResolvedAt *time.Time
+}
+
+// Silenced reports whether notifications for the rule are muted at t.
+func (r *AlertRule) Silenced(t time.Time) bool {
+	return r.SilencedUntil != nil && t.Before(*r.SilencedUntil)
+}
+
+// AlertEvent records a rule changing between firing and resolved.
+type AlertEvent struct {
+	ID        int
+	CreatedAt time.Time
+	RuleID    int32  `gorm:"index"`
+	AppID     string `gorm:"column:application_id;not null;"`
+	State     AlertState
+	Message   string
+	Silenced  bool
+}
+
+// AlertStore keeps alert rules and their events for the alert RPCs. Rules
+// of other users are not found.
+type AlertStore interface {
+	AlertRule(id int32, userID string) (*AlertRule, error)
+	CreateAlertRule(rule *AlertRule) error
+	// UpdateAlertRule writes the definition of a rule, its state is kept
+	UpdateAlertRule(rule *AlertRule) error
+	SilenceAlertRule(rule *AlertRule) error
+	DeleteAlertRule(rule *AlertRule) error
+	ListAlertRules(appID string) ([]*AlertRule, error)
+	// ListAlertEvents lists the events of a rule, newest first.
+	ListAlertEvents(ruleID int32) ([]*AlertEvent, error)
+}
@@ -0,0 +1,42 @@
+package service
+
+import (
+	"time"
+)
+
+type AnomalyType int
+
+const (
+	// AnomalyErrorRate is a window with significantly more errors and
+	// crashes relative to all messages than the windows before it
+	AnomalyErrorRate AnomalyType = iota
+	// AnomalyNewPattern is an error or crash of a pattern not seen before
+	AnomalyNewPattern
+)
+
+// Anomaly records something unusual in the messages of an application.
+type Anomaly struct {
+	ID          int
+	CreatedAt   time.Time `gorm:"index"`
+	AppID       string    `gorm:"column:application_id;not null;index"`
+	Type        AnomalyType
+	WindowStart time.Time
+	WindowEnd   time.Time
+	// errors and crashes, and all messages, of the window
+	Errors int64
+	Total  int64
+	// error rates of the window and of the windows before it, and the z
+	// score of the difference
+	Rate         float64
+	BaselineRate float64
+	Score        float64
+	PatternID    int64
+	Message      string
+}
+
+// AnomalyStore lists the anomalies found by the anomaly detector.
+type AnomalyStore interface {
+	// ListAnomalies lists the anomalies of an application found in
+	// [start, end), newest first. Zero times leave that end open.
+	ListAnomalies(appID string, start, end time.Time, limit int) ([]*Anomaly, error)
+}
@@ -55,9 +55,6 @@ func contains(slice []string, item string) bool {
 }
 
 var ignoreAuthArray = []string{
-	"/loggy.LoggyService/Notify",
-	"/loggy.LoggyService/RegisterReceive",
-	"/loggy.LoggyService/Receive",
 	"/loggy.LoggyService/InsertWaitListUser",
 }
 
@@ -101,18 +98,47 @@ func (interceptor *AuthInterceptor) Stream() grpc.StreamServerInterceptor {
 		log.Println("--> stream interceptor: ", info.FullMethod)
 		newCtx, err := InterceptAndVerify(info.FullMethod, ignoreAuthArray, interceptor, stream.Context())
 		if err != nil {
-			fmt.Println(err)
+			log.Println(err)
+			return err
 		}
 
 		md, _ := metadata.FromIncomingContext(newCtx)
 		if len(md["user_id"]) != 0 {
 			stream.SendHeader(metadata.Pairs("user_id", md["user_id"][0]))
 		}
-		return handler(srv, stream)
+		return handler(srv, &authorizedStream{stream, newCtx})
 	}
 
 }
 
+// authorizedStream carries the context produced by authorize, so stream
+// handlers see the verified user id just like unary handlers do.
+type authorizedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authorizedStream) Context() context.Context {
+	return s.ctx
+}
+
+// authHeaders are the HTTP headers that carry the same credentials as the
+// gRPC metadata.
+var authHeaders = []string{"authorization", "user_id", "client", "api_key"}
+
+// AuthorizeHTTP verifies the credentials of an HTTP request the same way
+// gRPC calls are verified. The returned context carries the user id in its
+// incoming metadata.
+func (interceptor *AuthInterceptor) AuthorizeHTTP(r *http.Request) (context.Context, error) {
+	md := metadata.MD{}
+	for _, header := range authHeaders {
+		if value := r.Header.Get(header); len(value) != 0 {
+			md.Set(header, value)
+		}
+	}
+	return interceptor.authorize(metadata.NewIncomingContext(r.Context(), md), r.URL.Path)
+}
+
 func (interceptor *AuthInterceptor) authorize(ctx context.Context, method string) (context.Context, error) {
 	md, ok := metadata.FromIncomingContext(ctx)
 	if !ok {
@@ -159,11 +185,14 @@ func (interceptor *AuthInterceptor) authorize(ctx context.Context, method string
 	}
 
 	if len(userID) > 0 {
-		newMD := metadata.Pairs("user_id", userID)
-		ctx = metadata.NewIncomingContext(ctx, metadata.Join(md, newMD))
+		// replace rather than append, the verified id must be the only one
+		md = md.Copy()
+		md.Set("user_id", userID)
+		ctx = metadata.NewIncomingContext(ctx, md)
 		log.Printf("authorization request granted for user %s", userID)
 	} else {
 		log.Println("authorization failed")
+		return ctx, status.Errorf(codes.Unauthenticated, "authorization failed")
 	}
 
 	return ctx, nil
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"log"
+	"sync"
+)
+
+// AllUsers subscribes to events for every user. It is meant for in-process
+// consumers and must never be derived from request data.
+const AllUsers = ""
+
+// Subscription is a single subscriber of a Broadcaster.
+type Subscription[T any] struct {
+	id     int
+	userID string
+	C      chan T
+}
+
+// Broadcaster fans out published values to every subscriber of the owning
+// user. Each subscriber has its own buffer, and publishing never blocks: a
+// subscriber whose buffer is full misses the value.
+type Broadcaster[T any] struct {
+	lock        sync.RWMutex
+	name        string
+	bufferSize  int
+	nextID      int
+	subscribers map[int]*Subscription[T]
+}
+
+func NewBroadcaster[T any](name string, bufferSize int) *Broadcaster[T] {
+	return &Broadcaster[T]{
+		name:        name,
+		bufferSize:  bufferSize,
+		subscribers: make(map[int]*Subscription[T]),
+	}
+}
+
+// Subscribe registers a subscriber for values published for userID.
+func (b *Broadcaster[T]) Subscribe(userID string) *Subscription[T] {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.nextID++
+	sub := &Subscription[T]{
+		id:     b.nextID,
+		userID: userID,
+		C:      make(chan T, b.bufferSize),
+	}
+	b.subscribers[sub.id] = sub
+	return sub
+}
+
+// Unsubscribe removes the subscriber and closes its channel.
+func (b *Broadcaster[T]) Unsubscribe(sub *Subscription[T]) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.subscribers[sub.id]; ok {
+		delete(b.subscribers, sub.id)
+		close(sub.C)
+	}
+}
+
+// Publish delivers value to all subscribers of userID and to AllUsers
+// subscribers.
+func (b *Broadcaster[T]) Publish(userID string, value T) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+
+	for _, sub := range b.subscribers {
+		if sub.userID != AllUsers && sub.userID != userID {
+			continue
+		}
+		select {
+		case sub.C <- value:
+		default:
+			log.Printf("%s: subscriber %d is full, dropping event", b.name, sub.id)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// envInternalSecret is sent to the internal endpoints of the auth service,
+// which share it.
+var envInternalSecret = os.Getenv("INTERNAL_SECRET")
+
+// Contact is how a user can be reached outside of the dashboard.
+type Contact struct {
+	UserID      string `json:"user_id"`
+	Email       string `json:"email"`
+	EmailAlerts bool   `json:"email_alerts"`
+}
+
+// FetchContact asks the auth service for the email and notification
+// preferences of a user.
+func FetchContact(userID string) (*Contact, error) {
+	u := url.URL{
+		Scheme: "http",
+		Host:   domain() + ":8080",
+		Path:   "/api/internal/contact",
+	}
+	q := url.Values{}
+	q.Add("user_id", userID)
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Internal-Secret", envInternalSecret)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status: %d - failed to fetch contact for userid %s", resp.StatusCode, userID)
+	}
+
+	contact := &Contact{}
+	if err := json.NewDecoder(resp.Body).Decode(contact); err != nil {
+		return nil, err
+	}
+	return contact, nil
+}
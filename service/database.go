@@ -0,0 +1,66 @@
+package service
+
+import (
+	"flag"
+	"os"
+	"strings"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// DatabaseConfig selects the database of a server and sizes its connection
+// pool.
+type DatabaseConfig struct {
+	// DSN is a PostgreSQL URL or keyword/value connection string, or the
+	// path of a SQLite database
+	DSN             string
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// DatabaseFlags defines the flags of a DatabaseConfig. The database is the
+// one in $DATABASE_URL if set, the SQLite database at path otherwise.
+func DatabaseFlags(path string) *DatabaseConfig {
+	config := &DatabaseConfig{}
+	dsn := os.Getenv("DATABASE_URL")
+	if len(dsn) == 0 {
+		dsn = path
+	}
+	flag.StringVar(&config.DSN, "database", dsn, "PostgreSQL URL or connection string, or path of a SQLite database. ($DATABASE_URL or "+path+")")
+	flag.IntVar(&config.MaxOpenConns, "db-max-open-conns", 25, "Maximum open database connections, 0 for no limit. (25)")
+	flag.IntVar(&config.MaxIdleConns, "db-max-idle-conns", 10, "Maximum idle database connections. (10)")
+	flag.DurationVar(&config.ConnMaxLifetime, "db-conn-max-lifetime", 30*time.Minute, "Maximum time a database connection is reused, 0 for no limit. (30m)")
+	return config
+}
+
+// IsPostgres reports whether the DSN is a PostgreSQL one.
+func (c *DatabaseConfig) IsPostgres() bool {
+	return strings.HasPrefix(c.DSN, "postgres://") ||
+		strings.HasPrefix(c.DSN, "postgresql://") ||
+		strings.Contains(c.DSN, "host=") ||
+		strings.Contains(c.DSN, "dbname=")
+}
+
+// OpenDatabase connects to the database of the config.
+func OpenDatabase(config *DatabaseConfig) (*gorm.DB, error) {
+	dialector := sqlite.Open(config.DSN)
+	if config.IsPostgres() {
+		dialector = postgres.Open(config.DSN)
+	}
+	db, err := gorm.Open(dialector, &gorm.Config{})
+	if err != nil {
+		return nil, err
+	}
+	pool, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	pool.SetMaxOpenConns(config.MaxOpenConns)
+	pool.SetMaxIdleConns(config.MaxIdleConns)
+	pool.SetConnMaxLifetime(config.ConnMaxLifetime)
+	return db, nil
+}
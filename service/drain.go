@@ -0,0 +1,147 @@
+package service
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Wildcard stands for the variable parts of a template.
+const Wildcard = "<*>"
+
+const (
+	// leading tokens messages have to share to be compared
+	drainPrefix      = 1
+	drainSimilarity  = 0.4
+	drainMaxChildren = 100
+)
+
+// DrainCluster is a template messages were grouped under. Its ID is set by
+// the owner of the Drain, zero until then.
+type DrainCluster struct {
+	ID     int64
+	Tokens []string
+}
+
+// Template is the template with its variable parts replaced by Wildcard.
+func (c *DrainCluster) Template() string {
+	return strings.Join(c.Tokens, " ")
+}
+
+type drainNode struct {
+	children map[string]*drainNode
+	clusters []*DrainCluster
+}
+
+func newDrainNode() *drainNode {
+	return &drainNode{children: make(map[string]*drainNode)}
+}
+
+// Drain mines message templates online, after "Drain: An Online Log Parsing
+// Approach with Fixed Depth Tree" (He et al., 2017). Messages are split into
+// tokens. Messages with as many tokens and the same leading tokens are
+// compared to the templates seen so far and join the most similar one, or
+// start a new one. Tokens with digits are taken as variables from the
+// start. Drain is not safe for concurrent use.
+type Drain struct {
+	root *drainNode
+}
+
+func NewDrain() *Drain {
+	return &Drain{root: newDrainNode()}
+}
+
+func drainTokens(msg string) []string {
+	tokens := strings.Fields(msg)
+	for i, token := range tokens {
+		if strings.IndexFunc(token, unicode.IsDigit) >= 0 {
+			tokens[i] = Wildcard
+		}
+	}
+	return tokens
+}
+
+// leaf finds the node holding the clusters of tokens, adding the path to it
+// as needed. The first level is the number of tokens, the next ones the
+// leading tokens.
+func (d *Drain) leaf(tokens []string) *drainNode {
+	length := strconv.Itoa(len(tokens))
+	node, ok := d.root.children[length]
+	if !ok {
+		node = newDrainNode()
+		d.root.children[length] = node
+	}
+	for i := 0; i < drainPrefix && i < len(tokens); i++ {
+		token := tokens[i]
+		child, ok := node.children[token]
+		if !ok {
+			child, ok = node.children[Wildcard]
+		}
+		if !ok {
+			// nodes that are full send new tokens to the wildcard
+			if token != Wildcard && len(node.children) >= drainMaxChildren-1 {
+				token = Wildcard
+			}
+			if child, ok = node.children[token]; !ok {
+				child = newDrainNode()
+				node.children[token] = child
+			}
+		}
+		node = child
+	}
+	return node
+}
+
+// similarity is the share of tokens equal to the template, and the number
+// of wildcards in it to break ties.
+func similarity(template, tokens []string) (float64, int) {
+	if len(template) == 0 {
+		return 1, 0
+	}
+	var equal, wildcards int
+	for i, token := range template {
+		if token == Wildcard {
+			wildcards++
+		}
+		// tokens with digits are wildcards already and match one
+		if token == tokens[i] {
+			equal++
+		}
+	}
+	return float64(equal) / float64(len(template)), wildcards
+}
+
+// Add assigns a message to a cluster. It reports whether the cluster is new
+// or its template changed.
+func (d *Drain) Add(msg string) (cluster *DrainCluster, changed bool) {
+	tokens := drainTokens(msg)
+	node := d.leaf(tokens)
+
+	best, bestSimilarity, bestWildcards := (*DrainCluster)(nil), -1.0, -1
+	for _, c := range node.clusters {
+		s, wildcards := similarity(c.Tokens, tokens)
+		if s > bestSimilarity || (s == bestSimilarity && wildcards > bestWildcards) {
+			best, bestSimilarity, bestWildcards = c, s, wildcards
+		}
+	}
+	if best == nil || bestSimilarity < drainSimilarity {
+		cluster = &DrainCluster{Tokens: tokens}
+		node.clusters = append(node.clusters, cluster)
+		return cluster, true
+	}
+
+	for i, token := range best.Tokens {
+		if token != Wildcard && token != tokens[i] {
+			best.Tokens[i] = Wildcard
+			changed = true
+		}
+	}
+	return best, changed
+}
+
+// Load adds a cluster mined before, so messages keep joining it.
+func (d *Drain) Load(id int64, template string) {
+	tokens := strings.Fields(template)
+	node := d.leaf(tokens)
+	node.clusters = append(node.clusters, &DrainCluster{ID: id, Tokens: tokens})
+}
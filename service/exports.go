@@ -0,0 +1,13 @@
+package service
+
+import (
+	"time"
+)
+
+// ExportWatermark is the last message of an application written to the
+// Parquet export, the next export starts after it.
+type ExportWatermark struct {
+	AppID         string `gorm:"primaryKey;column:application_id"`
+	LastMessageID int
+	UpdatedAt     time.Time
+}
@@ -0,0 +1,723 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// GormStore is a Store on a gorm database. Messages of archived sessions
+// are read from their segments.
+type GormStore struct {
+	db       *gorm.DB
+	segments *Segments
+}
+
+func NewGormStore(db *gorm.DB, segments *Segments) *GormStore {
+	return &GormStore{db: db, segments: segments}
+}
+
+// first loads the record matching a condition into dest, with ErrNotFound
+// if there is none.
+func (s *GormStore) first(dest interface{}, query string, args ...interface{}) error {
+	err := s.db.Where(query, args...).First(dest).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// isUUID reports whether id can be compared to uuid columns, PostgreSQL
+// fails queries comparing them to anything else.
+func isUUID(id string) bool {
+	_, err := uuid.FromString(id)
+	return err == nil
+}
+
+// byOffset orders a query on column and applies the offset of the page.
+func (p Page) byOffset(tx *gorm.DB, column string) *gorm.DB {
+	order := column + ", id"
+	if p.Desc {
+		order = column + " DESC, id DESC"
+	}
+	return tx.Order(order).Offset(p.Offset).Limit(p.Size)
+}
+
+// byID continues after the id of the last row.
+func (p Page) byID(tx *gorm.DB, column string) *gorm.DB {
+	if p.Desc {
+		if p.After != nil {
+			tx = tx.Where(column+" < ?", p.After.ID)
+		}
+		return tx.Order(column + " DESC").Limit(p.Size)
+	}
+	if p.After != nil {
+		tx = tx.Where(column+" > ?", p.After.ID)
+	}
+	return tx.Order(column).Limit(p.Size)
+}
+
+// byTime continues after the time and id of the last row.
+func (p Page) byTime(tx *gorm.DB, timeColumn, idColumn string) *gorm.DB {
+	if p.Desc {
+		if p.After != nil && p.After.Time != nil {
+			tx = tx.Where("("+timeColumn+" < ? OR ("+timeColumn+" = ? AND "+idColumn+" < ?))", *p.After.Time, *p.After.Time, p.After.ID)
+		}
+		return tx.Order(timeColumn + " DESC").Order(idColumn + " DESC").Limit(p.Size)
+	}
+	if p.After != nil && p.After.Time != nil {
+		tx = tx.Where("("+timeColumn+" > ? OR ("+timeColumn+" = ? AND "+idColumn+" > ?))", *p.After.Time, *p.After.Time, p.After.ID)
+	}
+	return tx.Order(timeColumn).Order(idColumn).Limit(p.Size)
+}
+
+// slice applies the page to messages in timestamp and id order, like
+// byTime does in the database.
+func (p Page) slice(messages []*Message) []*Message {
+	var rows []*Message
+	for i := range messages {
+		msg := messages[i]
+		if p.Desc {
+			msg = messages[len(messages)-1-i]
+		}
+		if p.After != nil && p.After.Time != nil && !p.follows(msg) {
+			continue
+		}
+		if p.Size > 0 && len(rows) == p.Size {
+			break
+		}
+		rows = append(rows, msg)
+	}
+	return rows
+}
+
+// follows reports whether msg comes after the cursor of the page.
+func (p Page) follows(msg *Message) bool {
+	t, id := *p.After.Time, int(p.After.ID)
+	if p.Desc {
+		return msg.Timestamp.Before(t) || (msg.Timestamp.Equal(t) && msg.ID < id)
+	}
+	return msg.Timestamp.After(t) || (msg.Timestamp.Equal(t) && msg.ID > id)
+}
+
+// archived returns the segment of a session and its entry in the segment,
+// nothing if the session is not archived.
+func (s *GormStore) archived(sessionID int32) (*Segment, *SegmentEntry, error) {
+	segment := &Segment{}
+	result := s.db.Model(&Segment{}).Select("segments.*").
+		Joins("JOIN sessions ON sessions.segment_id = segments.id").
+		Where("sessions.id = ?", sessionID).
+		Limit(1).Find(segment)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return nil, nil, result.Error
+	}
+	index, err := s.segments.Index(segment)
+	if err != nil {
+		return nil, nil, err
+	}
+	entry := index.Session(sessionID)
+	if entry == nil {
+		return nil, nil, fmt.Errorf("session %d is missing from segment %s", sessionID, segment.Path)
+	}
+	return segment, entry, nil
+}
+
+func (s *GormStore) AddWaitlistUser(email string) error {
+	entry := &WaitlistUser{Email: email}
+	return s.db.Where(entry).FirstOrCreate(entry).Error
+}
+
+func (s *GormStore) GetOrCreateApplication(app *Application) (*Application, error) {
+	exists := &Application{}
+	err := s.db.Where("id = ?", app.ID).Attrs(app).FirstOrCreate(exists).Error
+	if err != nil {
+		return nil, err
+	}
+	return exists, nil
+}
+
+func (s *GormStore) Application(id string) (*Application, error) {
+	app := &Application{}
+	if err := s.first(app, "id = ?", id); err != nil {
+		return nil, err
+	}
+	return app, nil
+}
+
+func (s *GormStore) CountApplications(userID string) (int64, error) {
+	var total int64
+	err := s.db.Model(&Application{}).Where("user_id = ?", userID).Count(&total).Error
+	return total, err
+}
+
+func (s *GormStore) ListApplications(userID string, page Page) ([]*Application, error) {
+	var apps []*Application
+	err := page.byOffset(s.db.Where("user_id = ?", userID), "created_at").Find(&apps).Error
+	return apps, err
+}
+
+func (s *GormStore) GetOrCreateDevice(device *Device) (*Device, bool, error) {
+	exists := &Device{}
+	result := s.db.Where("id = ?", device.ID).Attrs(device).FirstOrCreate(exists)
+	if result.Error != nil {
+		return nil, false, result.Error
+	}
+	if exists.AppID != device.AppID {
+		return nil, false, ErrDeviceApplication
+	}
+	return exists, result.RowsAffected > 0, nil
+}
+
+func (s *GormStore) Device(id string) (*Device, error) {
+	if !isUUID(id) {
+		return nil, ErrNotFound
+	}
+	device := &Device{}
+	if err := s.first(device, "id = ?", id); err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+func (s *GormStore) CountDevices(appID string) (int64, error) {
+	var total int64
+	err := s.db.Model(&Device{}).Where("application_id = ?", appID).Count(&total).Error
+	return total, err
+}
+
+func (s *GormStore) ListDevices(appID string, page Page) ([]*Device, error) {
+	var devices []*Device
+	err := page.byOffset(s.db.Where("application_id = ?", appID), "created_at").Find(&devices).Error
+	return devices, err
+}
+
+func (s *GormStore) CreateSession(session *Session) error {
+	return s.db.Create(session).Error
+}
+
+func (s *GormStore) Session(id int32) (*Session, error) {
+	session := &Session{}
+	if err := s.first(session, "id = ?", id); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (s *GormStore) CountSessions(appID, deviceID string) (int64, error) {
+	if !isUUID(deviceID) {
+		return 0, nil
+	}
+	var total int64
+	err := s.db.Model(&Session{}).Where("application_id = ? AND device_id = ?", appID, deviceID).Count(&total).Error
+	return total, err
+}
+
+func (s *GormStore) ListSessions(appID, deviceID string, page Page) ([]*Session, error) {
+	if !isUUID(deviceID) {
+		return nil, nil
+	}
+	var sessions []*Session
+	tx := s.db.Where("application_id = ? AND device_id = ?", appID, deviceID)
+	err := page.byID(tx, "id").Find(&sessions).Error
+	return sessions, err
+}
+
+func (s *GormStore) EndSession(session *Session) (bool, error) {
+	result := s.db.Model(&Session{}).Where("id = ? AND status = ?", session.ID, SessionLive).Updates(map[string]interface{}{
+		"status":   session.Status,
+		"ended_at": session.EndedAt,
+	})
+	return result.RowsAffected == 1, result.Error
+}
+
+func (s *GormStore) IdleSessions(cutoff time.Time) ([]*Session, error) {
+	var sessions []*Session
+	err := s.db.Where("status = ? AND last_message_at < ?", SessionLive, cutoff).Find(&sessions).Error
+	return sessions, err
+}
+
+func (s *GormStore) AddSessionMessage(sessionID int32, t time.Time, crashed bool) error {
+	updates := map[string]interface{}{
+		"message_count":   gorm.Expr("message_count + 1"),
+		"last_message_at": t,
+	}
+	if crashed {
+		updates["crashed"] = true
+	}
+	return s.db.Model(&Session{}).Where("id = ?", sessionID).Updates(updates).Error
+}
+
+func (s *GormStore) CreateMessage(msg *Message) error {
+	return s.db.Create(msg).Error
+}
+
+func (s *GormStore) Message(id int) (*Message, error) {
+	msg := &Message{}
+	err := s.first(msg, "id = ?", id)
+	if errors.Is(err, ErrNotFound) {
+		return s.archivedMessage(id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// archivedMessage looks for a message in the segments whose ids cover it,
+// reading only the sessions that can hold it.
+func (s *GormStore) archivedMessage(id int) (*Message, error) {
+	var segments []*Segment
+	err := s.db.Where("first_message_id <= ? AND last_message_id >= ?", id, id).Order("id").Find(&segments).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, segment := range segments {
+		index, err := s.segments.Index(segment)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range index.Sessions {
+			if entry.MinID > id || entry.MaxID < id {
+				continue
+			}
+			messages, err := s.segments.ReadSession(segment, entry)
+			if err != nil {
+				return nil, err
+			}
+			for _, msg := range messages {
+				if msg.ID == id {
+					// messages read from segments are shared
+					copied := *msg
+					return &copied, nil
+				}
+			}
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *GormStore) CountMessages(sessionID int32) (int64, error) {
+	_, entry, err := s.archived(sessionID)
+	if err != nil {
+		return 0, err
+	}
+	if entry != nil {
+		return entry.Messages, nil
+	}
+	var total int64
+	err = s.db.Model(&Message{}).Where("session_id = ?", sessionID).Count(&total).Error
+	return total, err
+}
+
+func (s *GormStore) ListMessages(filter MessageFilter, page Page) ([]*Message, error) {
+	segment, entry, err := s.archived(filter.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	if segment != nil {
+		messages, err := s.segments.ReadSession(segment, entry)
+		if err != nil {
+			return nil, err
+		}
+		if !filter.Start.IsZero() || !filter.End.IsZero() {
+			var filtered []*Message
+			for _, msg := range messages {
+				if (filter.Start.IsZero() || !msg.Timestamp.Before(filter.Start)) &&
+					(filter.End.IsZero() || !msg.Timestamp.After(filter.End)) {
+					filtered = append(filtered, msg)
+				}
+			}
+			messages = filtered
+		}
+		return page.slice(messages), nil
+	}
+	tx := s.db.Where("session_id = ?", filter.SessionID)
+	if !filter.Start.IsZero() {
+		tx = tx.Where("timestamp >= ?", filter.Start)
+	}
+	if !filter.End.IsZero() {
+		tx = tx.Where("timestamp <= ?", filter.End)
+	}
+	var messages []*Message
+	err = page.byTime(tx, "timestamp", "id").Find(&messages).Error
+	return messages, err
+}
+
+func (s *GormStore) SetDigest(appID string, enabled bool) error {
+	return s.db.Model(&Application{}).Where("id = ?", appID).Update("digest_enabled", enabled).Error
+}
+
+func (s *GormStore) DigestApplications() ([]*Application, error) {
+	var apps []*Application
+	err := s.db.Where("digest_enabled = ?", true).Find(&apps).Error
+	return apps, err
+}
+
+func (s *GormStore) AlertRule(id int32, userID string) (*AlertRule, error) {
+	rule := &AlertRule{}
+	if err := s.first(rule, "id = ? AND user_id = ?", id, userID); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+func (s *GormStore) CreateAlertRule(rule *AlertRule) error {
+	return s.db.Create(rule).Error
+}
+
+func (s *GormStore) UpdateAlertRule(rule *AlertRule) error {
+	return s.db.Model(rule).Select("name", "type", "level", "threshold", "window", "query").Updates(rule).Error
+}
+
+func (s *GormStore) SilenceAlertRule(rule *AlertRule) error {
+	return s.db.Model(rule).Update("silenced_until", rule.SilencedUntil).Error
+}
+
+func (s *GormStore) DeleteAlertRule(rule *AlertRule) error {
+	return s.db.Delete(rule).Error
+}
+
+func (s *GormStore) ListAlertRules(appID string) ([]*AlertRule, error) {
+	var rules []*AlertRule
+	err := s.db.Where("application_id = ?", appID).Find(&rules).Error
+	return rules, err
+}
+
+func (s *GormStore) ListAlertEvents(ruleID int32) ([]*AlertEvent, error) {
+	var events []*AlertEvent
+	err := s.db.Where("rule_id = ?", ruleID).Order("created_at desc").Find(&events).Error
+	return events, err
+}
+
+func (s *GormStore) Webhook(id int32, userID string) (*Webhook, error) {
+	webhook := &Webhook{}
+	if err := s.first(webhook, "id = ? AND user_id = ?", id, userID); err != nil {
+		return nil, err
+	}
+	return webhook, nil
+}
+
+func (s *GormStore) CreateWebhook(webhook *Webhook) error {
+	return s.db.Create(webhook).Error
+}
+
+func (s *GormStore) DeleteWebhook(webhook *Webhook) error {
+	return s.db.Delete(webhook).Error
+}
+
+func (s *GormStore) ListWebhooks(appID string) ([]*Webhook, error) {
+	var webhooks []*Webhook
+	err := s.db.Where("application_id = ?", appID).Find(&webhooks).Error
+	return webhooks, err
+}
+
+func (s *GormStore) WebhookDelivery(id int32) (*WebhookDelivery, error) {
+	delivery := &WebhookDelivery{}
+	if err := s.first(delivery, "id = ?", id); err != nil {
+		return nil, err
+	}
+	return delivery, nil
+}
+
+func (s *GormStore) SaveWebhookDelivery(delivery *WebhookDelivery) error {
+	return s.db.Save(delivery).Error
+}
+
+func (s *GormStore) ListWebhookDeliveries(webhookID int32, deadOnly bool) ([]*WebhookDelivery, error) {
+	tx := s.db.Where("webhook_id = ?", webhookID)
+	if deadOnly {
+		tx = tx.Where("status = ?", DeliveryDead)
+	}
+	var deliveries []*WebhookDelivery
+	err := tx.Order("created_at desc").Find(&deliveries).Error
+	return deliveries, err
+}
+
+func (s *GormStore) SavedSearch(id int32, userID string) (*SavedSearch, error) {
+	search := &SavedSearch{}
+	if err := s.first(search, "id = ? AND user_id = ?", id, userID); err != nil {
+		return nil, err
+	}
+	return search, nil
+}
+
+func (s *GormStore) CreateSavedSearch(search *SavedSearch) error {
+	return s.db.Create(search).Error
+}
+
+func (s *GormStore) UpdateSavedSearch(search *SavedSearch) error {
+	return s.db.Save(search).Error
+}
+
+func (s *GormStore) DeleteSavedSearch(search *SavedSearch) error {
+	return s.db.Delete(search).Error
+}
+
+func (s *GormStore) ListSavedSearches(userID, appID string) ([]*SavedSearch, error) {
+	tx := s.db.Where("user_id = ?", userID)
+	if len(appID) != 0 {
+		tx = tx.Where("application_id = ?", appID)
+	}
+	var searches []*SavedSearch
+	err := tx.Order("name").Find(&searches).Error
+	return searches, err
+}
+
+func (s *GormStore) RetentionPolicy(appID string) (*RetentionPolicy, error) {
+	policy := &RetentionPolicy{AppID: appID}
+	if err := s.db.Where(policy).Limit(1).Find(policy).Error; err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func (s *GormStore) SaveRetentionPolicy(policy *RetentionPolicy) error {
+	return s.db.Clauses(clause.OnConflict{UpdateAll: true}).Create(policy).Error
+}
+
+func (s *GormStore) CreateRetentionReport(report *RetentionReport) error {
+	return s.db.Create(report).Error
+}
+
+func (s *GormStore) ListRetentionReports(appID string, limit int) ([]*RetentionReport, error) {
+	var reports []*RetentionReport
+	err := s.db.Where("application_id = ?", appID).Order("started_at DESC, id DESC").Limit(limit).Find(&reports).Error
+	return reports, err
+}
+
+func (s *GormStore) ListAnomalies(appID string, start, end time.Time, limit int) ([]*Anomaly, error) {
+	tx := s.db.Where("application_id = ?", appID)
+	if !start.IsZero() {
+		tx = tx.Where("created_at >= ?", start)
+	}
+	if !end.IsZero() {
+		tx = tx.Where("created_at < ?", end)
+	}
+	var anomalies []*Anomaly
+	err := tx.Order("created_at DESC, id DESC").Limit(limit).Find(&anomalies).Error
+	return anomalies, err
+}
+
+func (s *GormStore) ListPatterns(appID string, since time.Time, newest bool, limit int) ([]*Pattern, error) {
+	tx := s.db.Where("application_id = ?", appID)
+	if !since.IsZero() {
+		tx = tx.Where("first_seen >= ?", since)
+	}
+	order := "count DESC, id"
+	if newest {
+		order = "first_seen DESC, count DESC, id"
+	}
+	var patterns []*Pattern
+	err := tx.Order(order).Limit(limit).Find(&patterns).Error
+	return patterns, err
+}
+
+func (s *GormStore) SessionPatterns(sessionID int32) ([]*Pattern, error) {
+	var rows []struct {
+		PatternID int64
+		Count     int64
+		FirstID   int
+		LastID    int
+	}
+	err := s.db.Model(&Message{}).
+		Select("pattern_id, COUNT(*) AS count, MIN(id) AS first_id, MAX(id) AS last_id").
+		Where("session_id = ? AND pattern_id <> 0", sessionID).
+		Group("pattern_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	var ids, messageIDs []interface{}
+	for _, row := range rows {
+		ids = append(ids, row.PatternID)
+		messageIDs = append(messageIDs, row.FirstID, row.LastID)
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	var patterns []*Pattern
+	if err := s.db.Where("id IN ?", ids).Find(&patterns).Error; err != nil {
+		return nil, err
+	}
+	var messages []*Message
+	if err := s.db.Where("id IN ?", messageIDs).Find(&messages).Error; err != nil {
+		return nil, err
+	}
+	templates := make(map[int64]string, len(patterns))
+	for _, pattern := range patterns {
+		templates[pattern.ID] = pattern.Template
+	}
+	byID := make(map[int]*Message, len(messages))
+	for _, msg := range messages {
+		byID[msg.ID] = msg
+	}
+
+	var result []*Pattern
+	for _, row := range rows {
+		first, last := byID[row.FirstID], byID[row.LastID]
+		if first == nil || last == nil {
+			continue
+		}
+		pattern := &Pattern{
+			ID:        row.PatternID,
+			Template:  templates[row.PatternID],
+			Count:     row.Count,
+			FirstSeen: first.Timestamp,
+			LastSeen:  last.Timestamp,
+		}
+		pattern.AddSample(first.Msg)
+		result = append(result, pattern)
+	}
+	return result, nil
+}
+
+func (s *GormStore) Segment(id int64) (*Segment, error) {
+	segment := &Segment{}
+	if err := s.first(segment, "id = ?", id); err != nil {
+		return nil, err
+	}
+	return segment, nil
+}
+
+func (s *GormStore) ListSegments(filter SegmentFilter) ([]*Segment, error) {
+	tx := s.db.Model(&Segment{}).Select("segments.*")
+	if len(filter.UserID) != 0 {
+		tx = tx.Joins("JOIN applications ON applications.id = segments.application_id").
+			Where("applications.user_id = ?", filter.UserID)
+	}
+	if len(filter.AppID) != 0 {
+		tx = tx.Where("segments.application_id = ?", filter.AppID)
+	}
+	if filter.SessionID != 0 {
+		tx = tx.Where("segments.id IN (?)", s.db.Model(&Session{}).Select("segment_id").Where("id = ?", filter.SessionID))
+	}
+	if !filter.Start.IsZero() {
+		tx = tx.Where("segments.last_message_at >= ?", filter.Start)
+	}
+	if !filter.End.IsZero() {
+		tx = tx.Where("segments.first_message_at <= ?", filter.End)
+	}
+	var segments []*Segment
+	err := tx.Order("segments.id").Find(&segments).Error
+	return segments, err
+}
+
+// levelCounts counts the messages of a query by level.
+func levelCounts(tx *gorm.DB) (map[LogLevel]int64, error) {
+	var rows []struct {
+		Level LogLevel
+		Count int64
+	}
+	if err := tx.Select("messages.level AS level, COUNT(*) AS count").Group("messages.level").Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+	counts := make(map[LogLevel]int64)
+	for _, row := range rows {
+		counts[row.Level] = row.Count
+	}
+	return counts, nil
+}
+
+func (s *GormStore) SessionLevelCounts(sessionID int32) (map[LogLevel]int64, error) {
+	return levelCounts(s.db.Model(&Message{}).Where("session_id = ?", sessionID))
+}
+
+func (s *GormStore) AppLevelCounts(appID string, from, to time.Time) (map[LogLevel]int64, error) {
+	return levelCounts(s.db.Model(&Message{}).
+		Joins("JOIN sessions ON sessions.id = messages.session_id").
+		Where("sessions.application_id = ? AND messages.timestamp >= ? AND messages.timestamp < ?", appID, from, to))
+}
+
+// bucketColumn is the SQL expression of the start of the bucket of a
+// message, in seconds since the epoch.
+func (s *GormStore) bucketColumn(width time.Duration) string {
+	seconds := int64(width / time.Second)
+	if s.db.Dialector.Name() == "postgres" {
+		return fmt.Sprintf("CAST(FLOOR(EXTRACT(EPOCH FROM messages.timestamp) / %d) * %d AS BIGINT)", seconds, seconds)
+	}
+	return fmt.Sprintf("CAST(strftime('%%s', messages.timestamp) AS INTEGER) / %d * %d", seconds, seconds)
+}
+
+func (s *GormStore) Histogram(filter HistogramFilter) ([]HistogramCount, error) {
+	tx := s.db.Table("messages").Joins("JOIN sessions ON sessions.id = messages.session_id")
+	if len(filter.AppID) != 0 {
+		tx = tx.Where("sessions.application_id = ?", filter.AppID)
+	}
+	if len(filter.DeviceID) != 0 {
+		if !isUUID(filter.DeviceID) {
+			return nil, nil
+		}
+		tx = tx.Where("sessions.device_id = ?", filter.DeviceID)
+	}
+	if filter.SessionID != 0 {
+		tx = tx.Where("messages.session_id = ?", filter.SessionID)
+	}
+	columns := s.bucketColumn(filter.Width) + " AS bucket, messages.level AS level, COUNT(*) AS count"
+	group := "bucket, level"
+	if filter.ByDevice {
+		columns += ", sessions.device_id AS device_id"
+		group += ", device_id"
+	}
+	var counts []HistogramCount
+	err := tx.Select(columns).
+		Where("messages.timestamp >= ? AND messages.timestamp < ?", filter.Start, filter.End).
+		Group(group).
+		Scan(&counts).Error
+	return counts, err
+}
+
+func (s *GormStore) NewIssues(appID string, from, to time.Time, limit int) ([]Issue, error) {
+	var issues []Issue
+	err := s.db.Model(&Message{}).
+		Select("patterns.template AS msg, COUNT(*) AS count").
+		Joins("JOIN sessions ON sessions.id = messages.session_id").
+		Joins("JOIN patterns ON patterns.id = messages.pattern_id").
+		Where("sessions.application_id = ? AND messages.timestamp >= ? AND messages.timestamp < ? AND messages.level >= ?", appID, from, to, ERROR).
+		Where("patterns.first_seen >= ?", from).
+		Group("patterns.id, patterns.template").
+		Order("count DESC").
+		Limit(limit).
+		Scan(&issues).Error
+	return issues, err
+}
+
+func (s *GormStore) NewDevices(appID string, from, to time.Time) ([]*Device, error) {
+	var devices []*Device
+	err := s.db.Where("application_id = ? AND created_at >= ? AND created_at < ?", appID, from, to).Find(&devices).Error
+	return devices, err
+}
+
+func (s *GormStore) Devices(ids []string) ([]*Device, error) {
+	var valid []string
+	for _, id := range ids {
+		if isUUID(id) {
+			valid = append(valid, id)
+		}
+	}
+	if len(valid) == 0 {
+		return nil, nil
+	}
+	var devices []*Device
+	err := s.db.Where("id IN ?", valid).Find(&devices).Error
+	return devices, err
+}
+
+func (s *GormStore) Rollups(appID, deviceID string, period RollupPeriod, from, to time.Time) ([]*Rollup, error) {
+	var rollups []*Rollup
+	err := s.db.Where("application_id = ? AND device_id = ? AND period = ? AND start >= ? AND start < ?",
+		appID, deviceID, period, from, to).Find(&rollups).Error
+	return rollups, err
+}
+
+func (s *GormStore) ActiveDevices(appID string, period RollupPeriod, from, to time.Time) (int64, error) {
+	var total int64
+	err := s.db.Model(&RollupDevice{}).
+		Where("application_id = ? AND period = ? AND start >= ? AND start < ?", appID, period, from, to).
+		Distinct("device_id").
+		Count(&total).Error
+	return total, err
+}
@@ -0,0 +1,274 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/blevesearch/bleve/v2"
+	"github.com/blevesearch/bleve/v2/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/v2/mapping"
+	"gorm.io/gorm"
+
+	// analyzers that can be chosen for message bodies
+	_ "github.com/blevesearch/bleve/v2/analysis/analyzer/simple"
+	_ "github.com/blevesearch/bleve/v2/analysis/analyzer/web"
+	_ "github.com/blevesearch/bleve/v2/analysis/lang/en"
+)
+
+// MessageDocType is the document type of messages in the search index.
+const MessageDocType = "message"
+
+// IndexVersion is the version of the index mapping. Indexes built with
+// another version are rebuilt from the database when opened.
+const IndexVersion = 3
+
+var (
+	indexVersionKey    = []byte("loggy.version")
+	indexAnalyzerKey   = []byte("loggy.analyzer")
+	indexCheckpointKey = []byte("loggy.checkpoint")
+)
+
+// IndexedMessage is the search index document of a message. It carries the
+// ids of everything the message belongs to, so searches can be scoped to a
+// user, application, device or session inside the index query.
+type IndexedMessage struct {
+	UserID    string    `json:"user_id"`
+	AppID     string    `json:"app_id"`
+	DeviceID  string    `json:"device_id"`
+	SessionID string    `json:"session_id"`
+	Msg       string    `json:"msg"`
+	Level     string    `json:"level"`
+	Severity  int       `json:"severity"`
+	Timestamp time.Time `json:"timestamp"`
+	TraceID   string    `json:"trace_id,omitempty"`
+	SpanID    string    `json:"span_id,omitempty"`
+	// Attributes are the device details, e.g. attributes.android_os_version
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+func NewIndexedMessage(msg *Message, session *Session, app *Application, device *Device) *IndexedMessage {
+	return newIndexedMessage(msg, app.UserID, session.AppID, session.DeviceID.String(), device.Details)
+}
+
+func newIndexedMessage(msg *Message, userID, appID, deviceID, details string) *IndexedMessage {
+	return &IndexedMessage{
+		UserID:     userID,
+		AppID:      appID,
+		DeviceID:   deviceID,
+		SessionID:  strconv.Itoa(int(msg.SessionID)),
+		Msg:        msg.Msg,
+		Level:      msg.Level.String(),
+		Severity:   int(msg.Level),
+		Timestamp:  msg.Timestamp,
+		TraceID:    msg.TraceID,
+		SpanID:     msg.SpanID,
+		Attributes: DeviceAttributes(details),
+	}
+}
+
+// DeviceAttributes flattens the JSON details of a device into strings.
+// Details that are not a JSON object have no attributes.
+func DeviceAttributes(details string) map[string]string {
+	var values map[string]interface{}
+	if err := json.Unmarshal([]byte(details), &values); err != nil || len(values) == 0 {
+		return nil
+	}
+	attributes := make(map[string]string, len(values))
+	for key, value := range values {
+		if value != nil {
+			attributes[key] = fmt.Sprint(value)
+		}
+	}
+	return attributes
+}
+
+// Type implements bleve's Classifier, so documents use the message mapping.
+func (m *IndexedMessage) Type() string {
+	return MessageDocType
+}
+
+func keywordField() *mapping.FieldMapping {
+	field := bleve.NewTextFieldMapping()
+	field.Analyzer = keyword.Name
+	field.IncludeInAll = false
+	return field
+}
+
+// NewIndexMapping maps ids, levels and attributes as keywords so they can
+// only be matched exactly. Message bodies are analyzed with analyzer and
+// are what unqualified query terms search.
+func NewIndexMapping(analyzer string) mapping.IndexMapping {
+	message := bleve.NewDocumentMapping()
+	message.Dynamic = false
+	message.AddFieldMappingsAt("user_id", keywordField())
+	message.AddFieldMappingsAt("app_id", keywordField())
+	message.AddFieldMappingsAt("device_id", keywordField())
+	message.AddFieldMappingsAt("session_id", keywordField())
+	message.AddFieldMappingsAt("level", keywordField())
+	message.AddFieldMappingsAt("trace_id", keywordField())
+	message.AddFieldMappingsAt("span_id", keywordField())
+
+	severity := bleve.NewNumericFieldMapping()
+	severity.IncludeInAll = false
+	message.AddFieldMappingsAt("severity", severity)
+
+	timestamp := bleve.NewDateTimeFieldMapping()
+	timestamp.IncludeInAll = false
+	message.AddFieldMappingsAt("timestamp", timestamp)
+
+	body := bleve.NewTextFieldMapping()
+	body.Analyzer = analyzer
+	message.AddFieldMappingsAt("msg", body)
+
+	attributes := bleve.NewDocumentMapping()
+	attributes.DefaultAnalyzer = keyword.Name
+	message.AddSubDocumentMapping("attributes", attributes)
+
+	indexMapping := bleve.NewIndexMapping()
+	indexMapping.AddDocumentMapping(MessageDocType, message)
+	indexMapping.DefaultField = "msg"
+	return indexMapping
+}
+
+// OpenIndex opens the index at path, creating it when there is none. An
+// index of another version or analyzer is replaced by an empty one, unless
+// it is an unfinished rebuild that can be resumed. The returned bool reports
+// whether the index has to be filled by RebuildIndex.
+func OpenIndex(path, analyzer string) (bleve.Index, bool, error) {
+	indexMapping := NewIndexMapping(analyzer)
+	// fail before an existing index is thrown away
+	if err := indexMapping.Validate(); err != nil {
+		return nil, false, err
+	}
+
+	if _, err := os.Stat(path); err == nil {
+		index, err := bleve.Open(path)
+		if err != nil {
+			return nil, false, err
+		}
+		version, _ := index.GetInternal(indexVersionKey)
+		current, _ := index.GetInternal(indexAnalyzerKey)
+		if string(version) == strconv.Itoa(IndexVersion) && string(current) == analyzer {
+			return index, false, nil
+		}
+		if len(version) == 0 && string(current) == analyzer {
+			return index, true, nil
+		}
+		log.Printf("index %s has version %q and analyzer %q, rebuilding it with version %d and analyzer %q", path, version, current, IndexVersion, analyzer)
+		index.Close()
+		if err := os.RemoveAll(path); err != nil {
+			return nil, false, err
+		}
+	}
+	return CreateIndex(path, analyzer)
+}
+
+// CreateIndex creates an empty index at path that RebuildIndex has to fill.
+func CreateIndex(path, analyzer string) (bleve.Index, bool, error) {
+	index, err := bleve.New(path, NewIndexMapping(analyzer))
+	if err != nil {
+		return nil, false, err
+	}
+	if err := index.SetInternal(indexAnalyzerKey, []byte(analyzer)); err != nil {
+		return nil, false, err
+	}
+	return index, true, nil
+}
+
+// IndexDocument is a message as it is stored in the search index.
+type IndexDocument struct {
+	ID  string
+	Doc *IndexedMessage
+}
+
+// indexRow is a message together with everything its document needs.
+type indexRow struct {
+	Message
+	UserID   string
+	AppID    string
+	DeviceID string
+	Details  string
+}
+
+// LoadIndexDocuments loads the documents of up to limit messages with ids
+// greater than afterID, ordered by id.
+func LoadIndexDocuments(db *gorm.DB, afterID, limit int) ([]*IndexDocument, error) {
+	var rows []*indexRow
+	err := db.Model(&Message{}).
+		Select("messages.*, applications.user_id AS user_id, sessions.application_id AS app_id, sessions.device_id AS device_id, COALESCE(devices.details, '') AS details").
+		Joins("JOIN sessions ON sessions.id = messages.session_id").
+		Joins("JOIN applications ON applications.id = sessions.application_id").
+		Joins("LEFT JOIN devices ON devices.id = sessions.device_id").
+		Where("messages.id > ?", afterID).
+		Order("messages.id").
+		Limit(limit).
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	docs := make([]*IndexDocument, len(rows))
+	for i, row := range rows {
+		docs[i] = &IndexDocument{
+			ID:  strconv.Itoa(row.ID),
+			Doc: newIndexedMessage(&row.Message, row.UserID, row.AppID, row.DeviceID, row.Details),
+		}
+	}
+	return docs, nil
+}
+
+// IndexCheckpoint returns the id of the last message indexed by an
+// unfinished rebuild, or 0.
+func IndexCheckpoint(index bleve.Index) int {
+	checkpoint, _ := index.GetInternal(indexCheckpointKey)
+	id, _ := strconv.Atoi(string(checkpoint))
+	return id
+}
+
+// RebuildIndex indexes every message in the database in batches and marks
+// the index as current once done. Each batch records a checkpoint, so an
+// interrupted rebuild continues where it stopped.
+func RebuildIndex(db *gorm.DB, index bleve.Index, batchSize int) error {
+	lastID := IndexCheckpoint(index)
+	var total int64
+	if err := db.Model(&Message{}).Where("id > ?", lastID).Count(&total).Error; err != nil {
+		return err
+	}
+	if lastID > 0 {
+		log.Printf("resuming index rebuild after message %d", lastID)
+	}
+
+	var done int64
+	start := time.Now()
+	for {
+		docs, err := LoadIndexDocuments(db, lastID, batchSize)
+		if err != nil {
+			return err
+		}
+		if len(docs) == 0 {
+			break
+		}
+
+		batch := index.NewBatch()
+		for _, doc := range docs {
+			if err := batch.Index(doc.ID, doc.Doc); err != nil {
+				return err
+			}
+		}
+		lastID, _ = strconv.Atoi(docs[len(docs)-1].ID)
+		batch.SetInternal(indexCheckpointKey, []byte(strconv.Itoa(lastID)))
+		if err := index.Batch(batch); err != nil {
+			return err
+		}
+		done += int64(len(docs))
+		log.Printf("reindexed %d of %d messages (%.0f/s)", done, total, float64(done)/time.Since(start).Seconds())
+	}
+
+	batch := index.NewBatch()
+	batch.SetInternal(indexVersionKey, []byte(strconv.Itoa(IndexVersion)))
+	batch.DeleteInternal(indexCheckpointKey)
+	return index.Batch(batch)
+}
@@ -0,0 +1,357 @@
+package service
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// MemoryStore is a Store that keeps everything in memory, for tests. It
+// returns copies, so callers can change what they load like they can with
+// GormStore. There are no archived sessions.
+type MemoryStore struct {
+	lock      sync.Mutex
+	waitlist  map[string]bool
+	apps      []*Application
+	devices   []*Device
+	sessions  []*Session
+	messages  []*Message
+	lastMsgID int
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{waitlist: make(map[string]bool)}
+}
+
+// offsetPage applies an offset page to rows in creation order.
+func offsetPage[T any](rows []T, page Page) []T {
+	if page.Desc {
+		reversed := make([]T, len(rows))
+		for i, row := range rows {
+			reversed[len(rows)-1-i] = row
+		}
+		rows = reversed
+	}
+	if page.Offset >= len(rows) {
+		return nil
+	}
+	rows = rows[page.Offset:]
+	if page.Size > 0 && len(rows) > page.Size {
+		rows = rows[:page.Size]
+	}
+	return rows
+}
+
+func (s *MemoryStore) AddWaitlistUser(email string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.waitlist[email] = true
+	return nil
+}
+
+func (s *MemoryStore) application(id string) *Application {
+	for _, app := range s.apps {
+		if app.ID == id {
+			return app
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetOrCreateApplication(app *Application) (*Application, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	exists := s.application(app.ID)
+	if exists == nil {
+		exists = &Application{}
+		*exists = *app
+		exists.CreatedAt = time.Now()
+		exists.UpdatedAt = exists.CreatedAt
+		s.apps = append(s.apps, exists)
+	}
+	copied := *exists
+	return &copied, nil
+}
+
+func (s *MemoryStore) Application(id string) (*Application, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	app := s.application(id)
+	if app == nil {
+		return nil, ErrNotFound
+	}
+	copied := *app
+	return &copied, nil
+}
+
+func (s *MemoryStore) userApps(userID string) []*Application {
+	var apps []*Application
+	for _, app := range s.apps {
+		if app.UserID == userID {
+			copied := *app
+			apps = append(apps, &copied)
+		}
+	}
+	return apps
+}
+
+func (s *MemoryStore) CountApplications(userID string) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return int64(len(s.userApps(userID))), nil
+}
+
+func (s *MemoryStore) ListApplications(userID string, page Page) ([]*Application, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return offsetPage(s.userApps(userID), page), nil
+}
+
+func (s *MemoryStore) SetDigest(appID string, enabled bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if app := s.application(appID); app != nil {
+		app.DigestEnabled = enabled
+	}
+	return nil
+}
+
+func (s *MemoryStore) DigestApplications() ([]*Application, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var apps []*Application
+	for _, app := range s.apps {
+		if app.DigestEnabled {
+			copied := *app
+			apps = append(apps, &copied)
+		}
+	}
+	return apps, nil
+}
+
+func (s *MemoryStore) device(id uuid.UUID) *Device {
+	for _, device := range s.devices {
+		if device.ID == id {
+			return device
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) GetOrCreateDevice(device *Device) (*Device, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	exists := s.device(device.ID)
+	created := exists == nil
+	if created {
+		exists = &Device{}
+		*exists = *device
+		exists.CreatedAt = time.Now()
+		exists.UpdatedAt = exists.CreatedAt
+		s.devices = append(s.devices, exists)
+	}
+	if exists.AppID != device.AppID {
+		return nil, false, ErrDeviceApplication
+	}
+	copied := *exists
+	return &copied, created, nil
+}
+
+func (s *MemoryStore) Device(id string) (*Device, error) {
+	deviceID, err := uuid.FromString(id)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	device := s.device(deviceID)
+	if device == nil {
+		return nil, ErrNotFound
+	}
+	copied := *device
+	return &copied, nil
+}
+
+func (s *MemoryStore) appDevices(appID string) []*Device {
+	var devices []*Device
+	for _, device := range s.devices {
+		if device.AppID == appID {
+			copied := *device
+			devices = append(devices, &copied)
+		}
+	}
+	return devices
+}
+
+func (s *MemoryStore) CountDevices(appID string) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return int64(len(s.appDevices(appID))), nil
+}
+
+func (s *MemoryStore) ListDevices(appID string, page Page) ([]*Device, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return offsetPage(s.appDevices(appID), page), nil
+}
+
+func (s *MemoryStore) CreateSession(session *Session) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	session.ID = int32(len(s.sessions) + 1)
+	session.CreatedAt = time.Now()
+	session.UpdatedAt = session.CreatedAt
+	copied := *session
+	s.sessions = append(s.sessions, &copied)
+	return nil
+}
+
+func (s *MemoryStore) session(id int32) *Session {
+	// sessions are numbered from 1 in the order they are created
+	if id < 1 || int(id) > len(s.sessions) {
+		return nil
+	}
+	return s.sessions[id-1]
+}
+
+func (s *MemoryStore) Session(id int32) (*Session, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	session := s.session(id)
+	if session == nil {
+		return nil, ErrNotFound
+	}
+	copied := *session
+	return &copied, nil
+}
+
+func (s *MemoryStore) deviceSessions(appID, deviceID string) []*Session {
+	var sessions []*Session
+	for _, session := range s.sessions {
+		if session.AppID == appID && session.DeviceID.String() == deviceID {
+			copied := *session
+			sessions = append(sessions, &copied)
+		}
+	}
+	return sessions
+}
+
+func (s *MemoryStore) CountSessions(appID, deviceID string) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return int64(len(s.deviceSessions(appID, deviceID))), nil
+}
+
+func (s *MemoryStore) ListSessions(appID, deviceID string, page Page) ([]*Session, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sessions := s.deviceSessions(appID, deviceID)
+	if page.After != nil {
+		var after []*Session
+		for _, session := range sessions {
+			if (page.Desc && int64(session.ID) < page.After.ID) || (!page.Desc && int64(session.ID) > page.After.ID) {
+				after = append(after, session)
+			}
+		}
+		sessions = after
+	}
+	page.Offset = 0
+	return offsetPage(sessions, page), nil
+}
+
+func (s *MemoryStore) EndSession(session *Session) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stored := s.session(session.ID)
+	if stored == nil || stored.Status != SessionLive {
+		return false, nil
+	}
+	stored.Status = session.Status
+	stored.EndedAt = session.EndedAt
+	return true, nil
+}
+
+func (s *MemoryStore) IdleSessions(cutoff time.Time) ([]*Session, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var sessions []*Session
+	for _, session := range s.sessions {
+		if session.Status == SessionLive && session.LastMessageAt.Before(cutoff) {
+			copied := *session
+			sessions = append(sessions, &copied)
+		}
+	}
+	return sessions, nil
+}
+
+func (s *MemoryStore) AddSessionMessage(sessionID int32, t time.Time, crashed bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if session := s.session(sessionID); session != nil {
+		session.MessageCount++
+		session.LastMessageAt = t
+		session.Crashed = session.Crashed || crashed
+	}
+	return nil
+}
+
+func (s *MemoryStore) CreateMessage(msg *Message) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lastMsgID++
+	msg.ID = s.lastMsgID
+	msg.CreatedAt = time.Now()
+	msg.UpdatedAt = msg.CreatedAt
+	copied := *msg
+	s.messages = append(s.messages, &copied)
+	return nil
+}
+
+func (s *MemoryStore) Message(id int) (*Message, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, msg := range s.messages {
+		if msg.ID == id {
+			copied := *msg
+			return &copied, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *MemoryStore) CountMessages(sessionID int32) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var total int64
+	for _, msg := range s.messages {
+		if msg.SessionID == sessionID {
+			total++
+		}
+	}
+	return total, nil
+}
+
+func (s *MemoryStore) ListMessages(filter MessageFilter, page Page) ([]*Message, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var messages []*Message
+	for _, msg := range s.messages {
+		if msg.SessionID != filter.SessionID ||
+			(!filter.Start.IsZero() && msg.Timestamp.Before(filter.Start)) ||
+			(!filter.End.IsZero() && msg.Timestamp.After(filter.End)) {
+			continue
+		}
+		copied := *msg
+		messages = append(messages, &copied)
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		a, b := messages[i], messages[j]
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.Before(b.Timestamp)
+		}
+		return a.ID < b.ID
+	})
+	return page.slice(messages), nil
+}
@@ -17,24 +17,57 @@ type Base struct {
 type Application struct {
 	Base
 	ID          string
-	UserID      string `gorm:"type:uuid;column:user_id;not null;default:empty;"`
-	PackageName string `gorm:"column:package_name;not null;default:empty;"`
+	UserID      string `gorm:"type:uuid;column:user_id;not null;index"`
+	PackageName string `gorm:"column:package_name;not null;"`
 	Name        string
 	Icon        string
+	// DigestEnabled sends a daily summary email to the owner
+	DigestEnabled bool
 }
 
 type Device struct {
 	Base
 	ID      uuid.UUID `gorm:"type:uuid;primary_key;"`
-	AppID   string    `gorm:"type:string;column:application_id;not null;default:empty;"`
+	AppID   string    `gorm:"column:application_id;not null;index"`
 	Details string
 }
 
+type SessionStatus int
+
+const (
+	SessionLive SessionStatus = iota
+	SessionEnded
+	SessionCrashed
+	SessionTimedOut
+)
+
 type Session struct {
 	Base
-	ID       int32
-	DeviceID uuid.UUID `gorm:"type:uuid;column:device_id;not null;default:empty;"`
-	AppID    string    `gorm:"type:string;column:application_id;not null;default:empty;"`
+	ID            int32
+	DeviceID      uuid.UUID `gorm:"type:uuid;column:device_id;not null;index"`
+	AppID         string    `gorm:"column:application_id;not null;index"`
+	Status        SessionStatus
+	StartedAt     time.Time
+	EndedAt       *time.Time
+	LastMessageAt time.Time
+	MessageCount  int32
+	Crashed       bool
+	// SegmentID is the segment holding the messages of an archived
+	// session, zero while they are in the messages table
+	SegmentID int64 `gorm:"not null;default:0;index"`
+}
+
+// Duration is the time between the start of the session and its end, or
+// now for sessions that are still live.
+func (s *Session) Duration() time.Duration {
+	started := s.StartedAt
+	if started.IsZero() {
+		started = s.CreatedAt
+	}
+	if s.EndedAt != nil {
+		return s.EndedAt.Sub(started)
+	}
+	return time.Since(started)
 }
 
 type WaitlistUser struct {
@@ -54,28 +87,37 @@ const (
 type Message struct {
 	ID int
 	Base
-	SessionID int32
+	// messages are listed by session in timestamp order
+	SessionID int32 `gorm:"index:idx_messages_session_timestamp,priority:1"`
 	Session   Session
 	Msg       string
-	Timestamp time.Time
-	Level     LogLevel
+	Timestamp time.Time `gorm:"index:idx_messages_session_timestamp,priority:2;index"`
+	Level     LogLevel  `gorm:"index"`
+	// PatternID is the pattern mined from the message, zero for messages
+	// from before patterns were mined
+	PatternID int64 `gorm:"index"`
+	// TraceID and SpanID link the message to the other messages of a
+	// request, also across applications
+	TraceID string `gorm:"index"`
+	SpanID  string
 }
 
-func (m *Message) String() string {
-	var level string
-	switch m.Level {
+func (l LogLevel) String() string {
+	switch l {
 	case DEBUG:
-		level = "DEBUG"
+		return "DEBUG"
 	case INFO:
-		level = "INFO"
+		return "INFO"
 	case WARN:
-		level = "WARN"
+		return "WARN"
 	case ERROR:
-		level = "ERROR"
+		return "ERROR"
 	case CRASH:
-		level = "CRASH"
-	default:
-		level = "undefined"
+		return "CRASH"
 	}
-	return fmt.Sprintf("%v :: %d :: <%s> :: %s", m.Timestamp, m.SessionID, level, m.Msg)
+	return "undefined"
+}
+
+func (m *Message) String() string {
+	return fmt.Sprintf("%v :: %d :: <%s> :: %s", m.Timestamp, m.SessionID, m.Level, m.Msg)
 }
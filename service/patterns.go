@@ -0,0 +1,55 @@
+package service
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// PatternSamples is how many sample lines a pattern keeps.
+const PatternSamples = 3
+
+// Pattern is a message template mined from the messages of an application.
+// Messages refer to it by PatternID.
+type Pattern struct {
+	ID        int64
+	AppID     string `gorm:"column:application_id;not null;index"`
+	Template  string
+	Count     int64
+	FirstSeen time.Time
+	LastSeen  time.Time
+	// Samples is a JSON list of the first lines of the pattern
+	Samples string
+}
+
+// SampleLines returns the sample lines of the pattern.
+func (p *Pattern) SampleLines() []string {
+	var lines []string
+	json.Unmarshal([]byte(p.Samples), &lines)
+	return lines
+}
+
+// AddSample keeps line as a sample, unless the pattern has enough of them.
+func (p *Pattern) AddSample(line string) {
+	lines := p.SampleLines()
+	if len(lines) >= PatternSamples {
+		return
+	}
+	for _, sample := range lines {
+		if sample == line {
+			return
+		}
+	}
+	data, _ := json.Marshal(append(lines, line))
+	p.Samples = string(data)
+}
+
+// PatternStore lists the patterns mined from the messages of applications.
+type PatternStore interface {
+	// ListPatterns lists the patterns of an application first seen since
+	// since, the most frequent first or the newest if newest is set.
+	ListPatterns(appID string, since time.Time, newest bool, limit int) ([]*Pattern, error)
+	// SessionPatterns counts the patterns of the messages of a session,
+	// with the first message of each pattern as its sample. Archived
+	// messages are left out.
+	SessionPatterns(sessionID int32) ([]*Pattern, error)
+}
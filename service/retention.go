@@ -0,0 +1,60 @@
+package service
+
+import (
+	"time"
+)
+
+// RetentionPolicy is how many days the messages of an application are kept,
+// by level. Messages of a level with zero days are kept forever.
+type RetentionPolicy struct {
+	AppID     string `gorm:"primaryKey;column:application_id"`
+	DebugDays int
+	InfoDays  int
+	WarnDays  int
+	ErrorDays int
+	CrashDays int
+	UpdatedAt time.Time
+}
+
+// Days is how many days messages of level are kept, zero for forever.
+func (p *RetentionPolicy) Days(level LogLevel) int {
+	switch level {
+	case DEBUG:
+		return p.DebugDays
+	case INFO:
+		return p.InfoDays
+	case WARN:
+		return p.WarnDays
+	case ERROR:
+		return p.ErrorDays
+	case CRASH:
+		return p.CrashDays
+	}
+	return 0
+}
+
+// RetentionReport records what a retention run deleted from an
+// application.
+type RetentionReport struct {
+	ID         int64
+	AppID      string `gorm:"column:application_id;not null;index"`
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Messages   int64
+	Sessions   int64
+	// EstimatedBytes is an estimate of the logical bytes deleted, not of the
+	// space freed on disk
+	EstimatedBytes int64
+}
+
+// RetentionStore keeps retention policies and the reports of their runs.
+type RetentionStore interface {
+	// RetentionPolicy returns the policy of an application, the one
+	// keeping everything if it has none.
+	RetentionPolicy(appID string) (*RetentionPolicy, error)
+	SaveRetentionPolicy(policy *RetentionPolicy) error
+	CreateRetentionReport(report *RetentionReport) error
+	// ListRetentionReports lists the latest reports of an application,
+	// newest first.
+	ListRetentionReports(appID string, limit int) ([]*RetentionReport, error)
+}
@@ -0,0 +1,74 @@
+package service
+
+import (
+	"time"
+)
+
+type RollupPeriod int
+
+const (
+	RollupHour RollupPeriod = iota
+	RollupDay
+)
+
+// RollupPeriods are the periods every rollup is kept for.
+var RollupPeriods = []RollupPeriod{RollupHour, RollupDay}
+
+// Duration is the length of the period.
+func (p RollupPeriod) Duration() time.Duration {
+	if p == RollupDay {
+		return 24 * time.Hour
+	}
+	return time.Hour
+}
+
+// Start returns the start of the period t falls in, in UTC.
+func (p RollupPeriod) Start(t time.Time) time.Time {
+	return t.UTC().Truncate(p.Duration())
+}
+
+// Rollup counts the messages and sessions of an application, or of one of
+// its devices, in an hour or a day. Application rollups have an empty
+// device id. Sessions and crashed sessions count in the period the session
+// started in.
+type Rollup struct {
+	AppID           string       `gorm:"column:application_id;primaryKey"`
+	DeviceID        string       `gorm:"primaryKey"`
+	Period          RollupPeriod `gorm:"primaryKey"`
+	Start           time.Time    `gorm:"primaryKey"`
+	DebugCount      int64
+	InfoCount       int64
+	WarnCount       int64
+	ErrorCount      int64
+	CrashCount      int64
+	Sessions        int64
+	CrashedSessions int64
+	// ActiveDevices counts the devices that sent messages or started
+	// sessions, in application rollups only
+	ActiveDevices int64
+}
+
+// Add counts n messages of a level.
+func (r *Rollup) Add(level LogLevel, n int64) {
+	switch level {
+	case DEBUG:
+		r.DebugCount += n
+	case INFO:
+		r.InfoCount += n
+	case WARN:
+		r.WarnCount += n
+	case ERROR:
+		r.ErrorCount += n
+	case CRASH:
+		r.CrashCount += n
+	}
+}
+
+// RollupDevice records that a device was active in a period, so each
+// device counts once in the active devices of its application.
+type RollupDevice struct {
+	AppID    string       `gorm:"column:application_id;primaryKey"`
+	DeviceID string       `gorm:"primaryKey"`
+	Period   RollupPeriod `gorm:"primaryKey"`
+	Start    time.Time    `gorm:"primaryKey"`
+}
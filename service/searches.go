@@ -0,0 +1,36 @@
+package service
+
+import (
+	"time"
+)
+
+// SavedSearch is a search kept under a name, with the filters of a search
+// request.
+type SavedSearch struct {
+	Base
+	ID        int32
+	UserID    string `gorm:"column:user_id;not null;index"`
+	AppID     string `gorm:"column:application_id;index"`
+	Name      string
+	Query     string
+	DeviceID  string
+	SessionID int32
+	MinLevel  *LogLevel
+	MaxLevel  *LogLevel
+	Start     *time.Time
+	End       *time.Time
+	// Range searches the last Range of time instead of Start and End
+	Range time.Duration
+}
+
+// SavedSearchStore keeps saved searches. Searches of other users are not
+// found.
+type SavedSearchStore interface {
+	SavedSearch(id int32, userID string) (*SavedSearch, error)
+	CreateSavedSearch(search *SavedSearch) error
+	UpdateSavedSearch(search *SavedSearch) error
+	DeleteSavedSearch(search *SavedSearch) error
+	// ListSavedSearches lists the searches of a user by name, only those
+	// of an application if appID is set.
+	ListSavedSearches(userID, appID string) ([]*SavedSearch, error)
+}
@@ -0,0 +1,405 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Segment is an immutable file holding the messages of archived sessions of
+// an application. Archived sessions keep their row, with the id of their
+// segment, while their messages are only in the segment.
+type Segment struct {
+	ID        int64
+	CreatedAt time.Time
+	AppID     string `gorm:"column:application_id;not null;index"`
+	// Path is relative to the segment directory
+	Path     string
+	Sessions int
+	Messages int64
+	Bytes    int64
+	// timestamps of the oldest and newest message
+	FirstMessageAt time.Time
+	LastMessageAt  time.Time
+	// lowest and highest message id, ids of other segments can fall in
+	// between
+	FirstMessageID int `gorm:"index"`
+	LastMessageID  int
+}
+
+// SegmentFilter selects the segments of the applications of a user that can
+// hold messages of a search. Empty fields match every segment.
+type SegmentFilter struct {
+	UserID    string
+	AppID     string
+	SessionID int32
+	// the segments with messages in [Start, End]
+	Start time.Time
+	End   time.Time
+}
+
+// SegmentStore finds the segments of archived sessions.
+type SegmentStore interface {
+	Segment(id int64) (*Segment, error)
+	// ListSegments lists the segments matching a filter by id.
+	ListSegments(filter SegmentFilter) ([]*Segment, error)
+}
+
+// A segment file is a gzip compressed block of JSON lines per session,
+// followed by the segment index as a compressed JSON block and a trailer
+// with the offset and length of the index.
+const segmentMagic = "LOGGYSG1"
+
+// index offset and length, then the magic
+const segmentTrailerSize = 24
+
+// SegmentEntry is where the messages of a session are in a segment, with
+// what searches need to skip the session without reading them.
+type SegmentEntry struct {
+	SessionID int32  `json:"session_id"`
+	DeviceID  string `json:"device_id"`
+	// Details of the device when the session was archived
+	Details  string    `json:"details,omitempty"`
+	Offset   int64     `json:"offset"`
+	Length   int64     `json:"length"`
+	Messages int64     `json:"messages"`
+	First    time.Time `json:"first"`
+	Last     time.Time `json:"last"`
+	// lowest and highest message id, zero in segments written before
+	// they were kept
+	MinID int `json:"min_id,omitempty"`
+	MaxID int `json:"max_id,omitempty"`
+	// Levels counts the messages of each level
+	Levels [CRASH + 1]int64 `json:"levels"`
+}
+
+// HasLevels reports whether the session has messages of a level in
+// [min, max].
+func (e *SegmentEntry) HasLevels(min, max LogLevel) bool {
+	for level := min; level <= max && level <= CRASH; level++ {
+		if level >= DEBUG && e.Levels[level] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// SegmentIndex lists the sessions of a segment by id.
+type SegmentIndex struct {
+	AppID    string          `json:"app_id"`
+	Sessions []*SegmentEntry `json:"sessions"`
+}
+
+// Session returns the entry of a session, nil if it is not in the segment.
+func (idx *SegmentIndex) Session(id int32) *SegmentEntry {
+	i := sort.Search(len(idx.Sessions), func(i int) bool {
+		return idx.Sessions[i].SessionID >= id
+	})
+	if i < len(idx.Sessions) && idx.Sessions[i].SessionID == id {
+		return idx.Sessions[i]
+	}
+	return nil
+}
+
+// Document is a message of the segment as it would be indexed, for
+// searches matching archived messages.
+func (idx *SegmentIndex) Document(entry *SegmentEntry, userID string, msg *Message) *IndexedMessage {
+	return newIndexedMessage(msg, userID, idx.AppID, entry.DeviceID, entry.Details)
+}
+
+// segmentMessage is a message the way it is stored in a segment, its
+// session is that of the block.
+type segmentMessage struct {
+	ID        int       `json:"id"`
+	Timestamp time.Time `json:"t"`
+	Level     LogLevel  `json:"l"`
+	Msg       string    `json:"m"`
+	PatternID int64     `json:"p,omitempty"`
+	TraceID   string    `json:"tr,omitempty"`
+	SpanID    string    `json:"sp,omitempty"`
+}
+
+// countingWriter counts the bytes written through it, the offset of the
+// next block.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(data []byte) (int, error) {
+	n, err := w.w.Write(data)
+	w.n += int64(n)
+	return n, err
+}
+
+// SegmentWriter writes a segment file. The file is renamed to its name once
+// complete, so readers never see part of it.
+type SegmentWriter struct {
+	path  string
+	file  *os.File
+	buf   *bufio.Writer
+	w     *countingWriter
+	index SegmentIndex
+}
+
+// Add writes the messages of a session, in timestamp and id order.
+// Sessions are added in id order.
+func (w *SegmentWriter) Add(session *Session, details string, messages []*Message) error {
+	if n := len(w.index.Sessions); n > 0 && w.index.Sessions[n-1].SessionID >= session.ID {
+		return fmt.Errorf("session %d added after session %d", session.ID, w.index.Sessions[n-1].SessionID)
+	}
+	entry := &SegmentEntry{
+		SessionID: session.ID,
+		DeviceID:  session.DeviceID.String(),
+		Details:   details,
+		Offset:    w.w.n,
+		Messages:  int64(len(messages)),
+	}
+	gz := gzip.NewWriter(w.w)
+	encoder := json.NewEncoder(gz)
+	for i, msg := range messages {
+		if i == 0 {
+			entry.First = msg.Timestamp
+		}
+		entry.Last = msg.Timestamp
+		if entry.MinID == 0 || msg.ID < entry.MinID {
+			entry.MinID = msg.ID
+		}
+		if msg.ID > entry.MaxID {
+			entry.MaxID = msg.ID
+		}
+		if msg.Level >= DEBUG && msg.Level <= CRASH {
+			entry.Levels[msg.Level]++
+		}
+		err := encoder.Encode(&segmentMessage{
+			ID:        msg.ID,
+			Timestamp: msg.Timestamp,
+			Level:     msg.Level,
+			Msg:       msg.Msg,
+			PatternID: msg.PatternID,
+			TraceID:   msg.TraceID,
+			SpanID:    msg.SpanID,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	entry.Length = w.w.n - entry.Offset
+	w.index.Sessions = append(w.index.Sessions, entry)
+	return nil
+}
+
+// Close writes the index of the segment and returns it with the size of
+// the file.
+func (w *SegmentWriter) Close() (*SegmentIndex, int64, error) {
+	offset := w.w.n
+	gz := gzip.NewWriter(w.w)
+	if err := json.NewEncoder(gz).Encode(&w.index); err != nil {
+		return nil, 0, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, 0, err
+	}
+	trailer := make([]byte, 16, segmentTrailerSize)
+	binary.BigEndian.PutUint64(trailer, uint64(offset))
+	binary.BigEndian.PutUint64(trailer[8:], uint64(w.w.n-offset))
+	if _, err := w.w.Write(append(trailer, segmentMagic...)); err != nil {
+		return nil, 0, err
+	}
+	if err := w.buf.Flush(); err != nil {
+		return nil, 0, err
+	}
+	if err := w.file.Sync(); err != nil {
+		return nil, 0, err
+	}
+	if err := w.file.Close(); err != nil {
+		return nil, 0, err
+	}
+	if err := os.Rename(w.path+".tmp", w.path); err != nil {
+		return nil, 0, err
+	}
+	return &w.index, w.w.n, nil
+}
+
+func (w *SegmentWriter) Abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// sessions read from segments kept in memory, pages of a session are read
+// one after the other
+const maxCachedSegmentSessions = 16
+
+// Segments reads and writes the segment files in a directory. Indexes of
+// segments and the last sessions read are cached, segments never change.
+type Segments struct {
+	dir      string
+	lock     sync.Mutex
+	indexes  map[int64]*SegmentIndex
+	sessions map[int32][]*Message
+}
+
+func NewSegments(dir string) *Segments {
+	return &Segments{
+		dir:      dir,
+		indexes:  make(map[int64]*SegmentIndex),
+		sessions: make(map[int32][]*Message),
+	}
+}
+
+// Create starts writing the segment file at path, relative to the
+// directory.
+func (s *Segments) Create(path, appID string) (*SegmentWriter, error) {
+	path = filepath.Join(s.dir, path)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	buf := bufio.NewWriter(file)
+	return &SegmentWriter{
+		path:  path,
+		file:  file,
+		buf:   buf,
+		w:     &countingWriter{w: buf},
+		index: SegmentIndex{AppID: appID},
+	}, nil
+}
+
+// Remove deletes the file of a segment.
+func (s *Segments) Remove(segment *Segment) error {
+	s.lock.Lock()
+	if index, ok := s.indexes[segment.ID]; ok {
+		for _, entry := range index.Sessions {
+			delete(s.sessions, entry.SessionID)
+		}
+		delete(s.indexes, segment.ID)
+	}
+	s.lock.Unlock()
+
+	err := os.Remove(filepath.Join(s.dir, segment.Path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// readBlock decompresses a block of a segment file.
+func readBlock(file *os.File, offset, length int64) (io.ReadCloser, error) {
+	return gzip.NewReader(bufio.NewReader(io.NewSectionReader(file, offset, length)))
+}
+
+// Index reads the index of a segment.
+func (s *Segments) Index(segment *Segment) (*SegmentIndex, error) {
+	s.lock.Lock()
+	index, ok := s.indexes[segment.ID]
+	s.lock.Unlock()
+	if ok {
+		return index, nil
+	}
+
+	file, err := os.Open(filepath.Join(s.dir, segment.Path))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	trailer := make([]byte, segmentTrailerSize)
+	if info.Size() < segmentTrailerSize {
+		return nil, fmt.Errorf("segment %s is truncated", segment.Path)
+	}
+	if _, err := file.ReadAt(trailer, info.Size()-segmentTrailerSize); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(trailer[16:], []byte(segmentMagic)) {
+		return nil, fmt.Errorf("%s is not a segment", segment.Path)
+	}
+	offset := int64(binary.BigEndian.Uint64(trailer))
+	length := int64(binary.BigEndian.Uint64(trailer[8:]))
+	block, err := readBlock(file, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	defer block.Close()
+	index = &SegmentIndex{}
+	if err := json.NewDecoder(block).Decode(index); err != nil {
+		return nil, fmt.Errorf("segment %s: %w", segment.Path, err)
+	}
+
+	s.lock.Lock()
+	s.indexes[segment.ID] = index
+	s.lock.Unlock()
+	return index, nil
+}
+
+// ReadSession reads the messages of a session from its segment, in
+// timestamp and id order. The messages are shared with other readers and
+// must not be changed.
+func (s *Segments) ReadSession(segment *Segment, entry *SegmentEntry) ([]*Message, error) {
+	s.lock.Lock()
+	messages, ok := s.sessions[entry.SessionID]
+	s.lock.Unlock()
+	if ok {
+		return messages, nil
+	}
+
+	file, err := os.Open(filepath.Join(s.dir, segment.Path))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	block, err := readBlock(file, entry.Offset, entry.Length)
+	if err != nil {
+		return nil, err
+	}
+	defer block.Close()
+	messages = make([]*Message, 0, entry.Messages)
+	decoder := json.NewDecoder(block)
+	for {
+		var m segmentMessage
+		if err := decoder.Decode(&m); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("segment %s, session %d: %w", segment.Path, entry.SessionID, err)
+		}
+		messages = append(messages, &Message{
+			ID:        m.ID,
+			SessionID: entry.SessionID,
+			Msg:       m.Msg,
+			Timestamp: m.Timestamp,
+			Level:     m.Level,
+			PatternID: m.PatternID,
+			TraceID:   m.TraceID,
+			SpanID:    m.SpanID,
+		})
+	}
+
+	s.lock.Lock()
+	if len(s.sessions) >= maxCachedSegmentSessions {
+		for id := range s.sessions {
+			delete(s.sessions, id)
+			break
+		}
+	}
+	s.sessions[entry.SessionID] = messages
+	s.lock.Unlock()
+	return messages, nil
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+	"time"
+)
+
+// HistogramFilter selects the messages a histogram counts, those of an
+// application, device or session logged in [Start, End).
+type HistogramFilter struct {
+	AppID     string
+	DeviceID  string
+	SessionID int32
+	Start     time.Time
+	End       time.Time
+	// Width of the buckets, whole seconds. Buckets line up with the epoch.
+	Width time.Duration
+	// ByDevice counts the messages of every device apart
+	ByDevice bool
+}
+
+// HistogramCount is the number of messages of a level in the bucket
+// starting Bucket seconds after the epoch, of one device when counted by
+// device.
+type HistogramCount struct {
+	Bucket   int64
+	Level    LogLevel
+	Count    int64
+	DeviceID string
+}
+
+// Issue is an error message and how often it was logged.
+type Issue struct {
+	Msg   string
+	Count int64
+}
+
+// StatsStore counts messages for stats, histograms and digests, and reads
+// the rollups of applications and devices. Archived messages are not
+// counted.
+type StatsStore interface {
+	// SessionLevelCounts counts the messages of a session by level.
+	SessionLevelCounts(sessionID int32) (map[LogLevel]int64, error)
+	// AppLevelCounts counts the messages of an application logged in
+	// [from, to) by level.
+	AppLevelCounts(appID string, from, to time.Time) (map[LogLevel]int64, error)
+	Histogram(filter HistogramFilter) ([]HistogramCount, error)
+	// NewIssues lists the errors and crashes of an application logged in
+	// [from, to) whose pattern was first seen then, the most frequent
+	// first, by pattern template.
+	NewIssues(appID string, from, to time.Time, limit int) ([]Issue, error)
+	// NewDevices lists the devices of an application created in [from, to).
+	NewDevices(appID string, from, to time.Time) ([]*Device, error)
+	// Devices loads devices by id, leaving out those that do not exist.
+	Devices(ids []string) ([]*Device, error)
+
+	// Rollups lists the rollups of an application, or of one of its devices
+	// when deviceID is set, of the periods starting in [from, to).
+	Rollups(appID, deviceID string, period RollupPeriod, from, to time.Time) ([]*Rollup, error)
+	// ActiveDevices counts the devices active in the periods of an
+	// application starting in [from, to), each device once.
+	ActiveDevices(appID string, period RollupPeriod, from, to time.Time) (int64, error)
+}
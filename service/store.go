@@ -0,0 +1,89 @@
+package service
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned by a Store for records that do not exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrDeviceApplication is returned for a device id that is already used by
+// another application.
+var ErrDeviceApplication = errors.New("device belongs to another application")
+
+// Cursor is the position after the last row of a page.
+type Cursor struct {
+	Time *time.Time
+	ID   int64
+}
+
+// Page selects a page of a list. Lists of applications and devices are
+// paged by Offset, sessions and messages continue after a Cursor.
+type Page struct {
+	Size   int
+	Desc   bool
+	Offset int
+	After  *Cursor
+}
+
+// MessageFilter selects the messages of a session, optionally only those
+// logged in [Start, End].
+type MessageFilter struct {
+	SessionID int32
+	Start     time.Time
+	End       time.Time
+}
+
+// Store keeps applications, devices, sessions and messages for the RPCs
+// that create, load and list them and for ingestion. Methods that load a
+// single record return ErrNotFound when there is none, so do those of the
+// stores of alerts, webhooks, saved searches, retention, anomalies,
+// patterns, segments and stats. GormStore implements all of them,
+// MemoryStore only this one. Rollups, exports, retention runs and archiving
+// work on the database directly.
+type Store interface {
+	AddWaitlistUser(email string) error
+
+	// GetOrCreateApplication returns the application with the id of app,
+	// and creates it from app if there is none.
+	GetOrCreateApplication(app *Application) (*Application, error)
+	Application(id string) (*Application, error)
+	CountApplications(userID string) (int64, error)
+	// ListApplications lists the applications of a user by creation time.
+	ListApplications(userID string, page Page) ([]*Application, error)
+	SetDigest(appID string, enabled bool) error
+	// DigestApplications lists the applications with digests enabled.
+	DigestApplications() ([]*Application, error)
+
+	// GetOrCreateDevice returns the device with the id of device, and
+	// creates it from device if there is none. It reports whether the
+	// device was created, and returns ErrDeviceApplication when the device
+	// exists for another application.
+	GetOrCreateDevice(device *Device) (*Device, bool, error)
+	Device(id string) (*Device, error)
+	CountDevices(appID string) (int64, error)
+	// ListDevices lists the devices of an application by creation time.
+	ListDevices(appID string, page Page) ([]*Device, error)
+
+	CreateSession(session *Session) error
+	Session(id int32) (*Session, error)
+	CountSessions(appID, deviceID string) (int64, error)
+	// ListSessions lists the sessions of a device by id.
+	ListSessions(appID, deviceID string, page Page) ([]*Session, error)
+	// EndSession writes the status and end of a live session. It reports
+	// false when the session was not live anymore.
+	EndSession(session *Session) (bool, error)
+	// IdleSessions lists the live sessions without messages since cutoff.
+	IdleSessions(cutoff time.Time) ([]*Session, error)
+	// AddSessionMessage counts a message received for a session at t.
+	AddSessionMessage(sessionID int32, t time.Time, crashed bool) error
+
+	CreateMessage(msg *Message) error
+	// Message loads a message, from its segment if its session is archived.
+	Message(id int) (*Message, error)
+	// CountMessages and ListMessages also read archived sessions.
+	CountMessages(sessionID int32) (int64, error)
+	// ListMessages lists the messages of a session by timestamp and id.
+	ListMessages(filter MessageFilter, page Page) ([]*Message, error)
+}
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"time"
+)
+
+// Headers sent with every webhook delivery.
+const (
+	WebhookEventHeader     = "X-Loggy-Event"
+	WebhookDeliveryHeader  = "X-Loggy-Delivery"
+	WebhookTimestampHeader = "X-Loggy-Timestamp"
+	WebhookSignatureHeader = "X-Loggy-Signature"
+)
+
+type Webhook struct {
+	Base
+	ID         int32
+	AppID      string `gorm:"column:application_id;not null;index"`
+	UserID     string `gorm:"column:user_id;not null;"`
+	URL        string
+	Secret     string
+	EventTypes string // comma separated, empty for all types
+}
+
+// Types returns the notification types the webhook is subscribed to.
+func (w *Webhook) Types() []string {
+	if len(w.EventTypes) == 0 {
+		return nil
+	}
+	return strings.Split(w.EventTypes, ",")
+}
+
+// Accepts reports whether the webhook is subscribed to eventType. Types
+// ending in ".*" match every type with that prefix.
+func (w *Webhook) Accepts(eventType string) bool {
+	types := w.Types()
+	if len(types) == 0 {
+		return true
+	}
+	for _, t := range types {
+		if t == eventType {
+			return true
+		}
+		if strings.HasSuffix(t, ".*") && strings.HasPrefix(eventType, strings.TrimSuffix(t, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+type DeliveryStatus int
+
+const (
+	DeliveryPending DeliveryStatus = iota
+	DeliveryDelivered
+	DeliveryRetrying
+	DeliveryDead
+)
+
+type WebhookDelivery struct {
+	ID            int32
+	CreatedAt     time.Time
+	UpdatedAt     time.Time
+	WebhookID     int32 `gorm:"index"`
+	EventType     string
+	Payload       string
+	Status        DeliveryStatus `gorm:"index"`
+	Attempts      int32
+	NextAttemptAt time.Time `gorm:"index"`
+	ResponseCode  int32
+	LastError     string
+	DeliveredAt   *time.Time
+}
+
+// SignWebhook returns the signature of a delivery body, a hex encoded
+// HMAC-SHA256 of the timestamp and the body joined by a dot.
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook checks a signature produced by SignWebhook.
+func VerifyWebhook(secret, timestamp string, body []byte, signature string) bool {
+	return hmac.Equal([]byte(SignWebhook(secret, timestamp, body)), []byte(signature))
+}
+
+// WebhookStore keeps webhooks and their deliveries for the webhook RPCs.
+// Webhooks of other users are not found.
+type WebhookStore interface {
+	Webhook(id int32, userID string) (*Webhook, error)
+	CreateWebhook(webhook *Webhook) error
+	DeleteWebhook(webhook *Webhook) error
+	ListWebhooks(appID string) ([]*Webhook, error)
+
+	WebhookDelivery(id int32) (*WebhookDelivery, error)
+	SaveWebhookDelivery(delivery *WebhookDelivery) error
+	// ListWebhookDeliveries lists the deliveries of a webhook, newest
+	// first, only the dead ones if deadOnly is set.
+	ListWebhookDeliveries(webhookID int32, deadOnly bool) ([]*WebhookDelivery, error)
+}